@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gobackup/internal/backup"
+	"gobackup/internal/repository"
+	"gobackup/internal/restore"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	exportFormat string
+	exportOutput string
+	importRoot   string
+)
+
+func newExportCommand() *cobra.Command {
+	exportCmd := &cobra.Command{
+		Use:   "export [path|glob...]",
+		Short: "Write backed up files as a tar, tar.gz or zip archive",
+		Long: "Streams the backed up files straight from the repository into an archive, without\n" +
+			"restoring them first. Arguments select files by path, directory or glob pattern,\n" +
+			"without any every file is exported. The archive goes to stdout unless --output is given.",
+		RunE: runExport,
+	}
+	exportCmd.Flags().StringVar(&exportFormat, "format", "", "Archive format: tar, tar.gz or zip (default from the --output extension, else tar)")
+	exportCmd.Flags().StringVarP(&exportOutput, "output", "o", "", "File to write the archive to (default stdout)")
+	return exportCmd
+}
+
+func newImportCommand() *cobra.Command {
+	importCmd := &cobra.Command{
+		Use:   "import ARCHIVE",
+		Short: "Add the files of a tar or tar.gz archive to --backup",
+		Long: "Reads a tar archive (gzipped or not, - for stdin) and stores its regular files in the\n" +
+			"repository with their modification times and modes, under a root of their own (--root),\n" +
+			"so watch sessions backing up named roots into the same repository leave them alone.\n" +
+			"Importing into the same root again replaces files with the same path. Restore or export\n" +
+			"them with --root NAME.",
+		Args: cobra.ExactArgs(1),
+		RunE: runImport,
+	}
+	importCmd.Flags().StringVar(&importRoot, "root", "imported", "Root to store the imported files under")
+	return importCmd
+}
+
+func runExport(cmd *cobra.Command, args []string) error {
+	format := exportFormat
+	if format == "" {
+		format = formatFromName(exportOutput)
+	}
+	for _, pattern := range args {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockShared(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	key, err := unlockRepository(backend)
+	if err != nil {
+		return err
+	}
+
+	engine, err := restore.NewEngine(backend, "")
+	if err != nil {
+		return err
+	}
+	engine.SetMasterKey(key)
+	if err := engine.InitializeWithoutTarget(); err != nil {
+		return fmt.Errorf("failed to initialize restore engine: %w", err)
+	}
+
+	var out io.Writer = os.Stdout
+	if exportOutput != "" && exportOutput != "-" {
+		f, err := os.Create(exportOutput)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", exportOutput, err)
+		}
+		defer f.Close()
+		out = f
+	}
+
+	report, err := engine.Export(out, format, exportSelector(args))
+	if err != nil {
+		return fmt.Errorf("export failed: %w", err)
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write %s: %w", exportOutput, err)
+		}
+	}
+
+	// stdout may be the archive, the summary goes to stderr
+	fmt.Fprintf(os.Stderr, "Exported %d files (%.1f MB) as %s\n", report.Files, float64(report.Bytes)/(1024*1024), format)
+	if report.Failed > 0 {
+		return fmt.Errorf("%d files could not be exported", report.Failed)
+	}
+	return nil
+}
+
+func runImport(cmd *cobra.Command, args []string) error {
+	var in io.Reader = os.Stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", args[0], err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	backend, _, err := openRepository()
+	if err != nil {
+		if errors.Is(err, repository.ErrNotRepository) {
+			return fmt.Errorf("%w, create it with init first", err)
+		}
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	key, err := unlockRepository(backend)
+	if err != nil {
+		return err
+	}
+
+	engine := backup.NewEngine("", backend)
+	engine.SetMasterKey(key)
+	if err := engine.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize backup engine: %w", err)
+	}
+	defer engine.Shutdown()
+
+	source := args[0]
+	if source == "-" {
+		source = "stdin"
+	}
+	report, err := engine.ImportTar(in, importRoot, source)
+	if err != nil {
+		return fmt.Errorf("import failed: %w", err)
+	}
+
+	fmt.Printf("Imported %d files (%.1f MB) under %s/ into %d chunks, %d were already stored\n",
+		report.Files, float64(report.Bytes)/(1024*1024), importRoot, report.Chunks, report.Existing)
+	if report.Skipped > 0 {
+		fmt.Printf("%d entries skipped (links, special files or invalid paths)\n", report.Skipped)
+	}
+	return nil
+}
+
+func formatFromName(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return restore.FormatTarGz
+	case strings.HasSuffix(name, ".zip"):
+		return restore.FormatZip
+	default:
+		return restore.FormatTar
+	}
+}
+
+// exportSelector matches a file against the export arguments: a path, a directory or a glob.
+func exportSelector(patterns []string) func(string) bool {
+	if len(patterns) == 0 {
+		return nil
+	}
+	for i, pattern := range patterns {
+		patterns[i] = strings.Trim(path.Clean(pattern), "/")
+	}
+	return func(file string) bool {
+		for _, pattern := range patterns {
+			if pattern == "." || file == pattern || strings.HasPrefix(file, pattern+"/") {
+				return true
+			}
+			if ok, _ := path.Match(pattern, file); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"gobackup/internal/backup"
+	"gobackup/internal/repository"
+	"gobackup/internal/restore"
+	"gobackup/internal/storage"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	copyFrom               string
+	copyFromKeyFile        string
+	copyFromPassphraseFile string
+)
+
+func newCopyCommand() *cobra.Command {
+	copyCmd := &cobra.Command{
+		Use:   "copy",
+		Short: "Copy backups from another repository into --backup",
+		Long: "Copies chunks and file entries from the --from repository into the --backup repository.\n" +
+			"Only chunks missing from --backup are transferred, re-encrypted with its key. Running it\n" +
+			"again copies what is new, an interrupted copy continues where it stopped.",
+		RunE: runCopy,
+	}
+	copyCmd.Flags().StringVar(&copyFrom, "from", "", "Repository to copy from")
+	copyCmd.Flags().StringVar(&copyFromKeyFile, "from-key-file", "", "Key file of the --from repository")
+	copyCmd.Flags().StringVar(&copyFromPassphraseFile, "from-passphrase-file", "", "File containing the passphrase of the --from repository")
+	return copyCmd
+}
+
+func runCopy(cmd *cobra.Command, args []string) error {
+	if copyFrom == "" {
+		return fmt.Errorf("--from is required")
+	}
+
+	settings, err := storage.LoadSettings(storageConfig)
+	if err != nil {
+		return err
+	}
+	source, err := storage.Open(copyFrom, settings)
+	if err != nil {
+		return fmt.Errorf("cannot open repository %s: %w", copyFrom, err)
+	}
+	defer source.Close()
+	sourceCfg, err := repository.Open(source)
+	if err != nil {
+		return fmt.Errorf("cannot open repository %s: %w", copyFrom, err)
+	}
+
+	backend, cfg, err := openRepository()
+	if err != nil {
+		if errors.Is(err, repository.ErrNotRepository) {
+			return fmt.Errorf("%w, create the destination with init first", err)
+		}
+		return err
+	}
+	defer backend.Close()
+	if cfg.ID == sourceCfg.ID {
+		return fmt.Errorf("--from and --backup are the same repository")
+	}
+
+	sourceLock, err := repository.LockShared(source)
+	if err != nil {
+		return err
+	}
+	defer sourceLock.Unlock()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	sourceKey, _, err := unlockSlotWith(source, func() ([]byte, error) {
+		return readSecretFrom(copyFromKeyFile, copyFromPassphraseFile, "GOBACKUP_FROM_PASSPHRASE", "Enter passphrase of the source repository: ")
+	})
+	if err != nil {
+		return err
+	}
+	key, err := unlockRepository(backend)
+	if err != nil {
+		return err
+	}
+
+	reader, err := restore.NewEngine(source, "")
+	if err != nil {
+		return err
+	}
+	reader.SetMasterKey(sourceKey)
+	if err := reader.InitializeWithoutTarget(); err != nil {
+		return fmt.Errorf("failed to read %s: %w", copyFrom, err)
+	}
+
+	engine := backup.NewEngine("", backend)
+	engine.SetMasterKey(key)
+	if err := engine.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize backup engine: %w", err)
+	}
+	defer engine.Shutdown()
+
+	log.Printf("Copying %s to %s", copyFrom, backupPath)
+	report, err := engine.CopyFrom(reader)
+	if err != nil {
+		return fmt.Errorf("copy failed, run it again to continue: %w", err)
+	}
+
+	fmt.Printf("Copied %d of %d chunks (%.1f MB), %d were already there\n",
+		report.Copied, report.Chunks, float64(report.CopiedBytes)/(1024*1024), report.Existing)
+	fmt.Printf("Files: %d updated, %d unchanged\n", report.FilesUpdated, report.FilesUnchanged)
+	if report.Unreadable > 0 {
+		fmt.Printf("%d chunks could not be read from %s\n", report.Unreadable, copyFrom)
+	}
+	if report.FilesSkipped > 0 {
+		fmt.Printf("%d files were not copied because their chunks are missing\n", report.FilesSkipped)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"gobackup/internal/encryption"
+	"gobackup/internal/metadata"
+	"gobackup/internal/repository"
+
+	"github.com/spf13/cobra"
+)
+
+var newKeyFile string
+
+/*
+key commands manage the slots wrapping the repository master key:
+list, add, passwd and remove. None of them touch chunk data.
+*/
+func newKeyCommand() *cobra.Command {
+	keyCmd := &cobra.Command{
+		Use:   "key",
+		Short: "Manage repository encryption keys",
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List key slots",
+		RunE:  runKeyList,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "Add a passphrase or key file (enables encryption on an empty repository)",
+		RunE:  runKeyAdd,
+	}
+	addCmd.Flags().StringVar(&newKeyFile, "new-key-file", "", "Generate a key file at this path instead of asking for a passphrase")
+
+	passwdCmd := &cobra.Command{
+		Use:   "passwd",
+		Short: "Change the passphrase of the slot used to unlock",
+		RunE:  runKeyPasswd,
+	}
+
+	removeCmd := &cobra.Command{
+		Use:   "remove <slot-id>",
+		Short: "Remove a key slot",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runKeyRemove,
+	}
+
+	keyCmd.AddCommand(listCmd, addCmd, passwdCmd, removeCmd)
+	return keyCmd
+}
+
+func runKeyList(cmd *cobra.Command, args []string) error {
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	slots, err := encryption.NewKeyStore(backend).List()
+	if err != nil {
+		return err
+	}
+	if len(slots) == 0 {
+		fmt.Println("Repository is not encrypted")
+		return nil
+	}
+
+	fmt.Printf("%-16s  %-10s  %-30s  %s\n", "ID", "KIND", "CREATED BY", "CREATED AT")
+	for _, slot := range slots {
+		fmt.Printf("%-16s  %-10s  %-30s  %s\n",
+			slot.ID, slot.Kind, slot.Username+"@"+slot.Host, slot.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	return nil
+}
+
+func runKeyAdd(cmd *cobra.Command, args []string) error {
+	backend, cfg, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	store := encryption.NewKeyStore(backend)
+	hasKeys, err := store.HasKeys()
+	if err != nil {
+		return err
+	}
+
+	var master *encryption.MasterKey
+	if hasKeys {
+		master, err = unlockRepository(backend)
+		if err != nil {
+			return err
+		}
+	} else {
+		// we never re-encrypt chunks, so encryption can only be switched on before the first backup
+		meta := metadata.NewManager(backend)
+		if err := meta.LoadMetadata(); err != nil {
+			return fmt.Errorf("failed to load metadata: %w", err)
+		}
+		if len(meta.GetMetadata().Chunks) > 0 {
+			return fmt.Errorf("repository already contains unencrypted chunks, encryption must be enabled before the first backup")
+		}
+	}
+
+	kind := encryption.SlotPassphrase
+	var secret []byte
+	if newKeyFile != "" {
+		kind = encryption.SlotKeyFile
+		secret, err = encryption.GenerateKeyFile(newKeyFile)
+	} else {
+		secret, err = promptNewPassphrase()
+	}
+	if err != nil {
+		return err
+	}
+
+	var slot *encryption.KeySlot
+	if master == nil {
+		_, slot, err = store.Create(secret, kind)
+	} else {
+		slot, err = store.AddSlot(master, secret, kind)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add key: %w", err)
+	}
+
+	if !cfg.Encrypted() {
+		cfg.SetEncrypted(true)
+		if err := repository.SaveConfig(backend, cfg); err != nil {
+			return fmt.Errorf("failed to update repository config: %w", err)
+		}
+	}
+
+	fmt.Printf("Added %s key slot %s\n", slot.Kind, slot.ID)
+	if newKeyFile != "" {
+		fmt.Printf("Key file written to %s, keep it safe\n", newKeyFile)
+	}
+	return nil
+}
+
+func runKeyPasswd(cmd *cobra.Command, args []string) error {
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	master, slot, err := unlockSlot(backend)
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		return fmt.Errorf("repository is not encrypted")
+	}
+	if slot.Kind != encryption.SlotPassphrase {
+		return fmt.Errorf("slot %s is a key file, add a new key and remove this one instead", slot.ID)
+	}
+
+	secret, err := promptNewPassphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := encryption.NewKeyStore(backend).ChangeSecret(slot, master, secret); err != nil {
+		return fmt.Errorf("failed to change passphrase: %w", err)
+	}
+
+	fmt.Printf("Passphrase changed for key slot %s\n", slot.ID)
+	return nil
+}
+
+func runKeyRemove(cmd *cobra.Command, args []string) error {
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	master, slot, err := unlockSlot(backend)
+	if err != nil {
+		return err
+	}
+	if master == nil {
+		return fmt.Errorf("repository is not encrypted")
+	}
+	if slot.ID == args[0] {
+		return fmt.Errorf("refusing to remove key slot %s, it is the one used to unlock", slot.ID)
+	}
+
+	if err := encryption.NewKeyStore(backend).Remove(args[0]); err != nil {
+		return err
+	}
+
+	fmt.Printf("Removed key slot %s\n", args[0])
+	return nil
+}
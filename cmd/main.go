@@ -4,12 +4,16 @@ import (
 	"context"
 	"fmt"
 	"gobackup/internal/backup"
+	"gobackup/internal/filter"
+	"gobackup/internal/replica"
+	"gobackup/internal/repository"
 	"gobackup/internal/restore"
 	"gobackup/internal/watcher"
 	"gobackup/pkg/models"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,13 +21,36 @@ import (
 )
 
 var (
-	watchPath   string
+	watchPaths  []string
 	backupPath  string
 	targetPath  string
 	refreshRate int
 	restoreMode bool
 	listMode    bool
 	verifyMode  bool
+	deepVerify  bool
+	rootFilter  []string
+
+	storageConfig string
+	replicaPaths  []string
+
+	excludePatterns []string
+	includePatterns []string
+	excludeFile     string
+	excludeLarger   string
+	excludeOlder    string
+	excludeTypes    []string
+	oneFileSystem   bool
+	excludeCaches   bool
+
+	batchWindow time.Duration
+	batchSize   int
+	settleTime  time.Duration
+	settleRules []string
+
+	watchMode    string
+	pollInterval time.Duration
+	pollRate     int
 )
 
 func main() {
@@ -32,15 +59,42 @@ func main() {
 		Short: "A file backup and restore system",
 		Long:  "A comprehensive file backup system with real-time monitoring and chunked storage",
 		Run:   runApp,
+		// errors are printed below, subcommands shouldn't dump usage on every failure
+		SilenceUsage:  true,
+		SilenceErrors: true,
 	}
 
-	rootCmd.Flags().StringVar(&watchPath, "watch", "", "Directory to watch for changes")
-	rootCmd.Flags().StringVar(&backupPath, "backup", "", "Directory to store backup files")
+	rootCmd.Flags().StringArrayVar(&watchPaths, "watch", nil, "Directory to watch for changes, NAME=DIR to name it, DIR:poll (or :notify, :auto) overrides --watch-mode for it (can be repeated, every directory is a root of the repository)")
+	rootCmd.PersistentFlags().StringVar(&backupPath, "backup", "", "Directory to store backup files, or a repository URL (s3:bucket/prefix, sftp:user@host:/path, rest:https://host:8000/)")
+	rootCmd.PersistentFlags().StringVar(&storageConfig, "storage-config", "", "JSON file with endpoints and credentials for remote repositories")
+	rootCmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "Key file for encrypted repositories (unattended mode)")
+	rootCmd.PersistentFlags().StringVar(&passphraseFile, "passphrase-file", "", "File containing the repository passphrase")
 	rootCmd.Flags().StringVar(&targetPath, "target", "", "Target directory for restore (restore mode only)")
+	rootCmd.Flags().StringArrayVar(&replicaPaths, "replicate", nil, "With --watch, also keep this repository in sync (can be repeated)")
+	rootCmd.Flags().StringArrayVar(&excludePatterns, "exclude", nil, "With --watch, skip files matching this gitignore-style pattern (can be repeated)")
+	rootCmd.Flags().StringArrayVar(&includePatterns, "include", nil, "With --watch, back up files matching this pattern even if excluded (can be repeated)")
+	rootCmd.Flags().StringVar(&excludeFile, "exclude-file", "", "With --watch, file with gitignore-style exclude patterns (.gobackupignore files are always read)")
+	rootCmd.Flags().StringVar(&excludeLarger, "exclude-larger-than", "", "With --watch, skip files larger than this (e.g. 2G, 500M)")
+	rootCmd.Flags().StringVar(&excludeOlder, "exclude-older-than", "", "With --watch, skip files not modified within this age or since this date (e.g. 90d, 2024-01-31)")
+	rootCmd.Flags().StringSliceVar(&excludeTypes, "exclude-type", nil, "With --watch, skip files of these types: symlink (sockets, fifos and devices are always skipped)")
+	rootCmd.Flags().BoolVar(&oneFileSystem, "one-file-system", false, "With --watch, don't cross into other filesystems")
+	rootCmd.Flags().BoolVar(&excludeCaches, "exclude-caches", false, "With --watch, skip directories containing a CACHEDIR.TAG")
+	rootCmd.Flags().DurationVar(&batchWindow, "batch-window", backup.DefaultBatchWindow, "With --watch, how long changes are gathered into one backup")
+	rootCmd.Flags().IntVar(&batchSize, "batch-size", backup.DefaultMaxBatchSize, "With --watch, back up a batch as soon as it has this many changes")
+	rootCmd.Flags().DurationVar(&settleTime, "settle-time", backup.DefaultSettleTime, "With --watch, how long a file must stay unchanged before it is backed up")
+	rootCmd.Flags().StringArrayVar(&settleRules, "settle", nil, "With --watch, settle time for files matching a pattern, e.g. '*.iso=30s' (can be repeated)")
+	rootCmd.Flags().StringVar(&watchMode, "watch-mode", watcher.ModeAuto, "With --watch, how changes are found: notify, poll, or auto (poll on network filesystems)")
+	rootCmd.Flags().DurationVar(&pollInterval, "poll-interval", watcher.DefaultPollInterval, "With --watch, how often a polled directory is walked")
+	rootCmd.Flags().IntVar(&pollRate, "poll-rate", 0, "With --watch, stat at most this many files per second while polling (0 for no limit)")
 	rootCmd.Flags().IntVar(&refreshRate, "refresh", 300, "Full scan interval in seconds")
 	rootCmd.Flags().BoolVar(&restoreMode, "restore", false, "Enable restore mode")
 	rootCmd.Flags().BoolVar(&listMode, "list", false, "List files in backup")
+	rootCmd.Flags().StringArrayVar(&rootFilter, "root", nil, "With --restore or --list, only this root (can be repeated, a single root is restored straight into --target)")
 	rootCmd.Flags().BoolVar(&verifyMode, "verify", false, "Verify backup integrity")
+	rootCmd.Flags().BoolVar(&deepVerify, "deep", false, "With --verify, read back every chunk and repair damaged ones from parity")
+
+	rootCmd.AddCommand(newKeyCommand(), newInitCommand(), newMigrateCommand(), newUnlockCommand(), newRepairCommand(), newServeCommand(), newCopyCommand(),
+		newExportCommand(), newImportCommand())
 
 	if err := rootCmd.Execute(); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
@@ -64,7 +118,7 @@ func runApp(cmd *cobra.Command, args []string) {
 	if restoreMode {
 		modeCount++
 	}
-	if watchPath != "" {
+	if len(watchPaths) > 0 {
 		modeCount++
 	}
 
@@ -109,7 +163,7 @@ func runApp(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	if watchPath != "" {
+	if len(watchPaths) > 0 {
 		if err := runBackup(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error during backup: %v\n", err)
 			os.Exit(1)
@@ -124,6 +178,8 @@ Usage Examples:
 
 1. Start backup monitoring (watch mode):
    %s --watch /path/to/watch --backup /path/to/backup --refresh 60
+   %s --watch /path/to/watch --backup /path/to/backup --exclude node_modules/ --exclude '*.swp'
+   %s --watch /path/to/watch --backup /path/to/backup --exclude-larger-than 2G --one-file-system --exclude-caches
 
 2. Restore from backup:
    %s --restore --backup /path/to/backup --target /path/to/restore
@@ -131,44 +187,167 @@ Usage Examples:
 3. List files in backup:
    %s --list --backup /path/to/backup
 
-4. Verify backup integrity:
+4. Verify backup integrity (--deep reads every chunk and repairs from parity):
    %s --verify --backup /path/to/backup
+   %s --verify --deep --backup /path/to/backup
+
+5. Create an encrypted repository / manage keys:
+   %s init --encrypt --backup /path/to/backup
+   %s key add --backup /path/to/backup
+   %s key list --backup /path/to/backup
+
+6. Upgrade a repository created by an older version:
+   %s migrate --backup /path/to/backup
+
+7. Back up to S3-compatible storage (credentials from AWS_ACCESS_KEY_ID /
+   AWS_SECRET_ACCESS_KEY or a --storage-config file):
+   %s init --backup s3:my-bucket/laptop
+   %s --watch /path/to/watch --backup s3:http://localhost:9000/my-bucket/laptop
+
+8. Back up over SFTP (SSH key auth, host must be in known_hosts):
+   %s --watch /path/to/watch --backup sftp:backup@nas:/srv/backups/laptop
+
+9. Back up to a local disk and keep an off-site copy in sync:
+   %s --watch /path/to/watch --backup /path/to/backup --replicate sftp:backup@offsite:/srv/backups/laptop
+
+10. Copy backups into another repository (only missing chunks are transferred):
+   %s copy --from /path/to/backup --backup s3:archive-bucket/laptop
+
+11. Serve a repository over HTTPS, append-only, and back up to it:
+   %s serve --backup /srv/repo --listen :8000 --htpasswd users.htpasswd --tls-cert cert.pem --tls-key key.pem --append-only
+   %s --watch /path/to/watch --backup rest:https://nas:8000/ --storage-config rest.json
+
+12. Export files as an archive / import a tarball:
+   %s export --backup /path/to/backup -o photos.tar.gz photos/
+   %s import --backup /path/to/backup old-backup.tar.gz
+
+13. Watch an NFS or SMB mount (polled automatically, or force it with --watch-mode poll, or :poll for one root):
+   %s --watch /mnt/nas/photos --backup /path/to/backup --watch-mode poll --poll-interval 1m --poll-rate 2000
+   %s --watch home=/home --watch photos=/mnt/nas/photos:poll --backup /path/to/backup
+
+14. Back up several directories into one repository, restore one of them:
+   %s --watch /etc --watch /home --watch data=/srv/data --backup /path/to/backup
+   %s --restore --backup /path/to/backup --root etc --target /tmp/etc
 
-`, os.Args[0], os.Args[0], os.Args[0], os.Args[0])
+`, os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0], os.Args[0])
 }
 func runBackup() error {
 	log.Printf("Starting backup system...")
-	log.Printf("Watch path: %s", watchPath)
+	roots, err := parseRoots(watchPaths)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		switch {
+		case root.Name != "" && root.Mode != "":
+			log.Printf("Watch path: %s (root %s, %s)", root.Path, root.Name, root.Mode)
+		case root.Name != "":
+			log.Printf("Watch path: %s (root %s)", root.Path, root.Name)
+		case root.Mode != "":
+			log.Printf("Watch path: %s (%s)", root.Path, root.Mode)
+		default:
+			log.Printf("Watch path: %s", root.Path)
+		}
+	}
 	log.Printf("Backup path: %s", backupPath)
 	log.Printf("Refresh rate: %d seconds", refreshRate)
 
-	if _, err := os.Stat(watchPath); os.IsNotExist(err) {
-		return fmt.Errorf("watch path does not exist: %s", watchPath)
+	for _, root := range roots {
+		if _, err := os.Stat(root.Path); os.IsNotExist(err) {
+			return fmt.Errorf("watch path does not exist: %s", root.Path)
+		}
 	}
 
-	engine := backup.NewEngine(watchPath, backupPath)
-	if err := engine.Initialize(); err != nil {
-		return fmt.Errorf("failed to initialize backup engine: %w", err)
+	backend, err := openBackend()
+	if err != nil {
+		return err
+	}
+	var replicated *replica.Replicated
+	if len(replicaPaths) > 0 {
+		replicated, err = openReplicas(backend)
+		if err != nil {
+			backend.Close()
+			return err
+		}
+		backend = replicated
 	}
+	defer backend.Close()
 
-	w, err := watcher.NewWatcher()
+	// keep the old "just point --backup at a new directory" workflow working
+	if empty, err := repository.IsEmpty(backend); err == nil && empty {
+		cfg, err := repository.NewConfig(repository.DefaultChunkSize, false)
+		if err != nil {
+			return err
+		}
+		if err := repository.Init(backend, cfg); err != nil {
+			return fmt.Errorf("failed to initialize repository: %w", err)
+		}
+		log.Printf("Initialized new repository at %s", backupPath)
+	}
+
+	lock, err := repository.LockExclusive(backend)
 	if err != nil {
-		return fmt.Errorf("failed to create watcher: %w", err)
+		return err
 	}
-	defer w.Close()
+	defer lock.Unlock()
 
-	if err := w.AddWatch(watchPath); err != nil {
-		return fmt.Errorf("failed to add watch path: %w", err)
+	key, err := unlockRepository(backend)
+	if err != nil {
+		return err
+	}
+
+	engine := backup.NewEngine("", backend)
+	engine.SetMasterKey(key)
+	rules := make([]*filter.Filter, len(roots))
+	for i, root := range roots {
+		if rules[i], err = newFilter(root.Path); err != nil {
+			return err
+		}
+		if err := engine.AddRoot(root.Name, root.Path, rules[i]); err != nil {
+			return err
+		}
+	}
+	engine.SetBatching(batchWindow, batchSize)
+	settle, err := parseSettleRules(settleRules)
+	if err != nil {
+		return err
+	}
+	engine.SetSettle(settleTime, settle)
+	if err := engine.Initialize(); err != nil {
+		return fmt.Errorf("failed to initialize backup engine: %w", err)
+	}
+
+	// one watcher per root, an NFS mount next to local disks gets polled on its own
+	watchers := make([]watcher.FileWatcher, len(roots))
+	for i, root := range roots {
+		mode := watchMode
+		if root.Mode != "" {
+			mode = root.Mode
+		}
+		w, err := watcher.New(root.Path, watcher.Options{Mode: mode, PollInterval: pollInterval, PollRate: pollRate})
+		if err != nil {
+			return fmt.Errorf("failed to create watcher: %w", err)
+		}
+		defer w.Close()
+		w.SetFilter(rules[i])
+
+		if err := w.AddWatch(root.Path); err != nil {
+			return fmt.Errorf("failed to add watch path: %w", err)
+		}
+		watchers[i] = w
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	changes, watchErrors := mergeWatchers(ctx, watchers)
 
 	if err := engine.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start backup engine: %w", err)
 	}
 
-	w.Start()
+	for _, w := range watchers {
+		w.Start()
+	}
 
 	log.Println("Performing initial full backup...")
 	if err := engine.PerformFullBackup(); err != nil {
@@ -181,6 +360,7 @@ func runBackup() error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	logWatchStatus(watchers)
 	log.Println("Backup system started. Press Ctrl+C to stop.")
 
 	for {
@@ -190,19 +370,12 @@ func runBackup() error {
 			engine.Shutdown()
 			return nil
 
-		case event := <-w.Changes():
-			changes := []models.FileChange{
-				{
-					Path:      event.Path,
-					Operation: event.Operation,
-				},
-			}
-
-			if err := engine.ProcessChanges(changes); err != nil {
+		case event := <-changes:
+			if err := engine.ProcessEvents([]models.FileEvent{event}); err != nil {
 				log.Printf("Error processing changes: %v", err)
 			}
 
-		case err := <-w.Errors():
+		case err := <-watchErrors:
 			log.Printf("Watcher error: %v", err)
 
 		case <-refreshTicker.C:
@@ -210,23 +383,104 @@ func runBackup() error {
 			if err := engine.PerformFullBackup(); err != nil {
 				log.Printf("Periodic backup failed: %v", err)
 			}
+			if replicated != nil {
+				logReplicaStatus(replicated)
+			}
+			logWatchStatus(watchers)
 		}
 	}
 }
 
+func logWatchStatus(watchers []watcher.FileWatcher) {
+	var status watcher.WatchStatus
+	for _, w := range watchers {
+		s := w.Status()
+		status.Watched += s.Watched
+		status.Polled += s.Polled
+	}
+	switch {
+	case status.Polled == 0:
+		log.Printf("Watches: %d directories", status.Watched)
+	case status.Watched == 0:
+		log.Printf("Watches: none, polling %d directories", status.Polled)
+	default:
+		log.Printf("Watches: %d directories, %d more polled", status.Watched, status.Polled)
+	}
+}
+
+func newFilter(root string) (*filter.Filter, error) {
+	opts := filter.Options{
+		Excludes:      excludePatterns,
+		Includes:      includePatterns,
+		ExcludeFile:   excludeFile,
+		ExcludeTypes:  excludeTypes,
+		OneFileSystem: oneFileSystem,
+		ExcludeCaches: excludeCaches,
+	}
+	if excludeLarger != "" {
+		size, err := filter.ParseSize(excludeLarger)
+		if err != nil {
+			return nil, fmt.Errorf("--exclude-larger-than: %w", err)
+		}
+		opts.MaxSize = size
+	}
+	if excludeOlder != "" {
+		age, date, err := filter.ParseCutoff(excludeOlder)
+		if err != nil {
+			return nil, fmt.Errorf("--exclude-older-than: %w", err)
+		}
+		opts.MaxAge, opts.NotBefore = age, date
+	}
+	return filter.New(root, opts)
+}
+
+// parseSettleRules reads --settle PATTERN=DURATION flags.
+func parseSettleRules(flags []string) ([]backup.SettleRule, error) {
+	var rules []backup.SettleRule
+	for _, flag := range flags {
+		i := strings.LastIndex(flag, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("--settle %q: expected PATTERN=DURATION", flag)
+		}
+		wait, err := time.ParseDuration(flag[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("--settle %q: %w", flag, err)
+		}
+		rules = append(rules, backup.SettleRule{Pattern: flag[:i], Wait: wait})
+	}
+	return rules, nil
+}
+
 func runRestore() error {
 	log.Printf("Starting restore operation...")
 	log.Printf("Backup path: %s", backupPath)
 	log.Printf("Target path: %s", targetPath)
 
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		return fmt.Errorf("backup path does not exist: %s", backupPath)
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockShared(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	key, err := unlockRepository(backend)
+	if err != nil {
+		return err
 	}
 
-	engine, err := restore.NewEngine(backupPath, targetPath)
+	engine, err := restore.NewEngine(backend, targetPath)
+	engine.SetMasterKey(key)
 	if err := engine.Initialize(); err != nil {
 		return fmt.Errorf("failed to initialize restore engine: %w", err)
 	}
+	if err := engine.SelectRoots(rootFilter); err != nil {
+		return err
+	}
 	engine.ListFiles()
 	if err != nil {
 		return fmt.Errorf("failed to initialize restore engine: %w", err)
@@ -241,27 +495,51 @@ func runRestore() error {
 }
 
 func listBackupFiles() error {
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		return fmt.Errorf("backup path does not exist: %s", backupPath)
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
 	}
+	defer backend.Close()
 
-	engine, err := restore.NewEngine(backupPath, "")
+	lock, err := repository.LockShared(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	engine, err := restore.NewEngine(backend, "")
 	if err := engine.InitializeWithoutTarget(); err != nil {
 		return fmt.Errorf("failed to initialize restore engine: %w", err)
 	}
 	if err != nil {
 		return fmt.Errorf("failed to initialize engine: %w", err)
 	}
+	if err := engine.SelectRoots(rootFilter); err != nil {
+		return err
+	}
 
 	return engine.ListFiles()
 }
 
 func verifyBackup() error {
-	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
-		return fmt.Errorf("backup path does not exist: %s", backupPath)
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	// deep verify rewrites repaired chunks, so it can't share the repository
+	lockRepository := repository.LockShared
+	if deepVerify {
+		lockRepository = repository.LockExclusive
+	}
+	lock, err := lockRepository(backend)
+	if err != nil {
+		return err
 	}
+	defer lock.Unlock()
 
-	engine, err := restore.NewEngine(backupPath, "")
+	engine, err := restore.NewEngine(backend, "")
 	if err := engine.InitializeWithoutTarget(); err != nil {
 		return fmt.Errorf("failed to initialize restore engine: %w", err)
 	}
@@ -269,6 +547,20 @@ func verifyBackup() error {
 		return fmt.Errorf("failed to initialize engine: %w", err)
 	}
 
+	if deepVerify {
+		key, err := unlockRepository(backend)
+		if err != nil {
+			return err
+		}
+		engine.SetMasterKey(key)
+
+		if err := engine.DeepVerify(); err != nil {
+			return fmt.Errorf("deep verification failed: %w", err)
+		}
+		fmt.Println("Deep verification completed successfully!")
+		return nil
+	}
+
 	if err := engine.ValidateBackup(); err != nil {
 		return fmt.Errorf("backup validation failed: %w", err)
 	}
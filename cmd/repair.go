@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/restore"
+
+	"github.com/spf13/cobra"
+)
+
+func newRepairCommand() *cobra.Command {
+	repairCmd := &cobra.Command{
+		Use:   "repair",
+		Short: "Repair a damaged repository",
+	}
+
+	indexCmd := &cobra.Command{
+		Use:   "index",
+		Short: "Rebuild the metadata index from the chunk headers and link records",
+		RunE:  runRepairIndex,
+	}
+
+	repairCmd.AddCommand(indexCmd)
+	return repairCmd
+}
+
+func runRepairIndex(cmd *cobra.Command, args []string) error {
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	key, err := unlockRepository(backend)
+	if err != nil {
+		return err
+	}
+
+	engine, err := restore.NewEngine(backend, "")
+	if err != nil {
+		return err
+	}
+	engine.SetMasterKey(key)
+
+	report, err := engine.RebuildIndex()
+	if err != nil {
+		return fmt.Errorf("failed to rebuild index: %w", err)
+	}
+
+	fmt.Printf("Rebuilt index from %d chunks and %d link records: %d files recovered\n", report.Chunks, report.Links, report.Files)
+	if report.Roots > 0 {
+		fmt.Printf("%d named roots recovered\n", report.Roots)
+	}
+	if report.Headerless > 0 {
+		fmt.Printf("%d chunks predate chunk headers, files stored only in them could not be recovered\n", report.Headerless)
+	}
+	if report.Unreadable > 0 {
+		fmt.Printf("%d chunks or link records could not be read and were left out\n", report.Unreadable)
+	}
+	if report.Lost > 0 {
+		fmt.Printf("%d files refer to chunks that are gone and were left out\n", report.Lost)
+	}
+	if report.Links == 0 {
+		fmt.Println("Note: no link records found, if an older version wrote this repository its deleted files show up as active again and deduplicated or renamed files are missing")
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"gobackup/internal/encryption"
+	"gobackup/internal/replica"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"log"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	initChunkSizeMB int64
+	initEncrypt     bool
+	initParityData  int
+	initParityExtra int
+	unlockAll       bool
+)
+
+func newInitCommand() *cobra.Command {
+	initCmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create a new backup repository",
+		RunE:  runInit,
+	}
+	initCmd.Flags().Int64Var(&initChunkSizeMB, "chunk-size", repository.DefaultChunkSize/(1024*1024), "Chunk size in MB")
+	initCmd.Flags().BoolVar(&initEncrypt, "encrypt", false, "Encrypt the repository")
+	initCmd.Flags().StringVar(&newKeyFile, "new-key-file", "", "With --encrypt, generate a key file instead of asking for a passphrase")
+	initCmd.Flags().IntVar(&initParityData, "parity-data", 0, "Chunks per parity group (0 disables parity)")
+	initCmd.Flags().IntVar(&initParityExtra, "parity-shards", 2, "Parity files per group, how many files a group can lose")
+	return initCmd
+}
+
+func newMigrateCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade a repository to the current format",
+		RunE:  runMigrate,
+	}
+}
+
+func newUnlockCommand() *cobra.Command {
+	unlockCmd := &cobra.Command{
+		Use:   "unlock",
+		Short: "Remove stale locks left behind by crashed processes",
+		RunE:  runUnlock,
+	}
+	unlockCmd.Flags().BoolVar(&unlockAll, "remove-all", false, "Remove all locks, including ones that still look alive")
+	return unlockCmd
+}
+
+// openBackend connects to the --backup location.
+func openBackend() (storage.Backend, error) {
+	if backupPath == "" {
+		return nil, fmt.Errorf("--backup path is required")
+	}
+
+	settings, err := storage.LoadSettings(storageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := storage.Open(backupPath, settings)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open repository %s: %w", backupPath, err)
+	}
+	return backend, nil
+}
+
+// openReplicas connects to every --replicate location, mirrors of the primary backend.
+func openReplicas(primary storage.Backend) (*replica.Replicated, error) {
+	settings, err := storage.LoadSettings(storageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var mirrors []storage.Backend
+	closeAll := func() {
+		for _, mirror := range mirrors {
+			mirror.Close()
+		}
+	}
+	for _, location := range replicaPaths {
+		if location == backupPath {
+			closeAll()
+			return nil, fmt.Errorf("--replicate %s is the --backup repository itself", location)
+		}
+		mirror, err := storage.Open(location, settings)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("cannot open replica %s: %w", location, err)
+		}
+		mirrors = append(mirrors, mirror)
+	}
+
+	for _, mirror := range mirrors {
+		log.Printf("Replicating to %s", mirror.Location())
+	}
+	return replica.New(primary, mirrors), nil
+}
+
+func logReplicaStatus(replicated *replica.Replicated) {
+	for _, status := range replicated.Status() {
+		switch {
+		case status.Disabled:
+			log.Printf("Replica %s: disabled, %v", status.Location, status.LastError)
+		case !status.Online:
+			log.Printf("Replica %s: offline, %d files queued, last error: %v", status.Location, status.Pending, status.LastError)
+		default:
+			log.Printf("Replica %s: online, %d files queued", status.Location, status.Pending)
+		}
+	}
+}
+
+// openRepository is the format check every command goes through before touching the repo.
+func openRepository() (storage.Backend, *repository.Config, error) {
+	backend, err := openBackend()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg, err := repository.Open(backend)
+	if err != nil {
+		backend.Close()
+		return nil, nil, fmt.Errorf("cannot open repository %s: %w", backupPath, err)
+	}
+	return backend, cfg, nil
+}
+
+func runInit(cmd *cobra.Command, args []string) error {
+	if initChunkSizeMB <= 0 {
+		return fmt.Errorf("--chunk-size must be positive")
+	}
+	if initParityData < 0 || (initParityData > 0 && initParityExtra <= 0) {
+		return fmt.Errorf("--parity-data and --parity-shards must be positive")
+	}
+
+	backend, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	// ask before creating anything so a typo doesn't leave a half set up repository
+	var secret []byte
+	kind := encryption.SlotPassphrase
+	if initEncrypt && newKeyFile == "" {
+		secret, err = promptNewPassphrase()
+		if err != nil {
+			return err
+		}
+	}
+
+	cfg, err := repository.NewConfig(initChunkSizeMB*1024*1024, initEncrypt)
+	if err != nil {
+		return err
+	}
+	if initParityData > 0 {
+		cfg.ParityData = initParityData
+		cfg.ParityShards = initParityExtra
+	}
+	if err := repository.Init(backend, cfg); err != nil {
+		return fmt.Errorf("failed to initialize repository: %w", err)
+	}
+
+	if initEncrypt {
+		if newKeyFile != "" {
+			kind = encryption.SlotKeyFile
+			secret, err = encryption.GenerateKeyFile(newKeyFile)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, _, err := encryption.NewKeyStore(backend).Create(secret, kind); err != nil {
+			return fmt.Errorf("failed to create key: %w", err)
+		}
+	}
+
+	fmt.Printf("Created repository %s at %s (format %d, encryption: %s)\n",
+		cfg.ID, backupPath, cfg.FormatVersion, cfg.Encryption)
+	if cfg.ParityEnabled() {
+		fmt.Printf("Parity: %d parity files for every %d chunks\n", cfg.ParityShards, cfg.ParityData)
+	}
+	return nil
+}
+
+func runMigrate(cmd *cobra.Command, args []string) error {
+	backend, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	lock, err := repository.LockExclusive(backend)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	cfg, err := repository.Migrate(backend)
+	if err != nil {
+		return fmt.Errorf("migration failed: %w", err)
+	}
+
+	log.Printf("Repository migrated to format %d", cfg.FormatVersion)
+	return nil
+}
+
+func runUnlock(cmd *cobra.Command, args []string) error {
+	backend, _, err := openRepository()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	removed, err := repository.RemoveLocks(backend, unlockAll)
+	if err != nil {
+		return fmt.Errorf("failed to remove locks: %w", err)
+	}
+
+	for _, info := range removed {
+		if info.ID == "" {
+			fmt.Printf("Removed unreadable lock file %s\n", info.Name)
+			continue
+		}
+		fmt.Printf("Removed lock %s (PID %d on %s, since %s)\n",
+			info.ID, info.PID, info.Host, info.CreatedAt.Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("%d lock(s) removed\n", len(removed))
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"gobackup/internal/backup"
+	"gobackup/internal/watcher"
+	"gobackup/pkg/models"
+	"path/filepath"
+	"strings"
+)
+
+// watchRoot is a root as --watch gives it, Mode overrides --watch-mode if set.
+type watchRoot struct {
+	models.Root
+	Mode string
+}
+
+/*
+parseRoots reads the --watch flags. A single directory keeps the unnamed layout
+of older repositories, with several each one is a named root: NAME=DIR, or the
+directory's base name (--watch /etc --watch /home is etc and home). A :poll,
+:notify or :auto suffix picks how that directory is watched.
+*/
+func parseRoots(flags []string) ([]watchRoot, error) {
+	var roots []watchRoot
+	for _, flag := range flags {
+		spec, mode := flag, ""
+		if i := strings.LastIndex(spec, ":"); i > 0 {
+			switch spec[i+1:] {
+			case watcher.ModeAuto, watcher.ModeNotify, watcher.ModePoll:
+				spec, mode = spec[:i], spec[i+1:]
+			}
+		}
+		root := watchRoot{Root: models.Root{Path: spec}, Mode: mode}
+		if i := strings.Index(spec, "="); i > 0 && backup.ValidRootName(spec[:i]) {
+			root.Root = models.Root{Name: spec[:i], Path: spec[i+1:]}
+		}
+		if root.Path == "" {
+			return nil, fmt.Errorf("--watch %s: directory missing", flag)
+		}
+		roots = append(roots, root)
+	}
+	if len(roots) < 2 {
+		return roots, nil
+	}
+
+	for i, root := range roots {
+		if root.Name != "" {
+			continue
+		}
+		absPath, err := filepath.Abs(root.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve %s: %w", root.Path, err)
+		}
+		name := filepath.Base(absPath)
+		if !backup.ValidRootName(name) {
+			return nil, fmt.Errorf("--watch %s: give it a name, e.g. --watch NAME=%s", root.Path, root.Path)
+		}
+		roots[i].Name = name
+	}
+	return roots, nil
+}
+
+// mergeWatchers gathers the events and errors of one watcher per root.
+func mergeWatchers(ctx context.Context, watchers []watcher.FileWatcher) (<-chan models.FileEvent, <-chan error) {
+	changes := make(chan models.FileEvent)
+	errs := make(chan error, 10)
+	for _, w := range watchers {
+		go func(w watcher.FileWatcher) {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case event := <-w.Changes():
+					select {
+					case changes <- event:
+					case <-ctx.Done():
+						return
+					}
+				case err := <-w.Errors():
+					select {
+					case errs <- err:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}(w)
+	}
+	return changes, errs
+}
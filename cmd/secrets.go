@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"gobackup/internal/encryption"
+	"gobackup/internal/storage"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var (
+	keyFile        string
+	passphraseFile string
+
+	// shared so that consecutive prompts don't lose buffered input when stdin is a pipe
+	stdinReader = bufio.NewReader(os.Stdin)
+)
+
+/*
+Secrets are looked up in this order:
+ 1. --key-file (unattended daemons)
+ 2. --passphrase-file
+ 3. GOBACKUP_PASSPHRASE env variable
+ 4. interactive prompt
+
+The source of a copy has its own --from-key-file, --from-passphrase-file and
+GOBACKUP_FROM_PASSPHRASE.
+*/
+func readSecret(prompt string) ([]byte, error) {
+	return readSecretFrom(keyFile, passphraseFile, "GOBACKUP_PASSPHRASE", prompt)
+}
+
+// readSecretFrom is readSecret for a repository with its own flags, e.g. the source of a copy.
+func readSecretFrom(keyFile, passphraseFile, envName, prompt string) ([]byte, error) {
+	if keyFile != "" {
+		return encryption.ReadKeyFile(keyFile)
+	}
+
+	if passphraseFile != "" {
+		data, err := os.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read passphrase file: %w", err)
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+
+	if env := os.Getenv(envName); env != "" {
+		return []byte(env), nil
+	}
+
+	return promptPassphrase(prompt)
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		return secret, nil
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
+
+// promptNewPassphrase asks twice so a typo doesn't lock anyone out.
+func promptNewPassphrase() ([]byte, error) {
+	first, err := promptPassphrase("Enter new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(first) == 0 {
+		return nil, fmt.Errorf("passphrase cannot be empty")
+	}
+
+	second, err := promptPassphrase("Repeat new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(first, second) {
+		return nil, fmt.Errorf("passphrases do not match")
+	}
+	return first, nil
+}
+
+// unlockRepository returns nil if the repository isn't encrypted.
+func unlockRepository(backend storage.Backend) (*encryption.MasterKey, error) {
+	master, _, err := unlockSlot(backend)
+	return master, err
+}
+
+func unlockSlot(backend storage.Backend) (*encryption.MasterKey, *encryption.KeySlot, error) {
+	return unlockSlotWith(backend, func() ([]byte, error) {
+		return readSecret("Enter repository passphrase: ")
+	})
+}
+
+func unlockSlotWith(backend storage.Backend, secretFn func() ([]byte, error)) (*encryption.MasterKey, *encryption.KeySlot, error) {
+	store := encryption.NewKeyStore(backend)
+	hasKeys, err := store.HasKeys()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read key slots: %w", err)
+	}
+	if !hasKeys {
+		return nil, nil, nil
+	}
+
+	secret, err := secretFn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	master, slot, err := store.Unlock(secret)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to unlock repository: %w", err)
+	}
+	return master, slot, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/server"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	serveListen     string
+	serveTLSCert    string
+	serveTLSKey     string
+	serveHTPasswd   string
+	serveTokens     string
+	serveAppendOnly bool
+	serveNoAuth     bool
+)
+
+func newServeCommand() *cobra.Command {
+	serveCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Export the --backup repository over HTTP(S) for rest: clients",
+		RunE:  runServe,
+	}
+	serveCmd.Flags().StringVar(&serveListen, "listen", ":8000", "Address to listen on")
+	serveCmd.Flags().StringVar(&serveTLSCert, "tls-cert", "", "TLS certificate (PEM), enables HTTPS")
+	serveCmd.Flags().StringVar(&serveTLSKey, "tls-key", "", "TLS private key (PEM)")
+	serveCmd.Flags().StringVar(&serveHTPasswd, "htpasswd", "", "htpasswd file with bcrypt passwords for basic auth")
+	serveCmd.Flags().StringVar(&serveTokens, "tokens", "", "File with user:token lines for bearer token auth")
+	serveCmd.Flags().BoolVar(&serveAppendOnly, "append-only", false, "Let clients add data but never delete or overwrite it")
+	serveCmd.Flags().BoolVar(&serveNoAuth, "no-auth", false, "Accept requests without credentials")
+	return serveCmd
+}
+
+func runServe(cmd *cobra.Command, args []string) error {
+	if (serveTLSCert == "") != (serveTLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key have to be given together")
+	}
+
+	var auth *server.Credentials
+	if serveHTPasswd != "" || serveTokens != "" {
+		auth = server.NewCredentials()
+		if serveHTPasswd != "" {
+			if err := auth.LoadHTPasswd(serveHTPasswd); err != nil {
+				return err
+			}
+		}
+		if serveTokens != "" {
+			if err := auth.LoadTokens(serveTokens); err != nil {
+				return err
+			}
+		}
+		if auth.Users() == 0 {
+			return fmt.Errorf("no users found in the credential files")
+		}
+	} else if !serveNoAuth {
+		return fmt.Errorf("--htpasswd or --tokens is required, use --no-auth to serve without credentials")
+	}
+
+	backend, err := openBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	// clients can run init over the server, anything else has to be a repository we understand
+	if empty, err := repository.IsEmpty(backend); err != nil {
+		return fmt.Errorf("cannot open repository %s: %w", backupPath, err)
+	} else if empty {
+		log.Printf("%s is empty, clients can create a repository with init", backupPath)
+	} else if _, err := repository.Open(backend); err != nil {
+		return fmt.Errorf("cannot open repository %s: %w", backupPath, err)
+	}
+
+	srv := &http.Server{
+		Addr:              serveListen,
+		Handler:           server.New(backend, auth, serveAppendOnly),
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+
+	errChan := make(chan error, 1)
+	go func() {
+		if serveTLSCert != "" {
+			errChan <- srv.ListenAndServeTLS(serveTLSCert, serveTLSKey)
+		} else {
+			errChan <- srv.ListenAndServe()
+		}
+	}()
+
+	scheme := "http"
+	if serveTLSCert != "" {
+		scheme = "https"
+	} else if auth != nil {
+		log.Printf("Warning: serving without TLS, credentials are sent in the clear")
+	}
+	mode := "read-write"
+	if serveAppendOnly {
+		mode = "append-only"
+	}
+	log.Printf("Serving %s (%s) on %s://%s", backupPath, mode, scheme, serveListen)
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-errChan:
+		return fmt.Errorf("server failed: %w", err)
+	case <-sigChan:
+		log.Println("Shutdown signal received...")
+	}
+
+	// let running requests finish, a half written chunk is a temp file nobody wants
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("shutdown failed: %w", err)
+	}
+	return nil
+}
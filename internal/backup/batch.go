@@ -0,0 +1,109 @@
+package backup
+
+import (
+	"gobackup/pkg/models"
+	"time"
+)
+
+/*
+Watcher events are gathered into batches instead of being handled one by one:
+a batch is closed batchWindow after its first event or when it holds
+maxBatchSize paths, and then handled as one change set, which packs its files
+into as few chunks as possible and is committed with one SaveMetadata. A git
+checkout touching 5,000 files becomes a handful of chunks, not 5,000.
+
+Events for a path already in the batch are merged into one, moved to the back
+so the batch keeps the order of each path's last event (rm -rf d; mkdir d; touch
+d/f must end with d/f, not with d deleted). A file created and deleted again
+within one batch disappears completely. Renames are never merged, they also end
+the merging for both of their paths so everything after them stays after them.
+*/
+const (
+	DefaultBatchWindow  = 2 * time.Second
+	DefaultMaxBatchSize = 1000
+)
+
+type eventBatch struct {
+	events []models.FileEvent
+	// path -> position in events, for merging
+	index map[string]int
+	// paths whose first event in this batch was a CREATE
+	created map[string]bool
+}
+
+func newEventBatch() *eventBatch {
+	return &eventBatch{index: make(map[string]int), created: make(map[string]bool)}
+}
+
+func (b *eventBatch) len() int {
+	return len(b.events)
+}
+
+func (b *eventBatch) add(event models.FileEvent) {
+	if event.Operation == "RENAME" {
+		delete(b.index, event.OldPath)
+		delete(b.index, event.Path)
+		b.events = append(b.events, event)
+		return
+	}
+
+	pos, exists := b.index[event.Path]
+	if !exists {
+		if event.Operation == "CREATE" {
+			b.created[event.Path] = true
+		}
+		b.index[event.Path] = len(b.events)
+		b.events = append(b.events, event)
+		return
+	}
+
+	merged := b.events[pos]
+	merged.Operation = mergeOperations(merged.Operation, event.Operation)
+	merged.Timestamp = event.Timestamp
+	b.remove(pos)
+
+	if merged.Operation == "DELETE" && b.created[event.Path] {
+		// never backed up, nothing to delete either
+		delete(b.created, event.Path)
+		return
+	}
+	b.index[event.Path] = len(b.events)
+	b.events = append(b.events, merged)
+}
+
+// remove takes the event at pos out and fixes up the positions after it.
+func (b *eventBatch) remove(pos int) {
+	delete(b.index, b.events[pos].Path)
+	b.events = append(b.events[:pos], b.events[pos+1:]...)
+	for path, i := range b.index {
+		if i > pos {
+			b.index[path] = i - 1
+		}
+	}
+}
+
+// take returns the events gathered so far and starts a new batch.
+func (b *eventBatch) take() []models.FileEvent {
+	events := b.events
+	b.events = nil
+	b.index = make(map[string]int)
+	b.created = make(map[string]bool)
+	return events
+}
+
+// mergeOperations is what two events for the same path amount to.
+func mergeOperations(first, second string) string {
+	switch {
+	case second == "DELETE":
+		return "DELETE"
+	case first == "CREATE":
+		return "CREATE"
+	case first == "DELETE":
+		// deleted and there again, compared against the index like any change
+		return "MODIFY"
+	case second == "SCAN":
+		return first
+	default:
+		return second
+	}
+}
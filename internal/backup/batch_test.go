@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"reflect"
+	"testing"
+
+	"gobackup/pkg/models"
+)
+
+func TestMergeOperations(t *testing.T) {
+	ops := []string{"CREATE", "MODIFY", "DELETE", "SCAN"}
+	// want[first][second]
+	want := map[string]map[string]string{
+		"CREATE": {"CREATE": "CREATE", "MODIFY": "CREATE", "DELETE": "DELETE", "SCAN": "CREATE"},
+		"MODIFY": {"CREATE": "CREATE", "MODIFY": "MODIFY", "DELETE": "DELETE", "SCAN": "MODIFY"},
+		"DELETE": {"CREATE": "MODIFY", "MODIFY": "MODIFY", "DELETE": "DELETE", "SCAN": "MODIFY"},
+		"SCAN":   {"CREATE": "CREATE", "MODIFY": "MODIFY", "DELETE": "DELETE", "SCAN": "SCAN"},
+	}
+	for _, first := range ops {
+		for _, second := range ops {
+			if got := mergeOperations(first, second); got != want[first][second] {
+				t.Errorf("mergeOperations(%s, %s) = %s, want %s", first, second, got, want[first][second])
+			}
+		}
+	}
+}
+
+func TestEventBatch(t *testing.T) {
+	ev := func(operation, path string) models.FileEvent {
+		return models.FileEvent{Path: path, Operation: operation}
+	}
+	rename := func(from, to string) models.FileEvent {
+		return models.FileEvent{Path: to, Operation: "RENAME", OldPath: from}
+	}
+
+	tests := []struct {
+		name   string
+		events []models.FileEvent
+		want   []models.FileEvent
+	}{
+		{
+			name:   "separate paths keep their order",
+			events: []models.FileEvent{ev("CREATE", "a"), ev("MODIFY", "b"), ev("DELETE", "c")},
+			want:   []models.FileEvent{ev("CREATE", "a"), ev("MODIFY", "b"), ev("DELETE", "c")},
+		},
+		{
+			name:   "repeated writes are one event",
+			events: []models.FileEvent{ev("MODIFY", "a"), ev("MODIFY", "a"), ev("SCAN", "a")},
+			want:   []models.FileEvent{ev("MODIFY", "a")},
+		},
+		{
+			name:   "created and written stays a create",
+			events: []models.FileEvent{ev("CREATE", "a"), ev("MODIFY", "a")},
+			want:   []models.FileEvent{ev("CREATE", "a")},
+		},
+		{
+			name:   "created and deleted disappears",
+			events: []models.FileEvent{ev("CREATE", "a"), ev("MODIFY", "b"), ev("MODIFY", "a"), ev("DELETE", "a")},
+			want:   []models.FileEvent{ev("MODIFY", "b")},
+		},
+		{
+			name:   "created again after that is new",
+			events: []models.FileEvent{ev("CREATE", "a"), ev("DELETE", "a"), ev("CREATE", "a")},
+			want:   []models.FileEvent{ev("CREATE", "a")},
+		},
+		{
+			name:   "deleted and there again is a modify",
+			events: []models.FileEvent{ev("DELETE", "a"), ev("CREATE", "a")},
+			want:   []models.FileEvent{ev("MODIFY", "a")},
+		},
+		{
+			name:   "modified and deleted is a delete",
+			events: []models.FileEvent{ev("MODIFY", "a"), ev("DELETE", "a")},
+			want:   []models.FileEvent{ev("DELETE", "a")},
+		},
+		{
+			name:   "a merged event moves to the back",
+			events: []models.FileEvent{ev("DELETE", "d"), ev("CREATE", "d/f"), ev("CREATE", "d")},
+			want:   []models.FileEvent{ev("CREATE", "d/f"), ev("MODIFY", "d")},
+		},
+		{
+			name:   "renames are never merged",
+			events: []models.FileEvent{rename("a", "b"), rename("a", "b")},
+			want:   []models.FileEvent{rename("a", "b"), rename("a", "b")},
+		},
+		{
+			name:   "nothing merges across a rename",
+			events: []models.FileEvent{ev("MODIFY", "a"), rename("a", "b"), ev("MODIFY", "b"), ev("CREATE", "a"), ev("MODIFY", "b")},
+			want:   []models.FileEvent{ev("MODIFY", "a"), rename("a", "b"), ev("CREATE", "a"), ev("MODIFY", "b")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newEventBatch()
+			for _, event := range tt.events {
+				b.add(event)
+			}
+			if b.len() != len(tt.want) {
+				t.Errorf("len() = %d, want %d", b.len(), len(tt.want))
+			}
+			got := b.take()
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batch = %v, want %v", got, tt.want)
+			}
+			if b.len() != 0 {
+				t.Errorf("take left %d events behind", b.len())
+			}
+			// a new batch doesn't remember what was created in the old one
+			b.add(ev("DELETE", "a"))
+			if b.len() != 1 {
+				t.Errorf("DELETE after take was dropped")
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"gobackup/pkg/models"
+	"time"
+)
+
+/*
+Chunk header:
+Every chunk starts (inside the compression, so also inside the encryption) with a
+small header describing which files it holds and where, so the index can be rebuilt
+from the chunks alone if it's ever lost.
+
+	"GBCH" | version (1 byte) | header length (uint32, big endian) | header JSON | data
+
+Chunks written before this have no header, DecodeChunk hands their data back as is.
+*/
+var chunkMagic = []byte("GBCH")
+
+const chunkHeaderVersion = 1
+
+type ChunkHeader struct {
+	ChunkID   int               `json:"chunk_id"`
+	CreatedAt time.Time         `json:"created_at"`
+	Files     []ChunkHeaderFile `json:"files"`
+	// link records only (see links.go): paths deleted by the commit
+	Deleted []string `json:"deleted,omitempty"`
+	// named roots of the repository when this was written, see roots.go
+	Roots map[string]string `json:"roots,omitempty"`
+}
+
+type ChunkHeaderFile struct {
+	Path    string    `json:"path"`
+	Offset  int64     `json:"offset"`
+	Size    int64     `json:"size"`
+	Hash    string    `json:"hash"`
+	ModTime time.Time `json:"mod_time"`
+	Mode    uint32    `json:"mode,omitempty"`
+	// link records only: where the content is, Offset and Size don't apply
+	Extents []models.Extent `json:"extents,omitempty"`
+}
+
+func EncodeChunk(header *ChunkHeader, data []byte) ([]byte, error) {
+	headerData, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(chunkMagic) + 5 + len(headerData) + len(data))
+	buf.Write(chunkMagic)
+	buf.WriteByte(chunkHeaderVersion)
+	binary.Write(&buf, binary.BigEndian, uint32(len(headerData)))
+	buf.Write(headerData)
+	buf.Write(data)
+	return buf.Bytes(), nil
+}
+
+// DecodeChunk splits a decompressed chunk into header and data, header is nil for old chunks.
+func DecodeChunk(raw []byte) (*ChunkHeader, []byte, error) {
+	prefixLen := len(chunkMagic) + 5
+	if len(raw) < prefixLen || !bytes.Equal(raw[:len(chunkMagic)], chunkMagic) {
+		return nil, raw, nil
+	}
+
+	version := raw[len(chunkMagic)]
+	if version != chunkHeaderVersion {
+		return nil, nil, fmt.Errorf("unsupported chunk header version %d", version)
+	}
+
+	headerLen := int(binary.BigEndian.Uint32(raw[len(chunkMagic)+1 : prefixLen]))
+	if prefixLen+headerLen > len(raw) {
+		return nil, nil, fmt.Errorf("chunk header extends beyond chunk")
+	}
+
+	var header ChunkHeader
+	if err := json.Unmarshal(raw[prefixLen:prefixLen+headerLen], &header); err != nil {
+		return nil, nil, fmt.Errorf("invalid chunk header: %w", err)
+	}
+
+	return &header, raw[prefixLen+headerLen:], nil
+}
@@ -1,14 +1,38 @@
 package backup
 
-// Current chunk size is 5 MB, can be changed accordingly
+import "gobackup/internal/utils"
+
+// Default chunk size is 5 MB, repositories can pick their own at init
 const ChunkSize = 5 * 1024 * 1024
 
 type Chunker struct {
-	chunkID int
+	chunkID   int
+	chunkSize int64
+	hasher    utils.Hasher
 }
 
 func NewChunker() *Chunker {
-	return &Chunker{chunkID: 1}
+	return &Chunker{chunkID: 1, chunkSize: ChunkSize, hasher: utils.NewSHA256Hasher()}
+}
+
+func (c *Chunker) SetChunkSize(size int64) {
+	c.chunkSize = size
+}
+
+func (c *Chunker) SetHasher(hasher utils.Hasher) {
+	c.hasher = hasher
+}
+
+// SetNextID continues numbering after the chunks already in the repository.
+func (c *Chunker) SetNextID(id int) {
+	c.chunkID = id
+}
+
+// takeID hands out a chunk ID for a chunk that doesn't come from CreateChunks.
+func (c *Chunker) takeID() int {
+	id := c.chunkID
+	c.chunkID++
+	return id
 }
 
 type ChunkData struct {
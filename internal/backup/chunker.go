@@ -2,7 +2,6 @@ package backup
 
 import (
 	"fmt"
-	"gobackup/internal/utils"
 	"os"
 )
 
@@ -23,9 +22,9 @@ func (c *Chunker) CreateChunks(files []string) ([]ChunkData, error) {
 			continue
 		}
 
-		if currentSize+fileInfo.Size() > ChunkSize {
+		if currentSize+fileInfo.Size() > c.chunkSize {
 			if len(currentChunk.Files) > 0 {
-				currentChunk.Hash = utils.CalculateDataHash(currentChunk.Data)
+				currentChunk.Hash = c.hasher.HashData(currentChunk.Data)
 				chunks = append(chunks, currentChunk)
 				currentChunk = ChunkData{
 					ID: c.chunkID,
@@ -40,25 +39,23 @@ func (c *Chunker) CreateChunks(files []string) ([]ChunkData, error) {
 			continue
 		}
 
-		fileHash, err := utils.CalculateFileHash(filePath)
-		if err != nil {
-			continue
-		}
+		// hash what we actually read, the file may have changed since the stat
+		fileHash := c.hasher.HashData(fileData)
 
 		// Add file to the current chunk
 		currentChunk.Files = append(currentChunk.Files, ChunkFileInfo{
 			Path:   filePath,
 			Offset: int64(len(currentChunk.Data)),
-			Size:   fileInfo.Size(),
+			Size:   int64(len(fileData)),
 			Hash:   fileHash,
 		})
 		currentChunk.Data = append(currentChunk.Data, fileData...)
-		currentSize += fileInfo.Size()
+		currentSize += int64(len(fileData))
 
 	}
 
 	if len(currentChunk.Files) > 0 {
-		currentChunk.Hash = utils.CalculateDataHash(currentChunk.Data)
+		currentChunk.Hash = c.hasher.HashData(currentChunk.Data)
 		chunks = append(chunks, currentChunk)
 	}
 
@@ -72,7 +69,7 @@ func (c *Chunker) ExtractFileFromChunk(chunkData []byte, fileInfo ChunkFileInfo)
 
 	data := chunkData[fileInfo.Offset : fileInfo.Offset+fileInfo.Size]
 
-	if hash := utils.CalculateDataHash(data); hash != fileInfo.Hash {
+	if hash := c.hasher.HashData(data); hash != fileInfo.Hash {
 		return nil, fmt.Errorf("file hash mismatch")
 	}
 
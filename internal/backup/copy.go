@@ -0,0 +1,268 @@
+package backup
+
+import (
+	"fmt"
+	"gobackup/pkg/models"
+	"log"
+	"slices"
+	"sort"
+)
+
+/*
+Copy fills this repository from another one without going back to the source
+files: chunks are read from the other repository (decrypted, decompressed and
+verified there) and stored again with this repository's key and codec.
+
+Chunks whose content is already here are not stored again, and every copied
+chunk is committed right away, so running a copy again only transfers what is
+new and an interrupted copy picks up where it stopped. Between repositories that
+hash the same way (both unencrypted) that check needs only the index. Otherwise
+a chunk has to be read and hashed with this repository's key, so every copied
+chunk remembers its source (repository ID and hash there) and isn't read again
+by the next copy from that repository, nor are the files in it rehashed.
+
+File entries and root names of the source replace the ones here with the same
+path or name, files only this repository knows about are left alone.
+*/
+type ChunkSource interface {
+	RepositoryID() string
+	Metadata() *models.BackupMetadata
+	// ReadChunk returns the verified data of a chunk and its header (nil for old chunks)
+	ReadChunk(chunkID int) (*ChunkHeader, []byte, error)
+	HashData(data []byte) string
+}
+
+type CopyReport struct {
+	Chunks      int
+	Copied      int
+	CopiedBytes int64
+	Existing    int
+	Unreadable  int
+
+	FilesUpdated   int
+	FilesUnchanged int
+	// files that lost a chunk because it was unreadable in the source
+	FilesSkipped int
+}
+
+// CopyFrom copies everything src has that this repository is missing, Initialize must have run.
+func (e *Engine) CopyFrom(src ChunkSource) (*CopyReport, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	meta := src.Metadata()
+	report := &CopyReport{Chunks: len(meta.Chunks)}
+
+	// first, so the copied chunk headers carry them too
+	for name, path := range meta.Roots {
+		if previous, existed := e.metadata.SetRoot(name, path); existed && previous != path {
+			log.Printf("Warning: root %s was backed up from %s here, the copy says %s", name, previous, path)
+		}
+	}
+
+	probe := []byte("gobackup hash probe")
+	sameHashes := src.HashData(probe) == e.chunker.hasher.HashData(probe)
+
+	// with different hashes every file has to be rehashed, remember where their content is
+	extentHashes := make(map[models.Extent]string)
+	extentsByChunk := make(map[int][]models.Extent)
+	if !sameHashes {
+		for _, file := range meta.Files {
+			if file.IsDeleted || len(file.Extents) != 1 {
+				continue
+			}
+			extent := file.Extents[0]
+			if _, seen := extentHashes[extent]; !seen {
+				extentHashes[extent] = ""
+				extentsByChunk[extent.ChunkID] = append(extentsByChunk[extent.ChunkID], extent)
+			}
+		}
+	}
+
+	// chunks copied from src before, by source
+	copiedBefore := make(map[string]int)
+	for _, chunk := range e.metadata.Chunks() {
+		if chunk.Source != "" {
+			copiedBefore[chunk.Source] = chunk.ID
+		}
+	}
+
+	chunks := slices.Clone(meta.Chunks)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].ID < chunks[j].ID })
+
+	// source chunk ID -> chunk ID here
+	chunkMap := make(map[int]int)
+	for _, chunk := range chunks {
+		source := src.RepositoryID() + ":" + chunk.Hash
+		if id, ok := copiedBefore[source]; ok {
+			chunkMap[chunk.ID] = id
+			report.Existing++
+			continue
+		}
+		if sameHashes {
+			if existing, ok := e.metadata.FindChunkByHash(chunk.Hash); ok {
+				chunkMap[chunk.ID] = existing.ID
+				report.Existing++
+				continue
+			}
+		}
+
+		header, data, err := src.ReadChunk(chunk.ID)
+		if err != nil {
+			log.Printf("Warning: skipping chunk %s: %v", chunk.Filename, err)
+			report.Unreadable++
+			continue
+		}
+
+		for _, extent := range extentsByChunk[chunk.ID] {
+			if extent.Offset >= 0 && extent.Offset+extent.Size <= int64(len(data)) {
+				extentHashes[extent] = e.chunker.hasher.HashData(data[extent.Offset : extent.Offset+extent.Size])
+			}
+		}
+
+		hash := e.chunker.hasher.HashData(data)
+		if existing, ok := e.metadata.FindChunkByHash(hash); ok {
+			chunkMap[chunk.ID] = existing.ID
+			report.Existing++
+			continue
+		}
+
+		info, err := e.storeChunkFrom(e.copiedHeader(header, data, sameHashes), data, hash, source)
+		if err != nil {
+			return report, err
+		}
+		// committed one by one, that's what makes an interrupted copy resumable
+		if err := e.commit(); err != nil {
+			return report, err
+		}
+
+		chunkMap[chunk.ID] = info.ID
+		report.Copied++
+		report.CopiedBytes += info.CompressedSize
+		log.Printf("Copied %s as %s", chunk.Filename, info.Filename)
+	}
+
+	paths := make([]string, 0, len(meta.Files))
+	for path := range meta.Files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		file := meta.Files[path]
+		current, exists := e.metadata.GetFileInfo(path)
+
+		if file.IsDeleted {
+			if exists && !current.IsDeleted {
+				e.metadata.MarkFileDeleted(path)
+				report.FilesUpdated++
+			}
+			continue
+		}
+
+		var known *models.FileInfo
+		if exists && !current.IsDeleted {
+			known = &current
+		}
+		copied, err := e.copiedFileInfo(src, file, known, chunkMap, extentHashes, sameHashes)
+		if err != nil {
+			log.Printf("Warning: not copying %s: %v", path, err)
+			report.FilesSkipped++
+			continue
+		}
+
+		if exists && sameFileInfo(current, copied) {
+			report.FilesUnchanged++
+			continue
+		}
+		e.metadata.UpdateFileInfo(path, copied)
+		report.FilesUpdated++
+	}
+
+	if err := e.commit(); err != nil {
+		return report, err
+	}
+
+	if e.parity != nil {
+		if _, err := e.parity.Protect(e.metadata.Chunks()); err != nil {
+			log.Printf("Warning: failed to build parity: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// copiedHeader renumbers a source chunk header for this repository.
+func (e *Engine) copiedHeader(source *ChunkHeader, data []byte, sameHashes bool) *ChunkHeader {
+	header := &ChunkHeader{ChunkID: e.chunker.takeID()}
+	if source == nil {
+		return header
+	}
+
+	header.CreatedAt = source.CreatedAt
+	header.Files = slices.Clone(source.Files)
+	if !sameHashes {
+		for i, file := range header.Files {
+			if file.Offset >= 0 && file.Offset+file.Size <= int64(len(data)) {
+				header.Files[i].Hash = e.chunker.hasher.HashData(data[file.Offset : file.Offset+file.Size])
+			}
+		}
+	}
+	return header
+}
+
+// copiedFileInfo points a source file entry at the chunks here, known is the entry here with the same path.
+func (e *Engine) copiedFileInfo(src ChunkSource, file models.FileInfo, known *models.FileInfo, chunkMap map[int]int, extentHashes map[models.Extent]string, sameHashes bool) (models.FileInfo, error) {
+	copied := file
+	copied.ChunkRefs = nil
+	copied.Extents = nil
+
+	for _, id := range file.ChunkRefs {
+		mapped, ok := chunkMap[id]
+		if !ok {
+			return copied, fmt.Errorf("chunk %d was not copied", id)
+		}
+		copied.ChunkRefs = append(copied.ChunkRefs, mapped)
+	}
+	for _, extent := range file.Extents {
+		mapped, ok := chunkMap[extent.ChunkID]
+		if !ok {
+			return copied, fmt.Errorf("chunk %d was not copied", extent.ChunkID)
+		}
+		extent.ChunkID = mapped
+		copied.Extents = append(copied.Extents, extent)
+	}
+
+	if sameHashes {
+		return copied, nil
+	}
+
+	switch {
+	case len(file.Extents) == 1 && extentHashes[file.Extents[0]] != "":
+		copied.Hash = extentHashes[file.Extents[0]]
+	case known != nil && len(copied.Extents) > 0 && known.Size == copied.Size && slices.Equal(known.Extents, copied.Extents):
+		// copied by an earlier run and rehashed then, its chunks weren't read this time
+		copied.Hash = known.Hash
+	case len(file.Extents) > 0:
+		var content []byte
+		for _, extent := range file.Extents {
+			_, data, err := src.ReadChunk(extent.ChunkID)
+			if err != nil {
+				return copied, err
+			}
+			if extent.Offset < 0 || extent.Offset+extent.Size > int64(len(data)) {
+				return copied, fmt.Errorf("file data extends beyond chunk %d boundary", extent.ChunkID)
+			}
+			content = append(content, data[extent.Offset:extent.Offset+extent.Size]...)
+		}
+		copied.Hash = e.chunker.hasher.HashData(content)
+	default:
+		// old entries without extents can't be rehashed, the next scan of the file fixes it
+		copied.Hash = ""
+	}
+	return copied, nil
+}
+
+func sameFileInfo(a, b models.FileInfo) bool {
+	return a.Hash == b.Hash && a.Size == b.Size && a.ModTime.Equal(b.ModTime) && a.Mode == b.Mode &&
+		a.IsDeleted == b.IsDeleted && slices.Equal(a.ChunkRefs, b.ChunkRefs) && slices.Equal(a.Extents, b.Extents)
+}
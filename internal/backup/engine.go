@@ -3,13 +3,20 @@ package backup
 import (
 	"context"
 	"fmt"
+	"gobackup/internal/encryption"
+	"gobackup/internal/filter"
 	"gobackup/internal/metadata"
+	"gobackup/internal/parity"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
 	"gobackup/internal/utils"
 	"gobackup/pkg/models"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
+	"time"
 )
 
 /*
@@ -20,38 +27,107 @@ This is the main backup engine now.
 4. Shutdown() - Clean stop when done
 */
 type Engine struct {
-	watchPath    string
-	backupPath   string
+	roots        []*root
+	backend      storage.Backend
 	metadata     *metadata.Manager
 	chunker      *Chunker
 	compressor   *Compressor
+	parity       *parity.Manager
+	key          *encryption.MasterKey
 	changeChan   chan []models.FileChange
+	eventChan    chan []models.FileEvent
+	batchWindow  time.Duration
+	maxBatchSize int
+	settle       *settler
+	// path -> where the chunks written since the last commit say it is, see links.go
+	covered      map[string]models.Extent
 	shutdownChan chan struct{}
 	wg           sync.WaitGroup
 	mu           sync.Mutex
 }
 
-func NewEngine(watchPath, backupPath string) *Engine {
+// NewEngine backs up watchPath with the old single-root layout, or nothing until AddRoot with "".
+func NewEngine(watchPath string, backend storage.Backend) *Engine {
+	var roots []*root
+	if watchPath != "" {
+		absPath, _ := filepath.Abs(watchPath)
+		roots = append(roots, &root{path: filepath.Clean(watchPath), absPath: absPath})
+	}
 	return &Engine{
-		watchPath:    watchPath,
-		backupPath:   backupPath,
-		metadata:     metadata.NewManager(backupPath),
+		roots:        roots,
+		backend:      backend,
+		metadata:     metadata.NewManager(backend),
 		chunker:      NewChunker(),
 		compressor:   NewCompressor(),
 		changeChan:   make(chan []models.FileChange, 10),
+		eventChan:    make(chan []models.FileEvent, 10),
+		batchWindow:  DefaultBatchWindow,
+		maxBatchSize: DefaultMaxBatchSize,
+		settle:       newSettler(),
+		covered:      make(map[string]models.Extent),
 		shutdownChan: make(chan struct{}),
 	}
 }
+
+// SetMasterKey enables chunk encryption, must be called before Start for encrypted repositories.
+func (e *Engine) SetMasterKey(key *encryption.MasterKey) {
+	e.key = key
+	if key != nil {
+		hasher := utils.NewKeyedHasher(key.IDKey())
+		e.chunker.SetHasher(hasher)
+		e.metadata.SetHasher(hasher)
+	}
+}
+
 func (e *Engine) Initialize() error {
-	if err := utils.EnsureDirectoryExists(e.backupPath); err != nil {
-		return fmt.Errorf("failed to create backup directory: %w", err)
+	cfg, err := repository.Open(e.backend)
+	if err != nil {
+		return err
+	}
+	if cfg.Encrypted() && e.key == nil {
+		return fmt.Errorf("repository is encrypted, a passphrase or key file is required")
 	}
+	e.chunker.SetChunkSize(cfg.ChunkSize)
 
 	if err := e.metadata.LoadMetadata(); err != nil {
 		return fmt.Errorf("failed to load metadata: %w", err)
 	}
 
-	return nil
+	if cfg.ParityEnabled() {
+		e.parity = parity.NewManager(e.backend, cfg.ParityData, cfg.ParityShards)
+		if err := e.parity.Load(); err != nil {
+			return fmt.Errorf("failed to load parity groups: %w", err)
+		}
+		// heal lost chunks before recovery decides they are gone for good
+		e.repairFromParity()
+	}
+
+	report, err := e.metadata.Recover(true)
+	if err != nil {
+		return fmt.Errorf("recovery failed: %w", err)
+	}
+	if !report.Clean() {
+		log.Printf("Recovered from an unclean shutdown: %s", report)
+		for _, path := range report.DanglingFiles {
+			log.Printf("  %s will be backed up again, its chunk was lost", path)
+		}
+		if len(report.UnindexedChunks) > 0 {
+			log.Printf("  %d chunks are missing from the index and were kept, run repair index to recover their files", len(report.UnindexedChunks))
+		}
+	}
+
+	// don't overwrite chunks written by a previous run, including orphans an
+	// append-only server didn't let recovery remove
+	nextID := e.metadata.MaxChunkID() + 1
+	for _, orphan := range report.OrphanChunks {
+		var id int
+		if _, err := fmt.Sscanf(path.Base(orphan), "chunk_%06d.gz", &id); err == nil && id >= nextID {
+			nextID = id + 1
+		}
+	}
+	e.chunker.SetNextID(nextID)
+
+	return e.recordRoots()
 }
 func (e *Engine) Start(ctx context.Context) error {
 	e.wg.Add(1)
@@ -67,40 +143,147 @@ func (e *Engine) ProcessChanges(changes []models.FileChange) error {
 		return fmt.Errorf("backup engine is shutting down")
 	}
 }
+
+// SetBatching sets how long watcher events are gathered and how many at most, see batch.go.
+func (e *Engine) SetBatching(window time.Duration, maxSize int) {
+	if window > 0 {
+		e.batchWindow = window
+	}
+	if maxSize > 0 {
+		e.maxBatchSize = maxSize
+	}
+}
+
+// ProcessEvents queues watcher events, see eventChanges.
+func (e *Engine) ProcessEvents(events []models.FileEvent) error {
+	select {
+	case e.eventChan <- events:
+		return nil
+	case <-e.shutdownChan:
+		return fmt.Errorf("backup engine is shutting down")
+	}
+}
+
 func (e *Engine) processChanges(ctx context.Context) {
 	defer e.wg.Done()
 
+	batch := newEventBatch()
+	var window <-chan time.Time
+	// events of files still being written, looked at again on recheck
+	var held []models.FileEvent
+	var recheck <-chan time.Time
+	flush := func() {
+		held = append(held, e.flushEvents(batch)...)
+		if len(held) > 0 && recheck == nil {
+			recheck = time.After(e.settle.recheckInterval())
+		}
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
+			e.flushEvents(batch)
 			return
 		case <-e.shutdownChan:
+			// what is already queued still goes into this last batch
+			for drained := false; !drained; {
+				select {
+				case events := <-e.eventChan:
+					for _, event := range events {
+						batch.add(event)
+					}
+				default:
+					drained = true
+				}
+			}
+			if held = append(held, e.flushEvents(batch)...); len(held) > 0 {
+				log.Printf("%d files are still being written, the next scan backs them up", len(held))
+			}
 			return
 		case changes := <-e.changeChan:
 			if err := e.handleChanges(changes); err != nil {
 				log.Printf("Error processing changes: %v", err)
 			}
+		case events := <-e.eventChan:
+			if batch.len() == 0 {
+				window = time.After(e.batchWindow)
+			}
+			for _, event := range events {
+				batch.add(event)
+			}
+			if batch.len() >= e.maxBatchSize {
+				window = nil
+				flush()
+			}
+		case <-window:
+			window = nil
+			flush()
+		case <-recheck:
+			recheck = nil
+			// newer events for the same files are in the batch already, merge with those
+			for _, event := range held {
+				batch.add(event)
+			}
+			held = nil
+			window = nil
+			flush()
 		}
 	}
 }
 
+// flushEvents handles a batch as one change set, one commit, and returns the events it held back.
+func (e *Engine) flushEvents(batch *eventBatch) []models.FileEvent {
+	events, held := e.holdUnsettled(batch.take())
+	if len(events) == 0 {
+		return held
+	}
+	changes := e.eventChanges(events)
+	if len(changes) == 0 {
+		return held
+	}
+	log.Printf("Backing up %d changes from %d events", len(changes), len(events))
+	if err := e.handleChanges(changes); err != nil {
+		log.Printf("Error processing changes: %v", err)
+	}
+	return held
+}
+
 func (e *Engine) handleChanges(changes []models.FileChange) error {
 	e.mu.Lock()
 	defer e.mu.Unlock()
 
 	var filesToBackup []string
 
-	for _, change := range changes {
+	for i := 0; i < len(changes); i++ {
+		change := changes[i]
 		switch change.Operation {
 		case "CREATE", "MODIFY":
 			if change.FileInfo != nil {
-				fullPath := filepath.Join(e.watchPath, change.Path)
-				filesToBackup = append(filesToBackup, fullPath)
+				info := *change.FileInfo
 
-				e.metadata.UpdateFileInfo(change.Path, *change.FileInfo)
+				// same content already stored (copy, revert, touch) - just point at it
+				if existing, ok := e.metadata.FindFileByHash(info.Hash); ok {
+					info.ChunkRefs = existing.ChunkRefs
+					info.Extents = existing.Extents
+					e.metadata.UpdateFileInfo(change.Path, info)
+					continue
+				}
+
+				filesToBackup = append(filesToBackup, e.fullPath(change.Path))
+
+				e.metadata.UpdateFileInfo(change.Path, info)
 			}
 		case "DELETE":
 			e.metadata.MarkFileDeleted(change.Path)
+			// a directory moved out of the tree only reports itself
+			e.metadata.MarkDirDeleted(change.Path)
+		case "RENAME":
+			// same content under a new name, no need to read it again
+			if moved := e.metadata.RenameFile(change.OldPath, change.Path); moved > 0 {
+				log.Printf("Renamed %s to %s (%d files)", change.OldPath, change.Path, moved)
+			}
+			// written right before the move, its MODIFY found the old name gone
+			changes = append(changes, e.scanChanges(e.fullPath(change.Path))...)
 		}
 	}
 
@@ -110,7 +293,34 @@ func (e *Engine) handleChanges(changes []models.FileChange) error {
 		}
 	}
 
-	return e.metadata.SaveMetadata()
+	if err := e.commit(); err != nil {
+		return err
+	}
+
+	// parity is extra safety on top of a commit, failing here mustn't fail the backup
+	if e.parity != nil {
+		if _, err := e.parity.Protect(e.metadata.Chunks()); err != nil {
+			log.Printf("Warning: failed to build parity: %v", err)
+		}
+	}
+	return nil
+}
+
+func (e *Engine) repairFromParity() {
+	for _, status := range e.parity.Check(false) {
+		if len(status.Damaged) == 0 {
+			continue
+		}
+
+		repaired, err := e.parity.Repair(status.GroupID)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		for _, filename := range repaired {
+			log.Printf("Repaired %s from parity group %d", filename, status.GroupID)
+		}
+	}
 }
 
 func (e *Engine) createBackupChunks(files []string) error {
@@ -120,51 +330,147 @@ func (e *Engine) createBackupChunks(files []string) error {
 	}
 
 	for _, chunk := range chunks {
-		compressed, err := e.compressor.Compress(chunk.Data)
-		if err != nil {
-			return fmt.Errorf("failed to compress chunk %d: %w", chunk.ID, err)
-		}
-
-		chunkFilename := fmt.Sprintf("chunk_%06d.gz", chunk.ID)
-		chunkPath := filepath.Join(e.backupPath, chunkFilename)
-
-		if err := os.WriteFile(chunkPath, compressed, 0644); err != nil {
-			return fmt.Errorf("failed to write chunk file: %w", err)
-		}
+		chunkID := chunk.ID
 
-		chunkInfo := models.ChunkInfo{
-			ID:             chunk.ID,
-			Filename:       chunkFilename,
-			Size:           int64(len(chunk.Data)),
-			Hash:           chunk.Hash,
-			CompressedSize: int64(len(compressed)),
+		if existing, ok := e.metadata.FindChunkByHash(chunk.Hash); ok {
+			chunkID = existing.ID
+			log.Printf("Chunk %d duplicates %s, not storing it again", chunk.ID, existing.Filename)
+		} else {
+			if err := e.writeChunk(chunk); err != nil {
+				return err
+			}
 		}
 
-		e.metadata.AddChunk(chunkInfo)
-
 		// Update file info with chunk references
 		for _, fileInfo := range chunk.Files {
-			relPath, _ := filepath.Rel(e.watchPath, fileInfo.Path)
+			_, relPath, _ := e.locate(fileInfo.Path)
 			if storedInfo, exists := e.metadata.GetFileInfo(relPath); exists {
-				storedInfo.ChunkRefs = append(storedInfo.ChunkRefs, chunk.ID)
+				storedInfo.ChunkRefs = append(storedInfo.ChunkRefs, chunkID)
+				storedInfo.Extents = append(storedInfo.Extents, models.Extent{
+					ChunkID: chunkID,
+					Offset:  fileInfo.Offset,
+					Size:    fileInfo.Size,
+				})
+				// the chunker hashes what it read, keep that so restore can verify it
+				storedInfo.Hash = fileInfo.Hash
+				storedInfo.Size = fileInfo.Size
 				e.metadata.UpdateFileInfo(relPath, storedInfo)
 			}
 		}
+	}
 
-		log.Printf("Created chunk %s with %d files", chunkFilename, len(chunk.Files))
+	return nil
+}
+
+func (e *Engine) writeChunk(chunk ChunkData) error {
+	header := &ChunkHeader{ChunkID: chunk.ID, CreatedAt: time.Now()}
+	for _, fileInfo := range chunk.Files {
+		_, relPath, _ := e.locate(fileInfo.Path)
+		storedInfo, _ := e.metadata.GetFileInfo(relPath)
+		header.Files = append(header.Files, ChunkHeaderFile{
+			Path:    relPath,
+			Offset:  fileInfo.Offset,
+			Size:    fileInfo.Size,
+			Hash:    fileInfo.Hash,
+			ModTime: storedInfo.ModTime,
+			Mode:    storedInfo.Mode,
+		})
 	}
 
+	if _, err := e.storeChunk(header, chunk.Data, chunk.Hash); err != nil {
+		return err
+	}
+
+	log.Printf("Created chunk chunk_%06d.gz with %d files", chunk.ID, len(chunk.Files))
 	return nil
 }
 
-func (e *Engine) PerformFullBackup() error {
-	changes, err := e.metadata.DetectChanges(e.watchPath)
+// storeChunk encodes, compresses, encrypts and writes a chunk, then adds it to the index.
+func (e *Engine) storeChunk(header *ChunkHeader, data []byte, hash string) (models.ChunkInfo, error) {
+	return e.storeChunkFrom(header, data, hash, "")
+}
+
+// storeChunkFrom stores a chunk copied from another repository, source is where it came from (see copy.go).
+func (e *Engine) storeChunkFrom(header *ChunkHeader, data []byte, hash, source string) (models.ChunkInfo, error) {
+	header.Roots = e.metadata.Roots()
+	compressed, err := e.seal(header, data)
 	if err != nil {
-		return fmt.Errorf("failed to detect changes: %w", err)
+		return models.ChunkInfo{}, fmt.Errorf("failed to encode chunk %d: %w", header.ChunkID, err)
+	}
+
+	chunkFilename := fmt.Sprintf("chunk_%06d.gz", header.ChunkID)
+
+	// durable before the metadata commit that references it, see SaveMetadata
+	if err := storage.SaveBytes(e.backend, repository.ChunkName(chunkFilename), compressed); err != nil {
+		return models.ChunkInfo{}, fmt.Errorf("failed to write chunk file: %w", err)
+	}
+
+	info := models.ChunkInfo{
+		ID:             header.ChunkID,
+		Filename:       chunkFilename,
+		Size:           int64(len(data)),
+		Hash:           hash,
+		CompressedSize: int64(len(compressed)),
+		Source:         source,
+	}
+	e.metadata.AddChunk(info)
+	for _, file := range header.Files {
+		e.covered[file.Path] = models.Extent{ChunkID: header.ChunkID, Offset: file.Offset, Size: file.Size}
+	}
+	return info, nil
+}
+
+// seal encodes, compresses and encrypts a chunk or link record as it is stored.
+func (e *Engine) seal(header *ChunkHeader, data []byte) ([]byte, error) {
+	payload, err := EncodeChunk(header, data)
+	if err != nil {
+		return nil, err
+	}
+
+	compressed, err := e.compressor.Compress(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compress: %w", err)
+	}
+
+	if e.key != nil {
+		compressed, err = e.key.Encrypt(compressed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt: %w", err)
+		}
+	}
+	return compressed, nil
+}
+
+func (e *Engine) PerformFullBackup() error {
+	var changes []models.FileChange
+	skipped := make(filter.Skipped)
+	for _, r := range e.roots {
+		if len(e.roots) > 1 {
+			// an unmounted /srv/data would otherwise look like all of it was deleted
+			if _, err := os.Stat(r.path); err != nil {
+				log.Printf("Warning: skipping root %s: %v", r.name, err)
+				continue
+			}
+		}
+		rootChanges, err := e.metadata.DetectChanges(r.path, r.name, r.filter)
+		if err != nil {
+			return fmt.Errorf("failed to detect changes in %s: %w", r.path, err)
+		}
+		changes = append(changes, rootChanges...)
+		for reason, n := range e.metadata.Skipped() {
+			skipped[reason] += n
+		}
 	}
 
 	log.Printf("Detected %d changes for full backup", len(changes))
-	return e.handleChanges(changes)
+	if err := e.handleChanges(e.holdUnsettledChanges(changes)); err != nil {
+		return err
+	}
+
+	if skipped.Total() > 0 {
+		log.Printf("Full backup skipped %d items: %s", skipped.Total(), skipped)
+	}
+	return nil
 }
 
 func (e *Engine) Shutdown() {
@@ -172,4 +478,8 @@ func (e *Engine) Shutdown() {
 	// gracefully shutdown now
 
 	e.wg.Wait()
+
+	if err := e.metadata.Close(); err != nil {
+		log.Printf("Warning: failed to close metadata journal: %v", err)
+	}
 }
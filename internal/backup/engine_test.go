@@ -0,0 +1,305 @@
+package backup_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gobackup/internal/backup"
+	"gobackup/internal/metadata"
+	"gobackup/internal/repository"
+	"gobackup/internal/restore"
+	"gobackup/internal/storage"
+	"gobackup/pkg/models"
+)
+
+func newRepository(t *testing.T) storage.Backend {
+	t.Helper()
+	backend := storage.NewMemory()
+	cfg, err := repository.NewConfig(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Init(backend, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+// run is one run of the backup daemon on src: fn feeds it, Shutdown handles whatever is still queued.
+func run(t *testing.T, backend storage.Backend, src string, fn func(e *backup.Engine)) {
+	t.Helper()
+	e := backup.NewEngine(src, backend)
+	e.SetSettle(0, nil)
+	if err := e.Initialize(); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := e.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	fn(e)
+	e.Shutdown()
+}
+
+func events(t *testing.T, e *backup.Engine, events ...models.FileEvent) {
+	t.Helper()
+	if err := e.ProcessEvents(events); err != nil {
+		t.Fatalf("ProcessEvents: %v", err)
+	}
+}
+
+func event(operation, path string) models.FileEvent {
+	return models.FileEvent{Path: path, Operation: operation}
+}
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	// WriteFile keeps the mode of a file that exists
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// index is the live part of the index as a reader of the repository sees it.
+func index(t *testing.T, backend storage.Backend) map[string]models.FileInfo {
+	t.Helper()
+	m := metadata.NewManager(backend)
+	if err := m.LoadMetadata(); err != nil {
+		t.Fatalf("LoadMetadata: %v", err)
+	}
+	live := make(map[string]models.FileInfo)
+	for path, info := range m.GetMetadata().Files {
+		if !info.IsDeleted {
+			live[path] = info
+		}
+	}
+	return live
+}
+
+// checkIndex compares the live index entries with the files in src.
+func checkIndex(t *testing.T, backend storage.Backend, src string, want ...string) {
+	t.Helper()
+	live := index(t, backend)
+	if len(live) != len(want) {
+		t.Errorf("index has %d files, want %d: %v", len(live), len(want), keys(live))
+	}
+	for _, path := range want {
+		info, ok := live[path]
+		if !ok {
+			t.Errorf("index has no %s: %v", path, keys(live))
+			continue
+		}
+		stat, err := os.Stat(filepath.Join(src, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size != stat.Size() || !info.ModTime.Equal(stat.ModTime()) || os.FileMode(info.Mode) != stat.Mode().Perm() {
+			t.Errorf("index entry of %s = size %d, mtime %v, mode %v; file has %d, %v, %v",
+				path, info.Size, info.ModTime, os.FileMode(info.Mode), stat.Size(), stat.ModTime(), stat.Mode().Perm())
+		}
+		if len(info.Extents) == 0 && info.Size > 0 {
+			t.Errorf("index entry of %s has no extents", path)
+		}
+	}
+}
+
+func keys(files map[string]models.FileInfo) []string {
+	var paths []string
+	for path := range files {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// checkRestore restores the repository and compares the result with src, content and modes.
+func checkRestore(t *testing.T, backend storage.Backend, src string) {
+	t.Helper()
+	target := t.TempDir()
+	r, err := restore.NewEngine(backend, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Initialize(); err != nil {
+		t.Fatalf("restore Initialize: %v", err)
+	}
+	if err := r.RestoreAll(); err != nil {
+		t.Fatalf("RestoreAll: %v", err)
+	}
+
+	want, got := tree(t, src), tree(t, target)
+	for path, file := range want {
+		if restored, ok := got[path]; !ok {
+			t.Errorf("%s was not restored", path)
+		} else if restored != file {
+			t.Errorf("%s restored as %+v, want %+v", path, restored, file)
+		}
+	}
+	for path := range got {
+		if _, ok := want[path]; !ok {
+			t.Errorf("%s was restored but is gone from the source", path)
+		}
+	}
+}
+
+type treeFile struct {
+	content string
+	mode    os.FileMode
+}
+
+func tree(t *testing.T, dir string) map[string]treeFile {
+	t.Helper()
+	files := make(map[string]treeFile)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = treeFile{content: string(data), mode: info.Mode().Perm()}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWatcherEvents(t *testing.T) {
+	backend := newRepository(t)
+	src := t.TempDir()
+	path := func(rel string) string { return filepath.Join(src, rel) }
+
+	run(t, backend, src, func(e *backup.Engine) {
+		writeFile(t, path("a.txt"), "alpha", 0644)
+		writeFile(t, path("b.txt"), "bravo", 0644)
+		writeFile(t, path("sub/c.txt"), "charlie", 0600)
+		writeFile(t, path("sub/d.txt"), "delta", 0644)
+		writeFile(t, path("old/e.txt"), "echo", 0644)
+		events(t, e, event("CREATE", path("a.txt")), event("CREATE", path("b.txt")),
+			event("CREATE", path("sub/c.txt")), event("CREATE", path("sub/d.txt")), event("CREATE", path("old/e.txt")))
+	})
+	checkIndex(t, backend, src, "a.txt", "b.txt", "sub/c.txt", "sub/d.txt", "old/e.txt")
+	deleted, err := os.Stat(path("sub/d.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run(t, backend, src, func(e *backup.Engine) {
+		writeFile(t, path("a.txt"), "alpha, second version", 0644)
+		events(t, e, event("MODIFY", path("a.txt")))
+
+		// written right before the move, the MODIFY of the old name finds nothing
+		writeFile(t, path("b.txt"), "bravo, changed before the move", 0644)
+		if err := os.Rename(path("b.txt"), path("sub/moved.txt")); err != nil {
+			t.Fatal(err)
+		}
+		events(t, e, event("MODIFY", path("b.txt")),
+			models.FileEvent{Path: path("sub/moved.txt"), Operation: "RENAME", OldPath: path("b.txt")})
+
+		if err := os.Remove(path("sub/d.txt")); err != nil {
+			t.Fatal(err)
+		}
+		events(t, e, event("DELETE", path("sub/d.txt")))
+
+		// only the mode changes
+		if err := os.Chmod(path("sub/c.txt"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		events(t, e, event("MODIFY", path("sub/c.txt")))
+	})
+	checkIndex(t, backend, src, "a.txt", "sub/c.txt", "sub/moved.txt", "old/e.txt")
+	checkRestore(t, backend, src)
+
+	run(t, backend, src, func(e *backup.Engine) {
+		// back as it was (cp -p, a restore), the deleted entry is no reason to skip it
+		writeFile(t, path("sub/d.txt"), "delta", 0644)
+		if err := os.Chtimes(path("sub/d.txt"), deleted.ModTime(), deleted.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		events(t, e, event("CREATE", path("sub/d.txt")))
+
+		// a directory moved away only reports itself
+		if err := os.Rename(path("old"), filepath.Join(t.TempDir(), "old")); err != nil {
+			t.Fatal(err)
+		}
+		events(t, e, event("DELETE", path("old")))
+	})
+	checkIndex(t, backend, src, "a.txt", "sub/c.txt", "sub/d.txt", "sub/moved.txt")
+	checkRestore(t, backend, src)
+}
+
+func TestFullBackup(t *testing.T) {
+	backend := newRepository(t)
+	src := t.TempDir()
+	path := func(rel string) string { return filepath.Join(src, rel) }
+	fullBackup := func(e *backup.Engine) {
+		if err := e.PerformFullBackup(); err != nil {
+			t.Fatalf("PerformFullBackup: %v", err)
+		}
+	}
+
+	writeFile(t, path("a.txt"), "alpha", 0644)
+	writeFile(t, path("sub/b.txt"), "bravo", 0644)
+	writeFile(t, path("sub/c.txt"), "charlie", 0755)
+	writeFile(t, path("empty"), "", 0644)
+	run(t, backend, src, fullBackup)
+	checkIndex(t, backend, src, "a.txt", "sub/b.txt", "sub/c.txt", "empty")
+	checkRestore(t, backend, src)
+
+	writeFile(t, path("copy.txt"), "alpha", 0600)
+	run(t, backend, src, fullBackup)
+	checkIndex(t, backend, src, "a.txt", "copy.txt", "sub/b.txt", "sub/c.txt", "empty")
+	// the copy points at the chunk of the original
+	live := index(t, backend)
+	if a, c := live["a.txt"], live["copy.txt"]; a.Hash != c.Hash || len(c.Extents) != 1 || c.Extents[0] != a.Extents[0] {
+		t.Errorf("copy.txt = %+v, want the extents of a.txt %+v", c.Extents, a.Extents)
+	}
+
+	writeFile(t, path("a.txt"), "alpha, second version", 0644)
+	if err := os.Rename(path("sub/b.txt"), path("b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(path("copy.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path("sub/c.txt"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	run(t, backend, src, fullBackup)
+	checkIndex(t, backend, src, "a.txt", "b.txt", "sub/c.txt", "empty")
+	checkRestore(t, backend, src)
+
+	// nothing changed, nothing to write
+	before := index(t, backend)
+	run(t, backend, src, fullBackup)
+	after := index(t, backend)
+	for path, info := range before {
+		if other := after[path]; other.Hash != info.Hash || len(other.Extents) != len(info.Extents) ||
+			(len(info.Extents) > 0 && other.Extents[0] != info.Extents[0]) {
+			t.Errorf("%s changed in a backup without changes: %+v, was %+v", path, other, info)
+		}
+	}
+
+	// a file deleted and created again is backed up again
+	if err := os.Remove(path("b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	run(t, backend, src, fullBackup)
+	checkIndex(t, backend, src, "a.txt", "sub/c.txt", "empty")
+	writeFile(t, path("b.txt"), "bravo", 0644)
+	run(t, backend, src, fullBackup)
+	checkIndex(t, backend, src, "a.txt", "b.txt", "sub/c.txt", "empty")
+	checkRestore(t, backend, src)
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"gobackup/pkg/models"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Watcher events only say that something happened to a path. eventChanges turns
+them into the changes handleChanges works with: paths relative to the watched
+directory, and for files that exist a FileInfo from a fresh stat and hash.
+
+A CREATE, MODIFY or SCAN is checked against the index like a full scan would, so
+a file saved without changing (or scanned again) costs a hash, not a backup.
+A RENAME whose old path was never backed up is a new file under the new name.
+
+This runs in the engine's goroutine, right before the changes are applied, so
+it always compares against the current index.
+*/
+func (e *Engine) eventChanges(events []models.FileEvent) []models.FileChange {
+	var changes []models.FileChange
+	for _, event := range events {
+		relPath, ok := e.relPath(event.Path)
+		if !ok {
+			continue
+		}
+
+		switch event.Operation {
+		case "DELETE":
+			changes = append(changes, models.FileChange{Path: relPath, Operation: "DELETE"})
+
+		case "RENAME":
+			oldPath, ok := e.relPath(event.OldPath)
+			if ok && e.isBackedUp(oldPath) {
+				changes = append(changes, models.FileChange{Path: relPath, Operation: "RENAME", OldPath: oldPath})
+				continue
+			}
+			changes = append(changes, e.scanChanges(event.Path)...)
+
+		case "CREATE", "MODIFY", "SCAN":
+			if change, ok := e.fileChange(event.Path, relPath); ok {
+				changes = append(changes, change)
+			}
+		}
+	}
+	return changes
+}
+
+// relPath makes a watcher path an index key: relative to its root, under the root's name.
+func (e *Engine) relPath(path string) (string, bool) {
+	_, relPath, ok := e.locate(path)
+	return relPath, ok
+}
+
+// isBackedUp reports whether the index has relPath, or files below it.
+func (e *Engine) isBackedUp(relPath string) bool {
+	if info, ok := e.metadata.GetFileInfo(relPath); ok && !info.IsDeleted {
+		return true
+	}
+	prefix := relPath + string(filepath.Separator)
+	for path, info := range e.metadata.GetMetadata().Files {
+		if !info.IsDeleted && strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileChange stats and hashes a file, false if it is gone, filtered or unchanged.
+func (e *Engine) fileChange(fullPath, relPath string) (models.FileChange, bool) {
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.IsDir() || e.check(fullPath, info) != "" {
+		// a file that is gone gets its own DELETE event, or its RENAME checks it again under the new name
+		return models.FileChange{}, false
+	}
+
+	current, err := e.metadata.StatFile(fullPath, relPath, info)
+	if err != nil {
+		log.Printf("Warning: failed to read %s: %v", relPath, err)
+		return models.FileChange{}, false
+	}
+
+	operation := e.metadata.Classify(relPath, current)
+	if operation == "" {
+		return models.FileChange{}, false
+	}
+	return models.FileChange{Path: relPath, Operation: operation, FileInfo: &current}, true
+}
+
+// scanChanges is fileChange for a path that may be a directory, for everything below it.
+func (e *Engine) scanChanges(fullPath string) []models.FileChange {
+	var changes []models.FileChange
+	filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, ok := e.relPath(path)
+		if !ok {
+			return nil
+		}
+		if info.IsDir() {
+			if e.check(path, info) != "" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if change, ok := e.fileChange(path, relPath); ok {
+			changes = append(changes, change)
+		}
+		return nil
+	})
+	return changes
+}
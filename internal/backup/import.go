@@ -0,0 +1,259 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"gobackup/internal/utils"
+	"gobackup/pkg/models"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/*
+Import adds the regular files of a tar archive (gzipped or not, that's detected)
+as if they had been backed up: packed into chunks the way the chunker does it,
+with the modification time and permission bits from the archive. Directories,
+links and special files are skipped, they aren't backed up from disk either.
+
+The archive is streamed, only the chunk being filled is held in memory: a member
+larger than a chunk is split across as many chunks as it needs, smaller ones
+start a new chunk rather than being split.
+
+Files are stored under a root of their own (see roots.go), recorded with the
+archive it came from, so a watch session on the same repository doesn't take
+them for files deleted from its directories. Importing into that root again
+replaces files with the same path.
+*/
+type ImportReport struct {
+	Files    int
+	Bytes    int64
+	Existing int
+	Skipped  int
+	Chunks   int
+}
+
+// importedFile is a file read from the archive, its entry is written once all of its pieces are stored.
+type importedFile struct {
+	info models.FileInfo
+	// pieces still waiting for their chunk to be written
+	unflushed int
+	done      bool
+}
+
+// pendingFile is a piece of an imported file in the chunk being filled.
+type pendingFile struct {
+	file   *importedFile
+	offset int64
+	size   int64
+}
+
+// ImportPrefix marks the directory of a root filled by import, followed by where the archive came from.
+const ImportPrefix = "import:"
+
+// ImportTar reads a tar stream into root name, source is where it came from. Initialize must have run.
+func (e *Engine) ImportTar(r io.Reader, name, source string) (*ImportReport, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.importRoot(name, source); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open gzip stream: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	report := &ImportReport{}
+	var data []byte
+	var files []pendingFile
+
+	flush := func() error {
+		if len(files) == 0 {
+			return nil
+		}
+		if err := e.storeImported(data, files); err != nil {
+			return err
+		}
+		report.Chunks++
+		data, files = nil, nil
+		return nil
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			if hdr.Typeflag != tar.TypeDir {
+				log.Printf("Skipping %s: not a regular file", hdr.Name)
+				report.Skipped++
+			}
+			continue
+		}
+
+		relPath := importName(hdr.Name)
+		if relPath == "" {
+			log.Printf("Skipping %s: not a valid path", hdr.Name)
+			report.Skipped++
+			continue
+		}
+
+		file := &importedFile{info: models.FileInfo{
+			Path:    filepath.Join(name, filepath.FromSlash(relPath)),
+			Size:    hdr.Size,
+			ModTime: hdr.ModTime,
+			Mode:    uint32(fs.FileMode(hdr.Mode).Perm()),
+		}}
+		// only what doesn't fit in a chunk anyway is split
+		if hdr.Size <= e.chunker.chunkSize && int64(len(data))+hdr.Size > e.chunker.chunkSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+
+		start, first := int64(len(data)), len(files)
+		hash := e.chunker.hasher.New()
+		for remaining := hdr.Size; ; {
+			space := e.chunker.chunkSize - int64(len(data))
+			if space <= 0 && remaining > 0 {
+				if err := flush(); err != nil {
+					return report, err
+				}
+				continue
+			}
+			size := min(space, remaining)
+			offset := int64(len(data))
+			data = append(data, make([]byte, size)...)
+			if _, err := io.ReadFull(tr, data[offset:]); err != nil {
+				return report, fmt.Errorf("failed to read %s from the archive: %w", hdr.Name, err)
+			}
+			hash.Write(data[offset:])
+			files = append(files, pendingFile{file: file, offset: offset, size: size})
+			file.unflushed++
+			if remaining -= size; remaining == 0 {
+				break
+			}
+		}
+		file.info.Hash = utils.Sum(hash)
+		file.done = true
+		report.Files++
+		report.Bytes += hdr.Size
+
+		// same content already stored - just point at it, unless part of it had to be written already
+		if existing, ok := e.metadata.FindFileByHash(file.info.Hash); ok && len(file.info.Extents) == 0 {
+			data, files = data[:start], files[:first]
+			file.info.ChunkRefs = existing.ChunkRefs
+			file.info.Extents = existing.Extents
+			e.metadata.UpdateFileInfo(file.info.Path, file.info)
+			report.Existing++
+		}
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+
+	if err := e.commit(); err != nil {
+		return report, err
+	}
+
+	if e.parity != nil {
+		if _, err := e.parity.Protect(e.metadata.Chunks()); err != nil {
+			log.Printf("Warning: failed to build parity: %v", err)
+		}
+	}
+	return report, nil
+}
+
+// importRoot records the root imported files go to, one a watch session backs up can't take them.
+func (e *Engine) importRoot(name, source string) error {
+	if !ValidRootName(name) {
+		return fmt.Errorf("invalid root name %q", name)
+	}
+	roots := e.metadata.Roots()
+	if len(roots) == 0 {
+		for _, info := range e.metadata.GetMetadata().Files {
+			if !info.IsDeleted {
+				return fmt.Errorf("this repository backs up a single unnamed directory, its scans would find imported files deleted; import into a repository with named roots")
+			}
+		}
+	}
+	if path, exists := roots[name]; exists && !strings.HasPrefix(path, ImportPrefix) {
+		return fmt.Errorf("root %s is backed up from %s, import under another name", name, path)
+	}
+	e.metadata.SetRoot(name, ImportPrefix+source)
+	return nil
+}
+
+// storeImported writes one chunk of imported files and points the entries of the files it completes at it.
+func (e *Engine) storeImported(data []byte, files []pendingFile) error {
+	hash := e.chunker.hasher.HashData(data)
+	chunkID := 0
+	if existing, ok := e.metadata.FindChunkByHash(hash); ok {
+		chunkID = existing.ID
+	} else {
+		header := &ChunkHeader{ChunkID: e.chunker.takeID(), CreatedAt: time.Now()}
+		for _, piece := range files {
+			info := piece.file.info
+			fileHash := info.Hash
+			// a piece of a split file, or one whose hash isn't known yet, carries its own hash
+			if !piece.file.done || piece.size != info.Size {
+				fileHash = e.chunker.hasher.HashData(data[piece.offset : piece.offset+piece.size])
+			}
+			header.Files = append(header.Files, ChunkHeaderFile{
+				Path:    info.Path,
+				Offset:  piece.offset,
+				Size:    piece.size,
+				Hash:    fileHash,
+				ModTime: info.ModTime,
+				Mode:    info.Mode,
+			})
+		}
+		info, err := e.storeChunk(header, data, hash)
+		if err != nil {
+			return err
+		}
+		chunkID = info.ID
+		log.Printf("Created chunk %s with %d files", info.Filename, len(files))
+	}
+
+	for _, piece := range files {
+		file := piece.file
+		file.info.ChunkRefs = append(file.info.ChunkRefs, chunkID)
+		file.info.Extents = append(file.info.Extents, models.Extent{ChunkID: chunkID, Offset: piece.offset, Size: piece.size})
+		if file.unflushed--; file.unflushed == 0 && file.done {
+			e.metadata.UpdateFileInfo(file.info.Path, file.info)
+		}
+	}
+	// committed chunk by chunk, a large import doesn't start over after a failure
+	return e.commit()
+}
+
+// importName turns an archive member name into a repository path, "" if it can't be one.
+func importName(name string) string {
+	name = path.Clean(strings.TrimLeft(name, "/"))
+	if name == "." || !fs.ValidPath(name) {
+		return ""
+	}
+	return name
+}
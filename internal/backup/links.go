@@ -0,0 +1,73 @@
+package backup
+
+import (
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"time"
+)
+
+/*
+Link records:
+Chunk headers only know the files that were written into that chunk. Entries
+that point at content stored earlier (a copy or revert found by its hash, a
+chunk that turned out to be a duplicate, a rename, an import of known content)
+and deletions never show up in a header, so an index rebuilt from the headers
+alone would silently miss them.
+
+Every commit that has such entries first writes a link record next to the
+chunks: data/links_<unix nanos>.gz, encoded, compressed and encrypted like a
+chunk but without data, its header listing each entry with its extents plus
+the deleted paths. Its ChunkID is the newest chunk when it was written, so
+RebuildIndex can replay chunks and link records in the order they were written
+(copied chunks keep the CreatedAt of their source, it can't go by time).
+*/
+const LinksPrefix = "links_"
+
+// commit writes the link record for what the chunk headers don't cover, then commits the index.
+func (e *Engine) commit() error {
+	if err := e.writeLinks(); err != nil {
+		return err
+	}
+	return e.metadata.SaveMetadata()
+}
+
+func (e *Engine) writeLinks() error {
+	files, deleted := e.metadata.Pending()
+	record := &ChunkHeader{CreatedAt: time.Now(), Deleted: deleted}
+	for _, file := range files {
+		// entries without extents can't be restored from anything anyway
+		if len(file.Extents) == 0 {
+			continue
+		}
+		if len(file.Extents) == 1 && e.covered[file.Path] == file.Extents[0] {
+			continue
+		}
+		record.Files = append(record.Files, ChunkHeaderFile{
+			Path:    file.Path,
+			Size:    file.Size,
+			Hash:    file.Hash,
+			ModTime: file.ModTime,
+			Mode:    file.Mode,
+			Extents: file.Extents,
+		})
+	}
+	clear(e.covered)
+	if len(record.Files) == 0 && len(record.Deleted) == 0 {
+		return nil
+	}
+
+	// replayed after every chunk up to this one
+	record.ChunkID = e.metadata.MaxChunkID()
+	record.Roots = e.metadata.Roots()
+	sealed, err := e.seal(record, nil)
+	if err != nil {
+		return fmt.Errorf("failed to encode link record: %w", err)
+	}
+	// durable before the commit, like chunks
+	name := fmt.Sprintf("%s%d.gz", LinksPrefix, record.CreatedAt.UnixNano())
+	if err := storage.SaveBytes(e.backend, repository.ChunkName(name), sealed); err != nil {
+		return fmt.Errorf("failed to write link record: %w", err)
+	}
+	return nil
+}
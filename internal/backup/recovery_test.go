@@ -0,0 +1,125 @@
+package backup_test
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"gobackup/internal/backup"
+	"gobackup/internal/repository"
+	"gobackup/internal/restore"
+	"gobackup/internal/storage"
+)
+
+func chunkFiles(t *testing.T, backend storage.Backend) []string {
+	t.Helper()
+	entries, err := backend.List(repository.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name, "chunk_") {
+			names = append(names, entry.Name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func fullBackup(t *testing.T) func(e *backup.Engine) {
+	return func(e *backup.Engine) {
+		if err := e.PerformFullBackup(); err != nil {
+			t.Fatalf("PerformFullBackup: %v", err)
+		}
+	}
+}
+
+func hasAll(have, want []string) bool {
+	set := make(map[string]bool, len(have))
+	for _, name := range have {
+		set[name] = true
+	}
+	for _, name := range want {
+		if !set[name] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRecoveryKeepsChunksWithoutIndex(t *testing.T) {
+	backend := newRepository(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), "alpha", 0644)
+	run(t, backend, src, fullBackup(t))
+	writeFile(t, filepath.Join(src, "b.txt"), "bravo", 0644)
+	run(t, backend, src, fullBackup(t))
+	written := chunkFiles(t, backend)
+	if len(written) == 0 {
+		t.Fatal("the backup wrote no chunks")
+	}
+
+	entries, err := backend.List(repository.IndexDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if err := backend.Remove(repository.IndexName(entry.Name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every chunk looks like an orphan to an empty index, the run must not start
+	e := backup.NewEngine(src, backend)
+	e.SetSettle(0, nil)
+	if err := e.Initialize(); err == nil || !strings.Contains(err.Error(), "repair index") {
+		t.Errorf("Initialize with an empty index = %v, want an error pointing at repair index", err)
+	}
+	e.Shutdown()
+	if got := chunkFiles(t, backend); !hasAll(got, written) {
+		t.Fatalf("chunks after a run without index = %v, want %v", got, written)
+	}
+
+	r, err := restore.NewEngine(backend, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.RebuildIndex(); err != nil {
+		t.Fatalf("RebuildIndex: %v", err)
+	}
+	writeFile(t, filepath.Join(src, "c.txt"), "charlie", 0644)
+	run(t, backend, src, fullBackup(t))
+	if got := chunkFiles(t, backend); !hasAll(got, written) {
+		t.Fatalf("chunks after repair index and a backup = %v, want %v", got, written)
+	}
+	checkIndex(t, backend, src, "a.txt", "b.txt", "c.txt")
+	checkRestore(t, backend, src)
+}
+
+func TestRecoveryRemovesOnlyNewOrphans(t *testing.T) {
+	backend := newRepository(t)
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), "alpha", 0644)
+	run(t, backend, src, fullBackup(t))
+
+	// chunk 0 is below the last committed one, so the index lost it; chunk 99
+	// was written by a run that crashed before committing it
+	unindexed, orphan := repository.ChunkName("chunk_000000.gz"), repository.ChunkName("chunk_000099.gz")
+	for _, name := range []string{unindexed, orphan} {
+		if err := storage.SaveBytes(backend, name, []byte("not committed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile(t, filepath.Join(src, "b.txt"), "bravo", 0644)
+	run(t, backend, src, fullBackup(t))
+	if exists, err := storage.Exists(backend, unindexed); err != nil || !exists {
+		t.Errorf("unindexed chunk below the last committed one was removed (%v)", err)
+	}
+	if exists, err := storage.Exists(backend, orphan); err != nil || exists {
+		t.Errorf("orphan chunk above the last committed one was kept (%v)", err)
+	}
+	checkIndex(t, backend, src, "a.txt", "b.txt")
+}
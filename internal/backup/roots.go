@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"fmt"
+	"gobackup/internal/filter"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Roots:
+One session can back up several directories into one repository, e.g. /etc,
+/home and /srv/data of a host, so they share the chunk store and dedup across
+each other. Each root has a name and its files are stored under name/ in the
+index (etc/passwd, home/alice/.bashrc), the repository remembers which directory
+each name was backed up from.
+
+The single unnamed root of NewEngine keeps the layout of older repositories,
+its files are stored without a prefix, so it can't be mixed with named ones.
+*/
+type root struct {
+	name string
+	// as the watcher reports it, and absolute for the index
+	path    string
+	absPath string
+	filter  *filter.Filter
+}
+
+// AddRoot adds a directory to back up, its files are stored under name ("" for the old single-root layout).
+func (e *Engine) AddRoot(name, path string, rules *filter.Filter) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %w", path, err)
+	}
+	if name != "" && !ValidRootName(name) {
+		return fmt.Errorf("invalid root name %q", name)
+	}
+
+	for _, other := range e.roots {
+		switch {
+		case name == "" || other.name == "":
+			return fmt.Errorf("an unnamed directory can only be backed up on its own, name every root")
+		case other.name == name:
+			return fmt.Errorf("root name %q is used twice", name)
+		case within(absPath, other.absPath) || within(other.absPath, absPath):
+			return fmt.Errorf("roots %s and %s overlap", other.absPath, absPath)
+		}
+	}
+	e.roots = append(e.roots, &root{name: name, path: filepath.Clean(path), absPath: absPath, filter: rules})
+	return nil
+}
+
+// ValidRootName reports whether name can name a root, it becomes the first element of its files' paths.
+func ValidRootName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+// recordRoots remembers in the index where each named root is backed up from.
+func (e *Engine) recordRoots() error {
+	for _, r := range e.roots {
+		if r.name == "" {
+			// it would take every named root's files for its own and find them deleted
+			if roots := e.metadata.GetMetadata().Roots; len(roots) > 0 {
+				return fmt.Errorf("this repository holds named roots (%d), %s needs a name too", len(roots), r.path)
+			}
+			continue
+		}
+		if previous, existed := e.metadata.SetRoot(r.name, r.absPath); existed && previous != r.absPath {
+			log.Printf("Warning: root %s was backed up from %s before, now from %s", r.name, previous, r.absPath)
+		}
+	}
+	return nil
+}
+
+// locate finds the root of a watcher path, and the path's index key.
+func (e *Engine) locate(path string) (*root, string, bool) {
+	for _, r := range e.roots {
+		relPath, err := filepath.Rel(r.path, path)
+		if err != nil || relPath == "." || relPath == ".." || strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+			continue
+		}
+		return r, filepath.Join(r.name, relPath), true
+	}
+	return nil, "", false
+}
+
+// fullPath is where the file of an index key is on disk.
+func (e *Engine) fullPath(key string) string {
+	for _, r := range e.roots {
+		if r.name == "" {
+			return filepath.Join(r.path, key)
+		}
+		if strings.HasPrefix(key, r.name+string(filepath.Separator)) {
+			return filepath.Join(r.path, key[len(r.name)+1:])
+		}
+	}
+	return key
+}
+
+// check is the filter check of the root path is in, "" if it isn't excluded.
+func (e *Engine) check(path string, info os.FileInfo) string {
+	r, _, ok := e.locate(path)
+	if !ok {
+		return ""
+	}
+	return r.filter.CheckPath(path, info)
+}
+
+func within(path, dir string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
@@ -0,0 +1,172 @@
+package backup
+
+import (
+	"gobackup/internal/filter"
+	"gobackup/pkg/models"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+Quiescence:
+A file is only read for a backup once it has stopped changing, so a download or
+an scp upload in progress is never stored half written. A file is settled when
+its mtime is older than the settle time, or when its size and mtime haven't
+changed for the settle time (that second rule is for network filesystems whose
+mtimes come from the server's clock). Until then its events are held back and
+looked at again, full scans leave it for the watcher to pick up.
+
+The settle time is --settle-time, or the one of the last --settle pattern that
+matches (e.g. *.iso=30s for slow copies of big files).
+
+fsnotify doesn't offer IN_CLOSE_WRITE in its public API, so a writer closing the
+file can't end the wait early; the stat checks are all there is.
+*/
+const DefaultSettleTime = 2 * time.Second
+
+type SettleRule struct {
+	Pattern string
+	Wait    time.Duration
+}
+
+type settleState struct {
+	size    int64
+	modTime time.Time
+	seen    time.Time
+}
+
+type settler struct {
+	wait  time.Duration
+	rules []SettleRule
+
+	mu sync.Mutex
+	// files seen changing recently, relative path -> last stat
+	files map[string]settleState
+}
+
+func newSettler() *settler {
+	return &settler{wait: DefaultSettleTime, files: make(map[string]settleState)}
+}
+
+// SetSettle sets how long a file must be left alone before it is backed up.
+func (e *Engine) SetSettle(wait time.Duration, rules []SettleRule) {
+	e.settle.mu.Lock()
+	defer e.settle.mu.Unlock()
+	e.settle.wait = wait
+	e.settle.rules = rules
+}
+
+func (s *settler) waitFor(relPath string) time.Duration {
+	wait := s.wait
+	for _, rule := range s.rules {
+		if filter.Match(rule.Pattern, relPath) {
+			wait = rule.Wait
+		}
+	}
+	return wait
+}
+
+// settled reports whether a file has stopped changing, info is its current stat.
+func (s *settler) settled(relPath string, info os.FileInfo) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	wait := s.waitFor(relPath)
+	now := time.Now()
+	if wait <= 0 || now.Sub(info.ModTime()) >= wait {
+		delete(s.files, relPath)
+		return true
+	}
+
+	state, seen := s.files[relPath]
+	if seen && state.size == info.Size() && state.modTime.Equal(info.ModTime()) {
+		if now.Sub(state.seen) >= wait {
+			delete(s.files, relPath)
+			return true
+		}
+		return false
+	}
+	if !seen {
+		log.Printf("Waiting for %s to settle, it is still being written", relPath)
+	}
+	s.files[relPath] = settleState{size: info.Size(), modTime: info.ModTime(), seen: now}
+	return false
+}
+
+// forget drops a file that is gone.
+func (s *settler) forget(relPath string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, relPath)
+}
+
+// recheckInterval is how often held back events are looked at again.
+func (s *settler) recheckInterval() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wait > 0 && s.wait < time.Second {
+		return s.wait
+	}
+	return time.Second
+}
+
+// holdUnsettled splits off the events of files that are still being written.
+func (e *Engine) holdUnsettled(events []models.FileEvent) (ready, held []models.FileEvent) {
+	for _, event := range events {
+		switch event.Operation {
+		case "CREATE", "MODIFY", "SCAN":
+		default:
+			ready = append(ready, event)
+			continue
+		}
+
+		relPath, ok := e.relPath(event.Path)
+		if !ok {
+			continue
+		}
+		info, err := os.Lstat(event.Path)
+		if err != nil {
+			e.settle.forget(relPath)
+			ready = append(ready, event)
+			continue
+		}
+		if info.IsDir() || e.settle.settled(relPath, info) {
+			ready = append(ready, event)
+			continue
+		}
+		held = append(held, event)
+	}
+	return ready, held
+}
+
+// holdUnsettledChanges does the same for the changes of a full scan, held back files go to the watcher path.
+func (e *Engine) holdUnsettledChanges(changes []models.FileChange) []models.FileChange {
+	var ready []models.FileChange
+	var held []models.FileEvent
+	for _, change := range changes {
+		if change.FileInfo == nil {
+			ready = append(ready, change)
+			continue
+		}
+		fullPath := e.fullPath(change.Path)
+		info, err := os.Lstat(fullPath)
+		if err != nil || e.settle.settled(change.Path, info) {
+			ready = append(ready, change)
+			continue
+		}
+		held = append(held, eventFor(fullPath, "SCAN"))
+	}
+
+	if len(held) > 0 {
+		if err := e.ProcessEvents(held); err != nil {
+			log.Printf("Warning: %d files still being written are left for the next scan: %v", len(held), err)
+		}
+	}
+	return ready
+}
+
+func eventFor(path, operation string) models.FileEvent {
+	return models.FileEvent{Path: path, Operation: operation, Timestamp: time.Now()}
+}
@@ -0,0 +1,116 @@
+package backup
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+type statInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi statInfo) Name() string       { return "f" }
+func (fi statInfo) Size() int64        { return fi.size }
+func (fi statInfo) Mode() os.FileMode  { return 0644 }
+func (fi statInfo) ModTime() time.Time { return fi.modTime }
+func (fi statInfo) IsDir() bool        { return false }
+func (fi statInfo) Sys() any           { return nil }
+
+func TestSettled(t *testing.T) {
+	const wait = time.Minute
+	now := time.Now()
+	fresh := statInfo{size: 10, modTime: now}
+
+	tests := []struct {
+		name string
+		// stats of the file one after the other, with the time since the first one
+		stats []statInfo
+		after []time.Duration
+		want  []bool
+	}{
+		{
+			name:  "old file",
+			stats: []statInfo{{size: 10, modTime: now.Add(-2 * wait)}},
+			after: []time.Duration{0},
+			want:  []bool{true},
+		},
+		{
+			name:  "unchanged for the settle time",
+			stats: []statInfo{fresh, fresh, fresh},
+			after: []time.Duration{0, wait / 2, wait},
+			want:  []bool{false, false, true},
+		},
+		{
+			name:  "still growing",
+			stats: []statInfo{fresh, {size: 20, modTime: now}, {size: 20, modTime: now}},
+			after: []time.Duration{0, wait, wait + wait/2},
+			want:  []bool{false, false, false},
+		},
+		{
+			name:  "touched",
+			stats: []statInfo{fresh, {size: 10, modTime: now.Add(time.Second)}, {size: 10, modTime: now.Add(time.Second)}},
+			after: []time.Duration{0, wait, 2 * wait},
+			want:  []bool{false, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newSettler()
+			s.wait = wait
+			for i, info := range tt.stats {
+				// pretend the earlier stats were taken that much earlier
+				if state, ok := s.files["f"]; ok && i > 0 {
+					state.seen = state.seen.Add(-(tt.after[i] - tt.after[i-1]))
+					s.files["f"] = state
+				}
+				if got := s.settled("f", info); got != tt.want[i] {
+					t.Errorf("settled after %v = %v, want %v", tt.after[i], got, tt.want[i])
+				}
+			}
+			if tt.want[len(tt.want)-1] {
+				if _, ok := s.files["f"]; ok {
+					t.Errorf("a settled file is still tracked")
+				}
+			}
+		})
+	}
+}
+
+func TestSettleRules(t *testing.T) {
+	s := newSettler()
+	s.wait = time.Second
+	s.rules = []SettleRule{
+		{Pattern: "*.iso", Wait: 30 * time.Second},
+		{Pattern: "fast/*.iso", Wait: 0},
+	}
+	tests := []struct {
+		path string
+		want time.Duration
+	}{
+		{"a.txt", time.Second},
+		{"images/a.iso", 30 * time.Second},
+		// the last matching rule wins
+		{"fast/a.iso", 0},
+		{"fast/deep/a.iso", 30 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := s.waitFor(tt.path); got != tt.want {
+			t.Errorf("waitFor(%s) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	fresh := statInfo{size: 1, modTime: time.Now()}
+	if !s.settled("fast/a.iso", fresh) {
+		t.Errorf("a file without settle time was held back")
+	}
+	if s.settled("a.txt", fresh) {
+		t.Errorf("a file written just now was not held back")
+	}
+	s.forget("a.txt")
+	if len(s.files) != 0 {
+		t.Errorf("forget left %v", s.files)
+	}
+}
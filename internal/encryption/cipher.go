@@ -0,0 +1,92 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// MasterKeySize is the length of the repository master key (AES-256).
+const MasterKeySize = 32
+
+/*
+MasterKey is the single key every chunk in the repository is encrypted with.
+It never touches disk in the clear - each key slot stores its own wrapped copy,
+so adding or removing a slot doesn't require re-encrypting any chunk data.
+*/
+type MasterKey struct {
+	key []byte
+}
+
+func NewMasterKey() (*MasterKey, error) {
+	key := make([]byte, MasterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %w", err)
+	}
+	return &MasterKey{key: key}, nil
+}
+
+// Encrypt seals data with AES-256-GCM, output is nonce || ciphertext.
+func (k *MasterKey) Encrypt(data []byte) ([]byte, error) {
+	return seal(k.key, data)
+}
+
+func (k *MasterKey) Decrypt(data []byte) ([]byte, error) {
+	return open(k.key, data)
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, data []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// IDKey is the repository secret for keyed chunk/file hashes, derived so it never equals the encryption key.
+func (k *MasterKey) IDKey() []byte {
+	idKey := make([]byte, 32)
+	reader := hkdf.New(sha256.New, k.key, nil, []byte("gobackup chunk id"))
+	if _, err := io.ReadFull(reader, idKey); err != nil {
+		// hkdf can only fail when asked for more than 255*32 bytes
+		panic(err)
+	}
+	return idKey
+}
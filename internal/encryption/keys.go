@@ -0,0 +1,300 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gobackup/internal/storage"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	KeysDir = "keys"
+
+	SlotPassphrase = "passphrase"
+	SlotKeyFile    = "keyfile"
+)
+
+// scrypt parameters for new slots, old slots keep whatever they were created with
+var defaultKDF = KDFParams{N: 1 << 15, R: 8, P: 1}
+
+type KDFParams struct {
+	N int `json:"n"`
+	R int `json:"r"`
+	P int `json:"p"`
+}
+
+// Limits for the parameters of a slot, far above the defaults, so a damaged or
+// tampered slot can't make an unlock take gigabytes of memory or hours of CPU.
+const (
+	maxKDFMemory = 1 << 30 // 128*N*r bytes, 32 MB with the defaults
+	maxKDFWork   = 1 << 24 // N*r*p, 2^18 with the defaults
+)
+
+func (p KDFParams) check() error {
+	if p.N < 2 || p.N&(p.N-1) != 0 || p.R < 1 || p.P < 1 {
+		return fmt.Errorf("invalid scrypt parameters N=%d r=%d p=%d", p.N, p.R, p.P)
+	}
+	if int64(p.N)*int64(p.R) > maxKDFMemory/128 || int64(p.N)*int64(p.R)*int64(p.P) > maxKDFWork {
+		return fmt.Errorf("scrypt parameters N=%d r=%d p=%d are beyond the limits of this version", p.N, p.R, p.P)
+	}
+	return nil
+}
+
+/*
+KeySlot holds one wrapped copy of the master key.
+Every team member / daemon gets their own slot, so access can be granted or
+revoked without touching the chunk data.
+*/
+type KeySlot struct {
+	ID         string    `json:"id"`
+	Kind       string    `json:"kind"`
+	Host       string    `json:"host"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+	KDF        KDFParams `json:"kdf"`
+	Salt       []byte    `json:"salt"`
+	WrappedKey []byte    `json:"wrapped_key"`
+}
+
+type KeyStore struct {
+	backend storage.Backend
+}
+
+func NewKeyStore(backend storage.Backend) *KeyStore {
+	return &KeyStore{backend: backend}
+}
+
+func slotName(id string) string {
+	return path.Join(KeysDir, id+".json")
+}
+
+// HasKeys reports whether the repository is encrypted.
+func (s *KeyStore) HasKeys() (bool, error) {
+	slots, err := s.List()
+	if err != nil {
+		return false, err
+	}
+	return len(slots) > 0, nil
+}
+
+func (s *KeyStore) List() ([]KeySlot, error) {
+	entries, err := s.backend.List(KeysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var slots []KeySlot
+	for _, entry := range entries {
+		if entry.IsDir || path.Ext(entry.Name) != ".json" {
+			continue
+		}
+
+		data, err := storage.LoadBytes(s.backend, path.Join(KeysDir, entry.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		var slot KeySlot
+		if err := json.Unmarshal(data, &slot); err != nil {
+			return nil, fmt.Errorf("invalid key slot %s: %w", entry.Name, err)
+		}
+		slots = append(slots, slot)
+	}
+
+	sort.Slice(slots, func(i, j int) bool {
+		return slots[i].CreatedAt.Before(slots[j].CreatedAt)
+	})
+	return slots, nil
+}
+
+// Create sets up encryption for a repository: a fresh master key and its first slot.
+func (s *KeyStore) Create(secret []byte, kind string) (*MasterKey, *KeySlot, error) {
+	hasKeys, err := s.HasKeys()
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasKeys {
+		return nil, nil, fmt.Errorf("repository already has keys")
+	}
+
+	master, err := NewMasterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slot, err := s.AddSlot(master, secret, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	return master, slot, nil
+}
+
+// Unlock tries the secret against every slot and returns the master key of the first match.
+func (s *KeyStore) Unlock(secret []byte) (*MasterKey, *KeySlot, error) {
+	slots, err := s.List()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(slots) == 0 {
+		return nil, nil, fmt.Errorf("repository is not encrypted")
+	}
+
+	for i := range slots {
+		if err := slots[i].KDF.check(); err != nil {
+			log.Printf("Warning: skipping key slot %s: %v", slots[i].ID, err)
+			continue
+		}
+		master, err := slots[i].unwrap(secret)
+		if err == nil {
+			return master, &slots[i], nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no key slot matches the given passphrase or key file")
+}
+
+func (s *KeyStore) AddSlot(master *MasterKey, secret []byte, kind string) (*KeySlot, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	slot := &KeySlot{
+		ID:        hex.EncodeToString(id),
+		Kind:      kind,
+		Host:      host,
+		Username:  username,
+		CreatedAt: time.Now(),
+	}
+	if err := slot.wrap(master, secret); err != nil {
+		return nil, err
+	}
+
+	if err := s.writeSlot(slot); err != nil {
+		return nil, err
+	}
+	return slot, nil
+}
+
+// ChangeSecret rewraps the same master key for a slot under a new secret.
+func (s *KeyStore) ChangeSecret(slot *KeySlot, master *MasterKey, newSecret []byte) error {
+	if err := slot.wrap(master, newSecret); err != nil {
+		return err
+	}
+	return s.writeSlot(slot)
+}
+
+func (s *KeyStore) Remove(id string) error {
+	slots, err := s.List()
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, slot := range slots {
+		if slot.ID == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("key slot %s not found", id)
+	}
+	if len(slots) == 1 {
+		return fmt.Errorf("refusing to remove the last key slot, the repository would become unreadable")
+	}
+
+	return s.backend.Remove(slotName(id))
+}
+
+func (s *KeyStore) writeSlot(slot *KeySlot) error {
+	data, err := json.MarshalIndent(slot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return storage.SaveBytes(s.backend, slotName(slot.ID), data)
+}
+
+func (slot *KeySlot) wrap(master *MasterKey, secret []byte) error {
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+
+	kek, err := scrypt.Key(secret, salt, defaultKDF.N, defaultKDF.R, defaultKDF.P, MasterKeySize)
+	if err != nil {
+		return fmt.Errorf("failed to derive key: %w", err)
+	}
+
+	wrapped, err := seal(kek, master.key)
+	if err != nil {
+		return fmt.Errorf("failed to wrap master key: %w", err)
+	}
+
+	slot.KDF = defaultKDF
+	slot.Salt = salt
+	slot.WrappedKey = wrapped
+	return nil
+}
+
+func (slot *KeySlot) unwrap(secret []byte) (*MasterKey, error) {
+	if err := slot.KDF.check(); err != nil {
+		return nil, err
+	}
+	kek, err := scrypt.Key(secret, slot.Salt, slot.KDF.N, slot.KDF.R, slot.KDF.P, MasterKeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := open(kek, slot.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != MasterKeySize {
+		return nil, fmt.Errorf("unwrapped key has wrong size")
+	}
+	return &MasterKey{key: key}, nil
+}
+
+// GenerateKeyFile writes a random secret for unattended use (e.g. watch daemons).
+func GenerateKeyFile(path string) ([]byte, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	encoded := []byte(hex.EncodeToString(secret))
+	if err := os.WriteFile(path, append(encoded, '\n'), 0600); err != nil {
+		return nil, fmt.Errorf("failed to write key file: %w", err)
+	}
+	return encoded, nil
+}
+
+func ReadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return nil, fmt.Errorf("key file %s is empty", path)
+	}
+	return []byte(secret), nil
+}
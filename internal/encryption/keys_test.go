@@ -0,0 +1,126 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"gobackup/internal/storage"
+)
+
+func TestKeySlots(t *testing.T) {
+	store := NewKeyStore(storage.NewMemory())
+
+	master, first, err := store.Create([]byte("first passphrase"), SlotPassphrase)
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, _, err := store.Create([]byte("again"), SlotPassphrase); err == nil {
+		t.Error("Create on a repository with keys succeeded")
+	}
+	second, err := store.AddSlot(master, []byte("key file secret"), SlotKeyFile)
+	if err != nil {
+		t.Fatalf("AddSlot: %v", err)
+	}
+
+	unlock := func(secret string, want *KeySlot) {
+		t.Helper()
+		key, slot, err := store.Unlock([]byte(secret))
+		if want == nil {
+			if err == nil {
+				t.Errorf("Unlock(%q) opened slot %s", secret, slot.ID)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("Unlock(%q): %v", secret, err)
+		}
+		if slot.ID != want.ID {
+			t.Errorf("Unlock(%q) used slot %s, want %s", secret, slot.ID, want.ID)
+		}
+		// every slot wraps the same master key, nothing gets re-encrypted
+		if !bytes.Equal(key.key, master.key) {
+			t.Errorf("Unlock(%q) returned another master key", secret)
+		}
+	}
+	unlock("first passphrase", first)
+	unlock("key file secret", second)
+	unlock("wrong", nil)
+
+	if err := store.ChangeSecret(first, master, []byte("new passphrase")); err != nil {
+		t.Fatalf("ChangeSecret: %v", err)
+	}
+	unlock("first passphrase", nil)
+	unlock("new passphrase", first)
+
+	if err := store.Remove("0000000000000000"); err == nil {
+		t.Error("Remove of an unknown slot succeeded")
+	}
+	if err := store.Remove(second.ID); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	unlock("key file secret", nil)
+	if err := store.Remove(first.ID); err == nil {
+		t.Error("Remove of the last slot succeeded")
+	}
+	slots, err := store.List()
+	if err != nil || len(slots) != 1 || slots[0].ID != first.ID {
+		t.Errorf("List after Remove = %v, %v, want slot %s only", slots, err, first.ID)
+	}
+}
+
+func TestKDFLimits(t *testing.T) {
+	tests := []struct {
+		params KDFParams
+		ok     bool
+	}{
+		{defaultKDF, true},
+		{KDFParams{N: 1 << 20, R: 8, P: 1}, true},
+		{KDFParams{N: 1 << 21, R: 8, P: 1}, false},
+		{KDFParams{N: 1 << 15, R: 8, P: 64}, true},
+		{KDFParams{N: 1 << 15, R: 8, P: 65}, false},
+		{KDFParams{N: 1 << 30, R: 1, P: 1}, false},
+		{KDFParams{N: 1000, R: 8, P: 1}, false},
+		{KDFParams{N: 1 << 15, R: 0, P: 1}, false},
+		{KDFParams{N: 1 << 15, R: 8, P: 0}, false},
+		{KDFParams{N: 0, R: 8, P: 1}, false},
+	}
+	for _, tt := range tests {
+		if err := tt.params.check(); (err == nil) != tt.ok {
+			t.Errorf("check(%+v) = %v, want ok = %v", tt.params, err, tt.ok)
+		}
+	}
+}
+
+func TestUnlockSkipsTamperedSlot(t *testing.T) {
+	backend := storage.NewMemory()
+	store := NewKeyStore(backend)
+	master, slot, err := store.Create([]byte("passphrase"), SlotPassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a copy of the slot asking for 128 GB, tried first
+	tampered := *slot
+	tampered.ID = "tampered"
+	tampered.CreatedAt = slot.CreatedAt.Add(-1)
+	tampered.KDF = KDFParams{N: 1 << 30, R: 1 << 7, P: 1}
+	data, err := json.Marshal(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveBytes(backend, slotName(tampered.ID), data); err != nil {
+		t.Fatal(err)
+	}
+
+	key, used, err := store.Unlock([]byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Unlock: %v", err)
+	}
+	if used.ID != slot.ID || !bytes.Equal(key.key, master.key) {
+		t.Errorf("Unlock used slot %s, want %s", used.ID, slot.ID)
+	}
+	if _, err := tampered.unwrap([]byte("passphrase")); err == nil {
+		t.Error("unwrap of the tampered slot succeeded")
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package filter
+
+import (
+	"os"
+	"syscall"
+)
+
+// deviceOf returns the device a file is on, for --one-file-system.
+func deviceOf(info os.FileInfo) (uint64, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return uint64(stat.Dev), true
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package filter
+
+import "os"
+
+// no device numbers here, --one-file-system doesn't skip anything on windows
+func deviceOf(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
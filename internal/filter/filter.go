@@ -0,0 +1,232 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Filter decides which files under the watched directory are backed up. The
+watcher and the full scan ask the same Filter, so a file is either seen by both
+or by neither, and an excluded directory is never walked or watched.
+
+Rules come from three places, later ones win over earlier ones:
+ 1. the exclude file (--exclude-file)
+ 2. .gobackupignore files, a deeper one over the ones above it
+ 3. --exclude, then --include (an include is a !pattern)
+
+Like git, a file inside an excluded directory can't be included again, the
+directory isn't even looked at.
+
+Files that were backed up and are excluded now are treated like deleted ones.
+*/
+type Filter struct {
+	root string
+	// from the exclude file and the command line, see the order above
+	fileRules []pattern
+	cliRules  []pattern
+
+	maxSize       int64
+	maxAge        time.Duration
+	notBefore     time.Time
+	oneFS         bool
+	rootDev       uint64
+	excludeCaches bool
+	excludeTypes  map[string]bool
+
+	mu sync.Mutex
+	// directory -> patterns of its .gobackupignore, nil if it has none
+	dirRules map[string][]pattern
+}
+
+// IgnoreFile is the name of the per-directory ignore file.
+const IgnoreFile = ".gobackupignore"
+
+type Options struct {
+	Excludes []string
+	Includes []string
+	// gitignore-style file applying to the whole watched directory
+	ExcludeFile string
+
+	// files larger than this are skipped, 0 for no limit
+	MaxSize int64
+	// files not modified within MaxAge, or since NotBefore, are skipped
+	MaxAge    time.Duration
+	NotBefore time.Time
+	// stay on the filesystem of the watched directory
+	OneFileSystem bool
+	// skip directories with a CACHEDIR.TAG
+	ExcludeCaches bool
+	// symlink, socket, fifo or device, see limits.go
+	ExcludeTypes []string
+}
+
+func New(root string, opts Options) (*Filter, error) {
+	f := &Filter{
+		root:          root,
+		dirRules:      make(map[string][]pattern),
+		maxSize:       opts.MaxSize,
+		maxAge:        opts.MaxAge,
+		notBefore:     opts.NotBefore,
+		oneFS:         opts.OneFileSystem,
+		excludeCaches: opts.ExcludeCaches,
+		excludeTypes:  make(map[string]bool),
+	}
+
+	for _, name := range opts.ExcludeTypes {
+		switch name {
+		case ReasonSymlink, ReasonSocket, ReasonFIFO, ReasonDevice:
+			f.excludeTypes[name] = true
+		default:
+			return nil, fmt.Errorf("unknown file type %q (symlink, socket, fifo or device)", name)
+		}
+	}
+	if f.oneFS {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if f.rootDev, f.oneFS = deviceOf(info); !f.oneFS {
+			log.Printf("Warning: --one-file-system is not supported on this platform")
+		}
+	}
+
+	if opts.ExcludeFile != "" {
+		rules, err := readRules(opts.ExcludeFile, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read exclude file: %w", err)
+		}
+		f.fileRules = rules
+	}
+	for _, line := range opts.Excludes {
+		if p, ok := parsePattern(line, ""); ok {
+			f.cliRules = append(f.cliRules, p)
+		}
+	}
+	for _, line := range opts.Includes {
+		if p, ok := parsePattern(line, ""); ok {
+			p.negate = true
+			f.cliRules = append(f.cliRules, p)
+		}
+	}
+	return f, nil
+}
+
+// Excluded reports whether rel (relative to the root) is left out, a nil Filter excludes nothing.
+func (f *Filter) Excluded(rel string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	rel = filepath.ToSlash(filepath.Clean(rel))
+	if rel == "." || rel == "" {
+		return false
+	}
+
+	parts := strings.Split(rel, "/")
+	for i := 1; i < len(parts); i++ {
+		if f.matches(parts[:i], true) {
+			return true
+		}
+	}
+	return f.matches(parts, isDir)
+}
+
+// ExcludedPath is Excluded for a path under the root.
+func (f *Filter) ExcludedPath(fullPath string, isDir bool) bool {
+	if f == nil {
+		return false
+	}
+	rel, err := filepath.Rel(f.root, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return false
+	}
+	return f.Excluded(rel, isDir)
+}
+
+// Forget drops the cached .gobackupignore of dir (a path under the root), call it when that file changed.
+func (f *Filter) Forget(dir string) {
+	if f == nil {
+		return
+	}
+	rel, err := filepath.Rel(f.root, dir)
+	if err != nil {
+		return
+	}
+	rel = filepath.ToSlash(rel)
+	if rel == "." {
+		rel = ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.dirRules, rel)
+}
+
+// Reset drops every cached .gobackupignore, a full scan starts with it.
+func (f *Filter) Reset() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.dirRules = make(map[string][]pattern)
+}
+
+// matches applies every rule to the path made of parts, the last matching one decides.
+func (f *Filter) matches(parts []string, isDir bool) bool {
+	rel := strings.Join(parts, "/")
+	excluded := false
+	apply := func(rules []pattern) {
+		for _, p := range rules {
+			if p.matches(rel, isDir) {
+				excluded = !p.negate
+			}
+		}
+	}
+
+	apply(f.fileRules)
+	for i := 0; i < len(parts); i++ {
+		apply(f.rulesOf(strings.Join(parts[:i], "/")))
+	}
+	apply(f.cliRules)
+	return excluded
+}
+
+// rulesOf returns the patterns of dir's .gobackupignore, reading it the first time.
+func (f *Filter) rulesOf(dir string) []pattern {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if rules, ok := f.dirRules[dir]; ok {
+		return rules
+	}
+	rules, err := readRules(filepath.Join(f.root, filepath.FromSlash(dir), IgnoreFile), dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to read %s: %v", path.Join(dir, IgnoreFile), err)
+	}
+	f.dirRules[dir] = rules
+	return rules
+}
+
+func readRules(file, base string) ([]pattern, error) {
+	fh, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	var rules []pattern
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		if p, ok := parsePattern(scanner.Text(), base); ok {
+			rules = append(rules, p)
+		}
+	}
+	return rules, scanner.Err()
+}
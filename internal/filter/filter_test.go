@@ -0,0 +1,119 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	root := t.TempDir()
+	excludeFile := filepath.Join(t.TempDir(), "excludes")
+	writeFile(t, excludeFile, "# from the exclude file\n*.log\n!keep.log\n/build/\n")
+	writeFile(t, filepath.Join(root, IgnoreFile), "*.tmp\nvendor/\n")
+	writeFile(t, filepath.Join(root, "sub", IgnoreFile), "!important.tmp\n/local.txt\nkeep.log\n")
+	writeFile(t, filepath.Join(root, "sub", "deep", IgnoreFile), "*.txt\n")
+
+	f, err := New(root, Options{
+		ExcludeFile: excludeFile,
+		Excludes:    []string{"secret*"},
+		Includes:    []string{"secret.pub"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		{"a.txt", false, false},
+		{"a.log", false, true},
+		{"keep.log", false, false},
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"src/build", true, false},
+		// a trailing slash only excludes directories
+		{"vendor", false, false},
+		{"vendor", true, true},
+		{"x/vendor/y.go", false, true},
+		{"a.tmp", false, true},
+		// a deeper .gobackupignore wins, and is anchored where it lives
+		{"sub/important.tmp", false, false},
+		{"important.tmp", false, true},
+		{"sub/local.txt", false, true},
+		{"sub/x/local.txt", false, false},
+		{"local.txt", false, false},
+		{"sub/keep.log", false, true},
+		{"sub/deep/a.txt", false, true},
+		{"sub/a.txt", false, false},
+		// the command line wins over every file
+		{"secret.key", false, true},
+		{"secret.pub", false, false},
+		{"sub/secret.key", false, true},
+		{".", true, false},
+	}
+	for _, tt := range tests {
+		if got := f.Excluded(filepath.FromSlash(tt.rel), tt.isDir); got != tt.want {
+			t.Errorf("Excluded(%q, dir %v) = %v, want %v", tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+
+	// like git, nothing inside an excluded directory can be included again
+	f, err = New(root, Options{Excludes: []string{"logs/"}, Includes: []string{"logs/keep.txt"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Excluded("logs/keep.txt", false) {
+		t.Errorf("file in an excluded directory was included again")
+	}
+
+	if !f.ExcludedPath(filepath.Join(root, "a.tmp"), false) || f.ExcludedPath(filepath.Join(filepath.Dir(root), "a.tmp"), false) {
+		t.Errorf("ExcludedPath must apply the rules under the root only")
+	}
+	var none *Filter
+	if none.Excluded("a.tmp", false) {
+		t.Errorf("a nil Filter excluded a file")
+	}
+}
+
+func TestForget(t *testing.T) {
+	root := t.TempDir()
+	ignore := filepath.Join(root, "sub", IgnoreFile)
+	writeFile(t, ignore, "*.tmp\n")
+	f, err := New(root, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Excluded("sub/a.tmp", false) {
+		t.Fatal("sub/a.tmp is not excluded")
+	}
+
+	writeFile(t, ignore, "*.bak\n")
+	if !f.Excluded("sub/a.tmp", false) {
+		t.Errorf("the .gobackupignore was read again before Forget")
+	}
+	f.Forget(filepath.Join(root, "sub"))
+	if f.Excluded("sub/a.tmp", false) || !f.Excluded("sub/a.bak", false) {
+		t.Errorf("Forget didn't pick up the changed .gobackupignore")
+	}
+
+	if err := os.Remove(ignore); err != nil {
+		t.Fatal(err)
+	}
+	f.Reset()
+	if f.Excluded("sub/a.bak", false) {
+		t.Errorf("Reset didn't drop the removed .gobackupignore")
+	}
+}
@@ -0,0 +1,211 @@
+package filter
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+Besides patterns a file can be skipped for what it is: too large, not modified
+since the cutoff, on another filesystem than the watched directory, inside a
+cache directory (one with a CACHEDIR.TAG, see https://bford.info/cachedir/) or
+of an excluded type.
+
+Sockets, FIFOs and devices are never backed up, there is no content to read (and
+opening a FIFO would block the scan), excluding symlinks is optional.
+
+Files skipped for their age that are already in the backup stay there: they
+haven't changed since they were backed up, they just got old.
+*/
+const (
+	ReasonExcluded    = "excluded"
+	ReasonTooLarge    = "too large"
+	ReasonTooOld      = "too old"
+	ReasonOtherFS     = "on another filesystem"
+	ReasonCacheDir    = "cache directory"
+	ReasonSocket      = "socket"
+	ReasonFIFO        = "fifo"
+	ReasonDevice      = "device"
+	ReasonSymlink     = "symlink"
+	ReasonIrregular   = "irregular file"
+	cacheDirTag       = "CACHEDIR.TAG"
+	cacheDirSignature = "Signature: 8a477f597d28d172789f06886806bc55"
+)
+
+// Check returns why rel (relative to the root) is skipped, "" if it is backed up.
+func (f *Filter) Check(rel string, info os.FileInfo) string {
+	if f == nil {
+		return ""
+	}
+	if f.Excluded(rel, info.IsDir()) {
+		return ReasonExcluded
+	}
+
+	if f.oneFS {
+		if dev, ok := deviceOf(info); ok && dev != f.rootDev {
+			return ReasonOtherFS
+		}
+	}
+
+	if info.IsDir() {
+		if f.excludeCaches && isCacheDir(filepath.Join(f.root, rel)) {
+			return ReasonCacheDir
+		}
+		return ""
+	}
+
+	if reason := typeReason(info.Mode()); reason != "" {
+		if reason == ReasonSymlink && !f.excludeTypes[ReasonSymlink] {
+			return ""
+		}
+		return reason
+	}
+	if f.maxSize > 0 && info.Size() > f.maxSize {
+		return ReasonTooLarge
+	}
+	if cutoff := f.cutoff(); !cutoff.IsZero() && info.ModTime().Before(cutoff) {
+		return ReasonTooOld
+	}
+	return ""
+}
+
+// CheckPath is Check for a path under the root.
+func (f *Filter) CheckPath(fullPath string, info os.FileInfo) string {
+	if f == nil {
+		return ""
+	}
+	rel, err := filepath.Rel(f.root, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	if rel == "." {
+		return ""
+	}
+	return f.Check(rel, info)
+}
+
+func (f *Filter) cutoff() time.Time {
+	if f.maxAge > 0 {
+		return time.Now().Add(-f.maxAge)
+	}
+	return f.notBefore
+}
+
+// typeReason names the file types that are skipped, "" for regular files and directories.
+func typeReason(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular(), mode.IsDir():
+		return ""
+	case mode&os.ModeSymlink != 0:
+		return ReasonSymlink
+	case mode&os.ModeSocket != 0:
+		return ReasonSocket
+	case mode&os.ModeNamedPipe != 0:
+		return ReasonFIFO
+	case mode&os.ModeDevice != 0:
+		return ReasonDevice
+	default:
+		return ReasonIrregular
+	}
+}
+
+func isCacheDir(dir string) bool {
+	fh, err := os.Open(filepath.Join(dir, cacheDirTag))
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+
+	buf := make([]byte, len(cacheDirSignature))
+	if _, err := io.ReadFull(fh, buf); err != nil {
+		return false
+	}
+	return bytes.Equal(buf, []byte(cacheDirSignature))
+}
+
+// Skipped counts skipped files and directories by reason, for the summary after a scan.
+type Skipped map[string]int
+
+func (s Skipped) Add(reason string) {
+	s[reason]++
+}
+
+func (s Skipped) Total() int {
+	total := 0
+	for _, n := range s {
+		total += n
+	}
+	return total
+}
+
+func (s Skipped) String() string {
+	reasons := make([]string, 0, len(s))
+	for reason := range s {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+
+	parts := make([]string, 0, len(reasons))
+	for _, reason := range reasons {
+		parts = append(parts, fmt.Sprintf("%d %s", s[reason], reason))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ParseSize reads sizes like 2G, 500M, 1.5GB or 4096.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	multiplier := int64(1)
+	if n := len(value); n > 0 {
+		switch value[n-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:n-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q (e.g. 2G, 500M, 4096)", s)
+	}
+	return int64(number * float64(multiplier)), nil
+}
+
+// ParseCutoff reads an age (90d, 2w, 36h) or a date (2024-01-31).
+func ParseCutoff(s string) (time.Duration, time.Time, error) {
+	s = strings.TrimSpace(s)
+	if date, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return 0, date, nil
+	}
+
+	units := map[byte]time.Duration{'d': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if n := len(s); n > 1 {
+		if unit, ok := units[s[n-1]]; ok {
+			count, err := strconv.Atoi(s[:n-1])
+			if err == nil && count > 0 {
+				return time.Duration(count) * unit, time.Time{}, nil
+			}
+		}
+	}
+	if age, err := time.ParseDuration(s); err == nil && age > 0 {
+		return age, time.Time{}, nil
+	}
+	return 0, time.Time{}, fmt.Errorf("invalid age %q (e.g. 90d, 2w, 36h or 2024-01-31)", s)
+}
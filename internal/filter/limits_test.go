@@ -0,0 +1,166 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fileInfo is an os.FileInfo for files that would be awkward to create.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string       { return fi.name }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any           { return nil }
+
+func TestCheck(t *testing.T) {
+	now := time.Now()
+	file := func(size int64, age time.Duration) fileInfo {
+		return fileInfo{name: "f", size: size, mode: 0644, modTime: now.Add(-age)}
+	}
+	typed := func(mode os.FileMode) fileInfo {
+		return fileInfo{name: "f", mode: mode | 0644, modTime: now}
+	}
+
+	tests := []struct {
+		name string
+		opts Options
+		rel  string
+		info os.FileInfo
+		want string
+	}{
+		{"no limits", Options{}, "a", file(1<<40, 10*365*24*time.Hour), ""},
+		{"pattern first", Options{Excludes: []string{"a"}, MaxSize: 1}, "a", file(10, 0), ReasonExcluded},
+		{"at max size", Options{MaxSize: 100}, "a", file(100, 0), ""},
+		{"above max size", Options{MaxSize: 100}, "a", file(101, 0), ReasonTooLarge},
+		{"within max age", Options{MaxAge: 48 * time.Hour}, "a", file(1, 24*time.Hour), ""},
+		{"beyond max age", Options{MaxAge: 48 * time.Hour}, "a", file(1, 72*time.Hour), ReasonTooOld},
+		{"after not before", Options{NotBefore: now.Add(-time.Hour)}, "a", file(1, time.Minute), ""},
+		{"before not before", Options{NotBefore: now.Add(-time.Hour)}, "a", file(1, 2*time.Hour), ReasonTooOld},
+		{"large directory", Options{MaxSize: 1, MaxAge: time.Hour}, "d", fileInfo{name: "d", size: 4096, mode: os.ModeDir | 0755}, ""},
+		{"socket", Options{}, "s", typed(os.ModeSocket), ReasonSocket},
+		{"fifo", Options{}, "p", typed(os.ModeNamedPipe), ReasonFIFO},
+		{"device", Options{}, "d", typed(os.ModeDevice), ReasonDevice},
+		{"char device", Options{}, "d", typed(os.ModeDevice | os.ModeCharDevice), ReasonDevice},
+		{"irregular", Options{}, "i", typed(os.ModeIrregular), ReasonIrregular},
+		{"symlink", Options{}, "l", typed(os.ModeSymlink), ""},
+		{"excluded symlink", Options{ExcludeTypes: []string{ReasonSymlink}}, "l", typed(os.ModeSymlink), ReasonSymlink},
+		// a symlink has no size or age of its own to go by
+		{"old large symlink", Options{MaxSize: 1, MaxAge: time.Hour}, "l", fileInfo{name: "l", size: 100, mode: os.ModeSymlink, modTime: now.Add(-48 * time.Hour)}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := New(t.TempDir(), tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Check(tt.rel, tt.info); got != tt.want {
+				t.Errorf("Check(%q) = %q, want %q", tt.rel, got, tt.want)
+			}
+		})
+	}
+
+	if _, err := New(t.TempDir(), Options{ExcludeTypes: []string{"symlink", "pipe"}}); err == nil {
+		t.Errorf("New accepted the unknown file type pipe")
+	}
+}
+
+func TestCacheDir(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "cache", cacheDirTag), cacheDirSignature+"\n# created by a test\n")
+	writeFile(t, filepath.Join(root, "fake", cacheDirTag), "Signature: not the right one")
+	writeFile(t, filepath.Join(root, "short", cacheDirTag), "Signature")
+
+	for _, excludeCaches := range []bool{false, true} {
+		f, err := New(root, Options{ExcludeCaches: excludeCaches})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for dir, tagged := range map[string]bool{"cache": true, "fake": false, "short": false} {
+			info, err := os.Stat(filepath.Join(root, dir))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := ""
+			if tagged && excludeCaches {
+				want = ReasonCacheDir
+			}
+			if got := f.CheckPath(filepath.Join(root, dir), info); got != want {
+				t.Errorf("CheckPath(%s) with ExcludeCaches %v = %q, want %q", dir, excludeCaches, got, want)
+			}
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"4096", 4096, false},
+		{"2K", 2 << 10, false},
+		{"500M", 500 << 20, false},
+		{"500mb", 500 << 20, false},
+		{"2G", 2 << 30, false},
+		{"2GiB", 2 << 30, false},
+		{"1.5G", 3 << 29, false},
+		{"1T", 1 << 40, false},
+		{" 10 ", 10, false},
+		{"", 0, true},
+		{"-1", 0, true},
+		{"lots", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d (error %v)", tt.in, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseCutoff(t *testing.T) {
+	tests := []struct {
+		in   string
+		age  time.Duration
+		date time.Time
+		err  bool
+	}{
+		{in: "90d", age: 90 * 24 * time.Hour},
+		{in: "2w", age: 14 * 24 * time.Hour},
+		{in: "36h", age: 36 * time.Hour},
+		{in: "1h30m", age: 90 * time.Minute},
+		{in: "2024-01-31", date: time.Date(2024, 1, 31, 0, 0, 0, 0, time.Local)},
+		{in: "0d", err: true},
+		{in: "-5h", err: true},
+		{in: "d", err: true},
+		{in: "2024-13-01", err: true},
+		{in: "yesterday", err: true},
+	}
+	for _, tt := range tests {
+		age, date, err := ParseCutoff(tt.in)
+		if (err != nil) != tt.err || age != tt.age || !date.Equal(tt.date) {
+			t.Errorf("ParseCutoff(%q) = %v, %v, %v, want %v, %v (error %v)", tt.in, age, date, err, tt.age, tt.date, tt.err)
+		}
+	}
+}
+
+func TestSkipped(t *testing.T) {
+	skipped := make(Skipped)
+	skipped.Add(ReasonTooLarge)
+	skipped.Add(ReasonExcluded)
+	skipped.Add(ReasonTooLarge)
+	if skipped.Total() != 3 || skipped.String() != "1 excluded, 2 too large" {
+		t.Errorf("Skipped = %d, %q, want 3, \"1 excluded, 2 too large\"", skipped.Total(), skipped.String())
+	}
+}
@@ -0,0 +1,113 @@
+package filter
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+/*
+Patterns follow .gitignore:
+  - blank lines and lines starting with # are ignored (\# for a literal #)
+  - !pattern re-includes what an earlier pattern excluded
+  - a trailing / only matches directories
+  - a pattern with a / anywhere else is relative to the directory it was defined
+    in (the watched directory for --exclude and the exclude file), otherwise it
+    matches a name at any depth
+  - * ? [...] match within a name, ** matches any number of directories
+*/
+type pattern struct {
+	// directory the pattern was defined in, relative to the root, "" for the root
+	base     string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// parsePattern returns false for blank lines and comments.
+func parsePattern(line, base string) (pattern, bool) {
+	line = strings.TrimRight(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " ")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+
+	p := pattern{base: base}
+	switch {
+	case strings.HasPrefix(line, "!"):
+		p.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\!`), strings.HasPrefix(line, `\#`):
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+
+	p.segments = strings.Split(line, "/")
+	if !p.anchored {
+		// "foo" is "**/foo"
+		p.segments = append([]string{"**"}, p.segments...)
+	}
+	return p, true
+}
+
+// matches reports whether rel (slash separated, relative to the root) is matched.
+func (p pattern) matches(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			// ** swallows zero or more directories, a trailing ** needs at least one name
+			if len(rest) == 0 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(rest, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Match reports whether a gitignore-style pattern matches the file rel (relative to the root).
+func Match(line, rel string) bool {
+	p, ok := parsePattern(line, "")
+	if !ok || p.negate {
+		return false
+	}
+	return p.matches(filepath.ToSlash(rel), false)
+}
@@ -0,0 +1,96 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/b/c", false},
+		{"a/*", "a/b", true},
+		{"a/*", "a/b/c", false},
+		{"*.log", "x.log", true},
+		{"*.log", "dir/x.log", false},
+		{"**/x", "x", true},
+		{"**/x", "a/b/x", true},
+		{"a/**/x", "a/x", true},
+		{"a/**/x", "a/b/c/x", true},
+		{"a/**/x", "b/x", false},
+		{"a/**", "a/b", true},
+		{"a/**", "a/b/c", true},
+		{"a/**", "a", false},
+		{"file[0-9]", "file7", true},
+		{"file[0-9]", "filex", false},
+		{"?.txt", "a.txt", true},
+		{"?.txt", "ab.txt", false},
+		// a broken character class matches nothing
+		{"[", "[", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchSegments(strings.Split(tt.pattern, "/"), strings.Split(tt.name, "/")); got != tt.want {
+			t.Errorf("matchSegments(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPattern(t *testing.T) {
+	tests := []struct {
+		line  string
+		base  string
+		rel   string
+		isDir bool
+		want  bool
+	}{
+		// without a slash a name matches at any depth
+		{"*.tmp", "", "a.tmp", false, true},
+		{"*.tmp", "", "x/y/a.tmp", false, true},
+		{"build", "", "src/build", true, true},
+		// a slash anchors it to where it was defined
+		{"/build", "", "build", true, true},
+		{"/build", "", "src/build", true, false},
+		{"doc/*.md", "", "doc/a.md", false, true},
+		{"doc/*.md", "", "x/doc/a.md", false, false},
+		{"doc/*.md", "sub", "sub/doc/a.md", false, true},
+		{"doc/*.md", "sub", "doc/a.md", false, false},
+		{"*.tmp", "sub", "sub/deep/a.tmp", false, true},
+		{"*.tmp", "sub", "other/a.tmp", false, false},
+		// a trailing slash only matches directories
+		{"cache/", "", "cache", true, true},
+		{"cache/", "", "cache", false, false},
+		{"cache/", "", "x/cache", true, true},
+		{"**/logs/*.log", "", "a/b/logs/x.log", false, true},
+		{"**/logs/*.log", "", "logs/x.log", false, true},
+		// escapes and trailing spaces
+		{`\#notes`, "", "#notes", false, true},
+		{`\!important`, "", "!important", false, true},
+		{"a.txt   ", "", "a.txt", false, true},
+		{`a\ `, "", "a ", false, true},
+	}
+
+	for _, tt := range tests {
+		p, ok := parsePattern(tt.line, tt.base)
+		if !ok {
+			t.Errorf("parsePattern(%q) was ignored", tt.line)
+			continue
+		}
+		if got := p.matches(tt.rel, tt.isDir); got != tt.want {
+			t.Errorf("pattern %q (base %q) matches(%q, dir %v) = %v, want %v", tt.line, tt.base, tt.rel, tt.isDir, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{"", "   ", "# comment", "/", "\r"} {
+		if _, ok := parsePattern(line, ""); ok {
+			t.Errorf("parsePattern(%q) is a pattern, want it ignored", line)
+		}
+	}
+	if p, _ := parsePattern("!keep.log", ""); !p.negate || !p.matches("keep.log", false) {
+		t.Errorf("!keep.log = %+v, want a negated pattern matching keep.log", p)
+	}
+}
@@ -0,0 +1,232 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"gobackup/pkg/models"
+	"log"
+	"path"
+)
+
+/*
+Checkpoints:
+metadata.json carries a checksum of its own content, and the previous
+indexGenerations-1 checkpoints are kept as metadata.json.1, metadata.json.2, ...
+If the newest one is damaged, loading falls back to an older generation. The
+journal is only trimmed up to the oldest kept generation, so replaying it on top
+of any generation still gets back to the latest state.
+
+When every generation is gone, the index can be rebuilt from the chunk headers
+with `repair index`.
+*/
+const indexGenerations = 3
+
+var ErrIndexCorrupt = errors.New("no readable copy of the metadata index, run repair index")
+
+type checkpointFile struct {
+	Checksum string          `json:"checksum"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+func generationName(generation int) string {
+	if generation == 0 {
+		return repository.IndexName(metadataFile)
+	}
+	return repository.IndexName(fmt.Sprintf("%s.%d", metadataFile, generation))
+}
+
+func encodeCheckpoint(snapshot *models.BackupMetadata) ([]byte, error) {
+	payload, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(checkpointFile{
+		Checksum: fmt.Sprintf("%x", sha256.Sum256(payload)),
+		Metadata: payload,
+	}, "", "  ")
+}
+
+func decodeCheckpoint(data []byte) (*models.BackupMetadata, error) {
+	var file checkpointFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	meta := &models.BackupMetadata{}
+	if file.Metadata == nil {
+		// written before checkpoints had checksums, nothing to verify
+		if err := json.Unmarshal(data, meta); err != nil {
+			return nil, err
+		}
+		return meta, nil
+	}
+
+	var payload bytes.Buffer
+	if err := json.Compact(&payload, file.Metadata); err != nil {
+		return nil, err
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(payload.Bytes())); sum != file.Checksum {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+
+	if err := json.Unmarshal(payload.Bytes(), meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// loadCheckpoint picks the newest readable generation, m.mu must be held.
+func (m *Manager) loadCheckpoint() error {
+	found := false
+	var loaded *models.BackupMetadata
+	m.generationSeqs = nil
+
+	for generation := 0; generation < indexGenerations; generation++ {
+		path := generationName(generation)
+		data, err := storage.LoadBytes(m.backend, path)
+		if storage.IsNotExist(err) {
+			continue
+		}
+		found = true
+		if err != nil {
+			log.Printf("Warning: cannot read index %s: %v", path, err)
+			continue
+		}
+
+		meta, err := decodeCheckpoint(data)
+		if err != nil {
+			log.Printf("Warning: index %s is damaged: %v", path, err)
+			continue
+		}
+
+		if loaded == nil {
+			loaded = meta
+			if generation > 0 {
+				log.Printf("Warning: using index generation %d, newer copies are damaged", generation)
+			}
+		}
+		m.generationSeqs = append(m.generationSeqs, meta.JournalSeq)
+	}
+
+	if loaded == nil {
+		if found {
+			return ErrIndexCorrupt
+		}
+		// a new repository, unless the index was lost: starting from an empty
+		// one would treat every chunk as an orphan and reuse its number
+		if written, err := m.hasBackupData(); err != nil {
+			return err
+		} else if written {
+			return fmt.Errorf("%s holds chunks but the index is gone: %w", repository.DataDir, ErrIndexCorrupt)
+		}
+		return nil
+	}
+
+	if loaded.Files == nil {
+		loaded.Files = make(map[string]models.FileInfo)
+	}
+	m.metadata = loaded
+	m.hasCheckpoint = true
+	return nil
+}
+
+// hasBackupData reports whether data/ has chunks or link records (see backup.LinksPrefix).
+func (m *Manager) hasBackupData() (bool, error) {
+	entries, err := m.backend.List(repository.DataDir)
+	if storage.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		for _, pattern := range []string{"chunk_*.gz", "links_*.gz"} {
+			if matched, _ := path.Match(pattern, entry.Name); matched {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// writeCheckpoint rotates the generations and writes snapshot as the newest one.
+func (m *Manager) writeCheckpoint(snapshot *models.BackupMetadata) error {
+	data, err := encodeCheckpoint(snapshot)
+	if err != nil {
+		return err
+	}
+
+	for generation := indexGenerations - 1; generation > 0; generation-- {
+		older := generationName(generation - 1)
+		if exists, _ := storage.Exists(m.backend, older); !exists {
+			continue
+		}
+		if err := storage.Rename(m.backend, older, generationName(generation)); err != nil {
+			return fmt.Errorf("failed to rotate index generations: %w", err)
+		}
+	}
+
+	return storage.SaveBytes(m.backend, generationName(0), data)
+}
+
+// checkpointWritten tracks generation seqs, m.mu must be held.
+func (m *Manager) checkpointWritten(seq int64) {
+	m.generationSeqs = append([]int64{seq}, m.generationSeqs...)
+	if len(m.generationSeqs) > indexGenerations {
+		m.generationSeqs = m.generationSeqs[:indexGenerations]
+	}
+	m.sinceCheckpoint = 0
+	m.hasCheckpoint = true
+}
+
+// oldestGenerationSeq is how far the journal may be trimmed.
+func (m *Manager) oldestGenerationSeq() int64 {
+	if len(m.generationSeqs) == 0 {
+		return 0
+	}
+	return m.generationSeqs[len(m.generationSeqs)-1]
+}
+
+/*
+ReplaceIndex throws away the current index and journal and starts over from
+meta, used by repair index. The damaged checkpoint stays around as an older
+generation and the journal is kept as journal.log.bak.
+*/
+func (m *Manager) ReplaceIndex(meta *models.BackupMetadata) error {
+	m.compactWg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	journalName := repository.IndexName(journalFile)
+	if exists, _ := storage.Exists(m.backend, journalName); exists {
+		if err := storage.Rename(m.backend, journalName, journalName+".bak"); err != nil {
+			return err
+		}
+	}
+
+	// keep seqs increasing so records of the old journal can never be mistaken for new ones
+	meta.JournalSeq = m.journalSeq
+	if err := m.writeCheckpoint(meta); err != nil {
+		return err
+	}
+
+	m.metadata = meta
+	m.pending = nil
+	m.journalSize = 0
+	m.journalChecked = false
+	// older generations belong to the old journal, never trim based on them
+	m.generationSeqs = nil
+	m.checkpointWritten(meta.JournalSeq)
+	m.rebuildHashIndex()
+	return nil
+}
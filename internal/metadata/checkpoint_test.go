@@ -0,0 +1,70 @@
+package metadata
+
+import (
+	"errors"
+	"testing"
+
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+)
+
+func TestLoadWithoutCheckpoint(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []string
+		wantErr bool
+	}{
+		{name: "new repository"},
+		{name: "unrelated files", data: []string{"README", "chunk_000001.gz.tmp"}},
+		{name: "chunks", data: []string{"chunk_000001.gz"}, wantErr: true},
+		{name: "link records", data: []string{"links_000001_1.gz"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := storage.NewMemory()
+			for _, name := range tt.data {
+				if err := storage.SaveBytes(backend, repository.ChunkName(name), []byte("data")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := NewManager(backend).LoadMetadata()
+			if tt.wantErr && !errors.Is(err, ErrIndexCorrupt) {
+				t.Errorf("LoadMetadata = %v, want ErrIndexCorrupt", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("LoadMetadata = %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckpointGenerations(t *testing.T) {
+	backend := storage.NewMemory()
+	m := NewManager(backend)
+	if err := m.LoadMetadata(); err != nil {
+		t.Fatal(err)
+	}
+	commitFiles(t, m, "a")
+	for generation := 1; generation < indexGenerations; generation++ {
+		m.compactWg.Add(1)
+		m.compacting = true
+		m.compact()
+	}
+	commitFiles(t, m, "b")
+
+	// damaged generations are skipped, the journal replays on top of an older one
+	for generation := 0; generation < indexGenerations; generation++ {
+		reloaded := NewManager(backend)
+		if err := reloaded.LoadMetadata(); err != nil {
+			t.Fatalf("LoadMetadata with %d damaged generations: %v", generation, err)
+		}
+		checkFiles(t, reloaded, "a", "b")
+		if err := storage.SaveBytes(backend, generationName(generation), []byte(`{"checksum": "0", "metadata": {}}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := NewManager(backend).LoadMetadata(); !errors.Is(err, ErrIndexCorrupt) {
+		t.Errorf("LoadMetadata with every generation damaged = %v, want ErrIndexCorrupt", err)
+	}
+}
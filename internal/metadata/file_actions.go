@@ -1,11 +1,17 @@
 package metadata
 
-import "gobackup/pkg/models"
+import (
+	"gobackup/pkg/models"
+	"path/filepath"
+	"strings"
+)
 
 func (m *Manager) UpdateFileInfo(path string, info models.FileInfo) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.metadata.Files[path] = info
+	m.indexFile(path, info)
+	m.pending = append(m.pending, journalEntry{Op: opUpsertFile, Path: path, File: &info})
 }
 
 func (m *Manager) MarkFileDeleted(path string) {
@@ -15,10 +21,91 @@ func (m *Manager) MarkFileDeleted(path string) {
 	if info, exists := m.metadata.Files[path]; exists {
 		info.IsDeleted = true
 		m.metadata.Files[path] = info
+		m.pending = append(m.pending, journalEntry{Op: opDeleteFile, Path: path})
 	}
 }
+
+// MarkDirDeleted marks every file below dir as deleted, for a directory that is gone as a whole.
+func (m *Manager) MarkDirDeleted(dir string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := dir + string(filepath.Separator)
+	marked := 0
+	for path, info := range m.metadata.Files {
+		if !info.IsDeleted && strings.HasPrefix(path, prefix) {
+			info.IsDeleted = true
+			m.metadata.Files[path] = info
+			m.pending = append(m.pending, journalEntry{Op: opDeleteFile, Path: path})
+			marked++
+		}
+	}
+	return marked
+}
+
+// RemoveChunk drops a chunk that no longer exists from the index.
+func (m *Manager) RemoveChunk(id int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeChunk(id)
+	m.pending = append(m.pending, journalEntry{Op: opRemoveChunk, ChunkID: id})
+}
+
+func (m *Manager) removeChunk(id int) {
+	for i, chunk := range m.metadata.Chunks {
+		if chunk.ID == id {
+			m.metadata.Chunks = append(m.metadata.Chunks[:i], m.metadata.Chunks[i+1:]...)
+			if m.chunkHashes[chunk.Hash] == id {
+				delete(m.chunkHashes, chunk.Hash)
+			}
+			return
+		}
+	}
+}
+
 func (m *Manager) AddChunk(chunk models.ChunkInfo) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.metadata.Chunks = append(m.metadata.Chunks, chunk)
+	m.chunkHashes[chunk.Hash] = chunk.ID
+	m.pending = append(m.pending, journalEntry{Op: opAddChunk, Chunk: &chunk})
+}
+
+/*
+RenameFile moves the entry of a renamed file, or the entries below a renamed
+directory, to the new path. The content doesn't change with a rename, so the
+entries keep their chunks and nothing has to be stored again. The old path stays
+in the index as deleted, like after any other delete. Returns how many moved.
+*/
+func (m *Manager) RenameFile(oldPath, newPath string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	prefix := oldPath + string(filepath.Separator)
+	moves := make(map[string]string)
+	for path, info := range m.metadata.Files {
+		if info.IsDeleted {
+			continue
+		}
+		switch {
+		case path == oldPath:
+			moves[path] = newPath
+		case strings.HasPrefix(path, prefix):
+			moves[path] = newPath + path[len(oldPath):]
+		}
+	}
+
+	for from, to := range moves {
+		info := m.metadata.Files[from]
+		info.IsDeleted = true
+		m.metadata.Files[from] = info
+		m.pending = append(m.pending, journalEntry{Op: opDeleteFile, Path: from})
+
+		info.IsDeleted = false
+		info.Path = to
+		m.metadata.Files[to] = info
+		m.indexFile(to, info)
+		m.pending = append(m.pending, journalEntry{Op: opUpsertFile, Path: to, File: &info})
+	}
+	return len(moves)
 }
@@ -0,0 +1,253 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"gobackup/pkg/models"
+	"io"
+	"log"
+	"time"
+)
+
+/*
+Journal:
+Instead of rewriting the whole metadata.json after every change batch, each
+SaveMetadata appends one record with the deltas of that batch to index/journal.log
+and fsyncs it. A record is a single JSON line, so a crash can at most leave a torn
+last line without its newline, which is dropped on the next load. A damaged record
+anywhere else fails the load instead of losing the records after it.
+
+metadata.json is now a checkpoint: it remembers the last journal seq it contains.
+Once compactThreshold bytes were appended since the last checkpoint, the journal
+gets folded into a new checkpoint in the background and records every kept
+checkpoint generation already contains are trimmed off (see checkpoint.go).
+
+Startup = load checkpoint + replay every record with a higher seq.
+*/
+
+const (
+	journalFile      = "journal.log"
+	compactThreshold = 4 * 1024 * 1024
+
+	opUpsertFile  = "upsert_file"
+	opDeleteFile  = "delete_file"
+	opAddChunk    = "add_chunk"
+	opRemoveChunk = "remove_chunk"
+	opSetRoot     = "set_root"
+)
+
+type journalEntry struct {
+	Op      string            `json:"op"`
+	Path    string            `json:"path,omitempty"`
+	File    *models.FileInfo  `json:"file,omitempty"`
+	Chunk   *models.ChunkInfo `json:"chunk,omitempty"`
+	ChunkID int               `json:"chunk_id,omitempty"`
+	Root    *models.Root      `json:"root,omitempty"`
+}
+
+type journalRecord struct {
+	Seq     int64          `json:"seq"`
+	Time    time.Time      `json:"time"`
+	Entries []journalEntry `json:"entries"`
+}
+
+// apply must only be called with m.mu held
+func (m *Manager) apply(entry journalEntry) {
+	switch entry.Op {
+	case opUpsertFile:
+		if entry.File != nil {
+			m.metadata.Files[entry.Path] = *entry.File
+		}
+	case opDeleteFile:
+		if info, exists := m.metadata.Files[entry.Path]; exists {
+			info.IsDeleted = true
+			m.metadata.Files[entry.Path] = info
+		}
+	case opAddChunk:
+		if entry.Chunk != nil {
+			m.metadata.Chunks = append(m.metadata.Chunks, *entry.Chunk)
+		}
+	case opRemoveChunk:
+		m.removeChunk(entry.ChunkID)
+	case opSetRoot:
+		if entry.Root != nil {
+			if m.metadata.Roots == nil {
+				m.metadata.Roots = make(map[string]string)
+			}
+			m.metadata.Roots[entry.Root.Name] = entry.Root.Path
+		}
+	}
+}
+
+// replayJournal applies every record newer than the checkpoint, m.mu must be held.
+func (m *Manager) replayJournal() error {
+	file, err := m.backend.Load(repository.IndexName(journalFile))
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var validSize int64
+	replayed := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Warning: discarding torn journal record (%d bytes)", len(line))
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// only a last line without its newline can be a torn write, anything
+		// else was committed and dropping it would lose what follows as well
+		var record journalRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			return fmt.Errorf("journal record after seq %d is damaged: %w", m.journalSeq, err)
+		}
+		validSize += int64(len(line))
+
+		if record.Seq <= m.journalSeq {
+			// already folded into the checkpoint (compaction was interrupted before
+			// trimming), or written twice by an append retried after a lost connection
+			continue
+		}
+
+		for _, entry := range record.Entries {
+			m.apply(entry)
+		}
+		m.metadata.UpdatedAt = record.Time
+		m.journalSeq = record.Seq
+		replayed++
+	}
+
+	m.journalSize = validSize
+	if replayed > 0 {
+		log.Printf("Replayed %d journal records", replayed)
+	}
+	return nil
+}
+
+// appendJournal writes and fsyncs one record, m.mu must be held.
+func (m *Manager) appendJournal(record journalRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if !m.journalChecked {
+		if err := m.dropTornTail(); err != nil {
+			return err
+		}
+		m.journalChecked = true
+	}
+
+	if err := storage.Append(m.backend, repository.IndexName(journalFile), data); err != nil {
+		// may have left half a record behind, cut it off before the next append
+		m.journalChecked = false
+		return err
+	}
+
+	m.journalSize += int64(len(data))
+	m.sinceCheckpoint += int64(len(data))
+	return nil
+}
+
+// dropTornTail cuts the journal back to the last complete record replay saw.
+func (m *Manager) dropTornTail() error {
+	name := repository.IndexName(journalFile)
+	info, err := m.backend.Stat(name)
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size == m.journalSize {
+		return nil
+	}
+
+	data, err := storage.LoadBytes(m.backend, name)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > m.journalSize {
+		data = data[:m.journalSize]
+	}
+	return storage.SaveBytes(m.backend, name, data)
+}
+
+// compact folds the journal into a new checkpoint, runs in the background.
+func (m *Manager) compact() {
+	defer m.compactWg.Done()
+
+	m.mu.RLock()
+	snapshot := m.copyMetadata()
+	seq := m.journalSeq
+	m.mu.RUnlock()
+
+	snapshot.JournalSeq = seq
+	if err := m.writeCheckpoint(snapshot); err != nil {
+		log.Printf("Warning: journal compaction failed: %v", err)
+		m.mu.Lock()
+		m.compacting = false
+		m.mu.Unlock()
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.compacting = false
+	m.checkpointWritten(seq)
+
+	// records newer than the oldest generation stay, so every generation can still be replayed
+	if err := m.trimJournal(m.oldestGenerationSeq()); err != nil {
+		// harmless, replay skips records the checkpoint already has
+		log.Printf("Warning: failed to trim journal: %v", err)
+		return
+	}
+	log.Printf("Compacted metadata journal into checkpoint at seq %d", seq)
+}
+
+// trimJournal drops records up to seq, keeping whatever got committed during compaction.
+func (m *Manager) trimJournal(seq int64) error {
+	name := repository.IndexName(journalFile)
+
+	data, err := storage.LoadBytes(m.backend, name)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) > m.journalSize {
+		data = data[:m.journalSize]
+	}
+
+	var kept []byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		var record journalRecord
+		if err := json.Unmarshal(bytes.TrimSpace(line), &record); err != nil {
+			continue
+		}
+		if record.Seq > seq {
+			kept = append(kept, line...)
+		}
+	}
+
+	if err := storage.SaveBytes(m.backend, name, kept); err != nil {
+		return err
+	}
+	m.journalSize = int64(len(kept))
+	m.journalChecked = true
+	return nil
+}
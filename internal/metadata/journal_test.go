@@ -0,0 +1,132 @@
+package metadata
+
+import (
+	"bytes"
+	"testing"
+
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"gobackup/pkg/models"
+)
+
+// commitFiles commits one journal record per path.
+func commitFiles(t *testing.T, m *Manager, paths ...string) {
+	t.Helper()
+	for _, path := range paths {
+		m.UpdateFileInfo(path, models.FileInfo{Path: path, Hash: "hash of " + path})
+		if err := m.SaveMetadata(); err != nil {
+			t.Fatalf("SaveMetadata: %v", err)
+		}
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		// changes the journal of records a, b and c
+		damage    func(journal []byte) []byte
+		wantErr   bool
+		wantFiles []string
+	}{
+		{
+			name:      "intact",
+			damage:    func(journal []byte) []byte { return journal },
+			wantFiles: []string{"a", "b", "c"},
+		},
+		{
+			name: "torn last record",
+			damage: func(journal []byte) []byte {
+				return append(journal, `{"seq":4,"time":"2026-01-01T00:00:00Z","entries":[{"op":"upsert_f`...)
+			},
+			wantFiles: []string{"a", "b", "c"},
+		},
+		{
+			name: "last record cut at its newline",
+			damage: func(journal []byte) []byte {
+				return journal[:len(journal)-1]
+			},
+			wantFiles: []string{"a", "b"},
+		},
+		{
+			name: "damaged record in the middle",
+			damage: func(journal []byte) []byte {
+				lines := bytes.SplitAfter(journal, []byte("\n"))
+				lines[1] = []byte("{\"seq\": garbage}\n")
+				return bytes.Join(lines, nil)
+			},
+			wantErr: true,
+		},
+		{
+			name: "damaged last record",
+			damage: func(journal []byte) []byte {
+				lines := bytes.SplitAfter(journal, []byte("\n"))
+				lines[2] = []byte("not json\n")
+				return bytes.Join(lines, nil)
+			},
+			wantErr: true,
+		},
+		{
+			name: "record written twice by a retried append",
+			damage: func(journal []byte) []byte {
+				lines := bytes.SplitAfter(journal, []byte("\n"))
+				return append(journal, lines[2]...)
+			},
+			wantFiles: []string{"a", "b", "c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := storage.NewMemory()
+			commitFiles(t, NewManager(backend), "a", "b", "c")
+
+			name := repository.IndexName(journalFile)
+			journal, err := storage.LoadBytes(backend, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			damaged := tt.damage(journal)
+			if err := storage.SaveBytes(backend, name, damaged); err != nil {
+				t.Fatal(err)
+			}
+
+			m := NewManager(backend)
+			err = m.LoadMetadata()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("LoadMetadata succeeded on a damaged journal")
+				}
+				// nothing is cut off, the records after the damage are still there
+				if after, _ := storage.LoadBytes(backend, name); !bytes.Equal(after, damaged) {
+					t.Errorf("journal changed by a failed load:\n%s", after)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadMetadata: %v", err)
+			}
+			checkFiles(t, m, tt.wantFiles...)
+
+			// the next commit goes after the last complete record, a torn one is cut off
+			commitFiles(t, m, "d")
+			reloaded := NewManager(backend)
+			if err := reloaded.LoadMetadata(); err != nil {
+				t.Fatalf("LoadMetadata after the next commit: %v", err)
+			}
+			checkFiles(t, reloaded, append(tt.wantFiles, "d")...)
+		})
+	}
+}
+
+func checkFiles(t *testing.T, m *Manager, want ...string) {
+	t.Helper()
+	files := m.GetMetadata().Files
+	if len(files) != len(want) {
+		t.Errorf("index has %d files, want %v", len(files), want)
+	}
+	for _, path := range want {
+		if _, ok := files[path]; !ok {
+			t.Errorf("index has no %s", path)
+		}
+	}
+}
@@ -1,24 +1,53 @@
 package metadata
 
 import (
-	"encoding/json"
+	"fmt"
+	"gobackup/internal/filter"
+	"gobackup/internal/storage"
 	"gobackup/internal/utils"
 	"gobackup/pkg/models"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
+const metadataFile = "metadata.json"
+
 type Manager struct {
-	backupPath string
-	metadata   *models.BackupMetadata
-	mu         sync.RWMutex
+	backend  storage.Backend
+	metadata *models.BackupMetadata
+	hasher   utils.Hasher
+	// what the last DetectChanges left out, by reason
+	skipped filter.Skipped
+	// content hash -> path / chunk ID, used for dedup
+	fileHashes  map[string]string
+	chunkHashes map[string]int
+
+	// deltas since the last SaveMetadata, see journal.go
+	pending     []journalEntry
+	journalSeq  int64
+	journalSize int64
+	// journal on the backend is known to end at journalSize
+	journalChecked bool
+	hasCheckpoint  bool
+	compacting     bool
+	compactWg      sync.WaitGroup
+
+	// journal seq of each index generation, newest first, see checkpoint.go
+	generationSeqs  []int64
+	sinceCheckpoint int64
+
+	mu sync.RWMutex
 }
 
-func NewManager(backupPath string) *Manager {
+func NewManager(backend storage.Backend) *Manager {
 	return &Manager{
-		backupPath: backupPath,
+		backend:     backend,
+		hasher:      utils.NewSHA256Hasher(),
+		fileHashes:  make(map[string]string),
+		chunkHashes: make(map[string]int),
 		metadata: &models.BackupMetadata{
 			Version:   "1.0",
 			CreatedAt: time.Now(),
@@ -32,41 +61,146 @@ func (m *Manager) LoadMetadata() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	metadataPath := filepath.Join(m.backupPath, "metadata.json")
-	data, err := os.ReadFile(metadataPath)
-	if os.IsNotExist(err) {
-		return nil
-	}
-	if err != nil {
+	if err := m.loadCheckpoint(); err != nil {
 		return err
 	}
+	m.journalSeq = m.metadata.JournalSeq
+
+	if err := m.replayJournal(); err != nil {
+		return fmt.Errorf("failed to replay journal: %w", err)
+	}
+
+	m.rebuildHashIndex()
+	return nil
+}
 
-	return json.Unmarshal(data, m.metadata)
+// SetHasher switches to keyed hashes for encrypted repositories.
+func (m *Manager) SetHasher(hasher utils.Hasher) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hasher = hasher
 }
 
+// SetRoot records the directory a root is backed up from, and returns the one it was before.
+func (m *Manager) SetRoot(name, path string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	previous, exists := m.metadata.Roots[name]
+	if exists && previous == path {
+		return previous, true
+	}
+	root := models.Root{Name: name, Path: path}
+	m.apply(journalEntry{Op: opSetRoot, Root: &root})
+	m.pending = append(m.pending, journalEntry{Op: opSetRoot, Root: &root})
+	return previous, exists
+}
+
+// Roots returns the named roots and the directories they are backed up from.
+func (m *Manager) Roots() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	roots := make(map[string]string, len(m.metadata.Roots))
+	for name, path := range m.metadata.Roots {
+		roots[name] = path
+	}
+	return roots
+}
+
+// Pending returns what the next SaveMetadata commits: the entries of the files it changes, and the paths it deletes.
+func (m *Manager) Pending() ([]models.FileInfo, []string) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var files []models.FileInfo
+	var deleted []string
+	seen := make(map[string]bool)
+	for _, entry := range m.pending {
+		if entry.Op != opUpsertFile && entry.Op != opDeleteFile || seen[entry.Path] {
+			continue
+		}
+		seen[entry.Path] = true
+		info, exists := m.metadata.Files[entry.Path]
+		switch {
+		case !exists:
+		case info.IsDeleted:
+			deleted = append(deleted, entry.Path)
+		default:
+			info.Path = entry.Path
+			files = append(files, info)
+		}
+	}
+	return files, deleted
+}
+
+func (m *Manager) rebuildHashIndex() {
+	m.fileHashes = make(map[string]string)
+	for path, info := range m.metadata.Files {
+		m.indexFile(path, info)
+	}
+
+	m.chunkHashes = make(map[string]int)
+	for _, chunk := range m.metadata.Chunks {
+		m.chunkHashes[chunk.Hash] = chunk.ID
+	}
+}
+
+// only files with known extents can be reused, legacy entries only have whole-chunk refs
+func (m *Manager) indexFile(path string, info models.FileInfo) {
+	if len(info.Extents) > 0 {
+		m.fileHashes[info.Hash] = path
+	}
+}
+
+// SaveMetadata commits everything changed since the last call as one journal record.
 func (m *Manager) SaveMetadata() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if err := utils.EnsureDirectoryExists(m.backupPath); err != nil {
-		return err
+	if len(m.pending) == 0 && m.hasCheckpoint {
+		return nil
 	}
 
 	m.metadata.UpdatedAt = time.Now()
-	data, err := json.MarshalIndent(m.metadata, "", "  ")
-	if err != nil {
-		return err
+
+	if len(m.pending) > 0 {
+		record := journalRecord{
+			Seq:     m.journalSeq + 1,
+			Time:    m.metadata.UpdatedAt,
+			Entries: m.pending,
+		}
+		if err := m.appendJournal(record); err != nil {
+			return fmt.Errorf("failed to append to journal: %w", err)
+		}
+		m.journalSeq = record.Seq
+		m.pending = nil
 	}
 
-	metadataPath := filepath.Join(m.backupPath, "metadata.json")
-	tempPath := metadataPath + ".tmp"
+	// brand new repository, write the first checkpoint right away so CreatedAt sticks
+	if !m.hasCheckpoint {
+		snapshot := m.copyMetadata()
+		snapshot.JournalSeq = m.journalSeq
+		if err := m.writeCheckpoint(snapshot); err != nil {
+			return err
+		}
+		m.checkpointWritten(snapshot.JournalSeq)
+		return nil
+	}
 
-	if err := os.WriteFile(tempPath, data, 0644); err != nil {
-		return err
+	if m.sinceCheckpoint > compactThreshold && !m.compacting {
+		m.compacting = true
+		m.compactWg.Add(1)
+		go m.compact()
 	}
 
-	// Atomic rename
-	return os.Rename(tempPath, metadataPath)
+	return nil
+}
+
+// Close waits for a running compaction.
+func (m *Manager) Close() error {
+	m.compactWg.Wait()
+	return nil
 }
 
 func (m *Manager) GetFileInfo(path string) (models.FileInfo, bool) {
@@ -76,10 +210,68 @@ func (m *Manager) GetFileInfo(path string) (models.FileInfo, bool) {
 	return info, exists
 }
 
+// FindFileByHash returns a stored file with the same content, if its extents are known.
+func (m *Manager) FindFileByHash(hash string) (models.FileInfo, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	path, exists := m.fileHashes[hash]
+	if !exists {
+		return models.FileInfo{}, false
+	}
+	info, exists := m.metadata.Files[path]
+	if !exists || info.Hash != hash || len(info.Extents) == 0 {
+		return models.FileInfo{}, false
+	}
+	return info, true
+}
+
+func (m *Manager) FindChunkByHash(hash string) (models.ChunkInfo, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	id, exists := m.chunkHashes[hash]
+	if !exists {
+		return models.ChunkInfo{}, false
+	}
+	for _, chunk := range m.metadata.Chunks {
+		if chunk.ID == id {
+			return chunk, true
+		}
+	}
+	return models.ChunkInfo{}, false
+}
+
+func (m *Manager) Chunks() []models.ChunkInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	chunks := make([]models.ChunkInfo, len(m.metadata.Chunks))
+	copy(chunks, m.metadata.Chunks)
+	return chunks
+}
+
+// MaxChunkID is used to continue chunk numbering after a restart.
+func (m *Manager) MaxChunkID() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	maxID := 0
+	for _, chunk := range m.metadata.Chunks {
+		if chunk.ID > maxID {
+			maxID = chunk.ID
+		}
+	}
+	return maxID
+}
+
 func (m *Manager) GetMetadata() *models.BackupMetadata {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
+	return m.copyMetadata()
+}
 
+func (m *Manager) copyMetadata() *models.BackupMetadata {
 	metaCopy := *m.metadata
 	metaCopy.Files = make(map[string]models.FileInfo)
 	for k, v := range m.metadata.Files {
@@ -87,40 +279,113 @@ func (m *Manager) GetMetadata() *models.BackupMetadata {
 	}
 	metaCopy.Chunks = make([]models.ChunkInfo, len(m.metadata.Chunks))
 	copy(metaCopy.Chunks, m.metadata.Chunks)
+	if m.metadata.Roots != nil {
+		metaCopy.Roots = make(map[string]string)
+		for name, path := range m.metadata.Roots {
+			metaCopy.Roots[name] = path
+		}
+	}
 
 	return &metaCopy
 }
 
-func (m *Manager) DetectChanges(watchPath string) ([]models.FileChange, error) {
+// StatFile builds the entry for a file as it is on disk now, info is its os.Lstat.
+func (m *Manager) StatFile(fullPath, relPath string, info os.FileInfo) (models.FileInfo, error) {
+	hash, err := m.hasher.HashFile(fullPath)
+	if err != nil {
+		return models.FileInfo{}, err
+	}
+	return models.FileInfo{
+		Path:    relPath,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		Hash:    hash,
+		Mode:    uint32(info.Mode().Perm()),
+	}, nil
+}
+
+/*
+Classify compares a file as it is on disk (see StatFile) with its index entry,
+for full scans and watcher events alike: CREATE if there is no live entry (never
+backed up, or deleted, excluded or moved away before), MODIFY if content, mtime
+or mode differ, "" if it is unchanged.
+*/
+func (m *Manager) Classify(path string, current models.FileInfo) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.classify(path, current)
+}
+
+// classify must only be called with m.mu held.
+func (m *Manager) classify(path string, current models.FileInfo) string {
+	stored, exists := m.metadata.Files[path]
+	switch {
+	case !exists || stored.IsDeleted:
+		return "CREATE"
+	case stored.Hash != current.Hash || !stored.ModTime.Equal(current.ModTime) || stored.Mode != current.Mode:
+		return "MODIFY"
+	default:
+		return ""
+	}
+}
+
+// Skipped reports what the last DetectChanges left out.
+func (m *Manager) Skipped() filter.Skipped {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.skipped
+}
+
+/*
+DetectChanges scans one backed up directory and compares it with the index.
+Its files are stored under prefix (a root name, "" for the single unnamed root
+of older repositories), and only entries under prefix can be found deleted, the
+other roots sharing the index are scanned on their own.
+*/
+func (m *Manager) DetectChanges(watchPath, prefix string, rules *filter.Filter) ([]models.FileChange, error) {
 	var changes []models.FileChange
 
 	currentFiles := make(map[string]models.FileInfo)
+	skipped := make(filter.Skipped)
+	// files skipped only for their age, they keep their entries
+	tooOld := make(map[string]bool)
+
+	// pick up .gobackupignore changes
+	rules.Reset()
 
 	err := filepath.Walk(watchPath, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
 
-		if info.IsDir() {
-			return nil
-		}
-
 		relPath, err := filepath.Rel(watchPath, path)
 		if err != nil {
 			return nil
 		}
 
-		hash, err := utils.CalculateFileHash(path)
-		if err != nil {
+		if relPath == "." {
+			return nil
+		}
+		if reason := rules.Check(relPath, info); reason != "" {
+			skipped.Add(reason)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			if reason == filter.ReasonTooOld {
+				tooOld[filepath.Join(prefix, relPath)] = true
+			}
+			return nil
+		}
+		if info.IsDir() {
 			return nil
 		}
 
-		currentFiles[relPath] = models.FileInfo{
-			Path:    relPath,
-			Size:    info.Size(),
-			ModTime: info.ModTime(),
-			Hash:    hash,
+		relPath = filepath.Join(prefix, relPath)
+		current, err := m.StatFile(path, relPath, info)
+		if err != nil {
+			return nil
 		}
+		currentFiles[relPath] = current
 
 		return nil
 	})
@@ -129,33 +394,32 @@ func (m *Manager) DetectChanges(watchPath string) ([]models.FileChange, error) {
 		return nil, err
 	}
 
+	m.mu.Lock()
+	m.skipped = skipped
+	m.mu.Unlock()
+
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	// Check for new or modified files
 	for path, currentInfo := range currentFiles {
-		// fmt.Print("these are current files - ", currentInfo)
-		if storedInfo, exists := m.metadata.Files[path]; exists {
-			if !storedInfo.IsDeleted && (storedInfo.Hash != currentInfo.Hash || storedInfo.ModTime != currentInfo.ModTime) {
-				changes = append(changes, models.FileChange{
-					Path:      path,
-					Operation: "MODIFY",
-					FileInfo:  &currentInfo,
-				})
-			}
-		} else {
+		if operation := m.classify(path, currentInfo); operation != "" {
 			changes = append(changes, models.FileChange{
 				Path:      path,
-				Operation: "CREATE",
+				Operation: operation,
 				FileInfo:  &currentInfo,
 			})
 		}
 	}
 
 	// Check for deleted files
+	rootPrefix := prefix + string(filepath.Separator)
 	for path, storedInfo := range m.metadata.Files {
+		if prefix != "" && !strings.HasPrefix(path, rootPrefix) {
+			continue
+		}
 		if !storedInfo.IsDeleted {
-			if _, exists := currentFiles[path]; !exists {
+			if _, exists := currentFiles[path]; !exists && !tooOld[path] {
 				changes = append(changes, models.FileChange{
 					Path:      path,
 					Operation: "DELETE",
@@ -0,0 +1,150 @@
+package metadata
+
+import (
+	"fmt"
+	"gobackup/internal/encryption"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"log"
+	"path"
+	"strings"
+)
+
+/*
+Recovery pass, run at startup before anything new gets written.
+
+Commit order is: chunk (temp file, fsync, rename, dir fsync) -> journal record (fsync).
+So after a crash we can find:
+  - leftover *.tmp files from writes that never got renamed
+  - orphan chunk files that were written but never committed, always numbered
+    above the last committed chunk
+  - and, on filesystems that don't honour fsync, index entries pointing at chunks
+    that never made it to disk
+
+A chunk the index doesn't know with a lower number is not from a crash, the
+index lost it (an older generation, a damaged journal), so it is kept for
+`repair index`.
+*/
+type RecoveryReport struct {
+	TempFiles       []string
+	OrphanChunks    []string
+	UnindexedChunks []string
+	MissingChunks   []int
+	DanglingFiles   []string
+}
+
+func (r *RecoveryReport) Clean() bool {
+	return len(r.TempFiles) == 0 && len(r.OrphanChunks) == 0 && len(r.UnindexedChunks) == 0 &&
+		len(r.MissingChunks) == 0 && len(r.DanglingFiles) == 0
+}
+
+func (r *RecoveryReport) String() string {
+	return fmt.Sprintf("%d leftover temp files, %d orphan chunks, %d chunks missing from the index, %d missing chunks, %d files referencing missing chunks",
+		len(r.TempFiles), len(r.OrphanChunks), len(r.UnindexedChunks), len(r.MissingChunks), len(r.DanglingFiles))
+}
+
+/*
+Recover checks the repository against the loaded index. With repair set (only
+with an exclusive lock held!) it also fixes what it finds: temp files and orphan
+chunks are deleted (unindexed ones never are), missing chunks are dropped from the index and files pointing
+at them are reset so the next scan backs them up again.
+*/
+func (m *Manager) Recover(repair bool) (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+
+	onDisk := make(map[string]bool)
+	for _, dir := range []string{"", repository.DataDir, repository.IndexDir, encryption.KeysDir, repository.LocksDir, repository.ParityDir} {
+		entries, err := m.backend.List(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			switch {
+			case entry.IsDir:
+			case strings.HasSuffix(entry.Name, ".tmp"):
+				report.TempFiles = append(report.TempFiles, path.Join(dir, entry.Name))
+			case dir == repository.DataDir:
+				if matched, _ := path.Match("chunk_*.gz", entry.Name); matched {
+					onDisk[entry.Name] = true
+				}
+			}
+		}
+	}
+
+	meta := m.GetMetadata()
+	if len(meta.Chunks) == 0 && len(onDisk) > 0 {
+		// every chunk would look like an orphan
+		return nil, fmt.Errorf("the index has no chunks but %s holds %d, run repair index", repository.DataDir, len(onDisk))
+	}
+	lastCommitted := m.MaxChunkID()
+
+	known := make(map[string]bool)
+	present := make(map[int]bool)
+	for _, chunk := range meta.Chunks {
+		known[chunk.Filename] = true
+		if onDisk[chunk.Filename] {
+			present[chunk.ID] = true
+		} else {
+			report.MissingChunks = append(report.MissingChunks, chunk.ID)
+		}
+	}
+
+	for filename := range onDisk {
+		if known[filename] {
+			continue
+		}
+		var id int
+		if _, err := fmt.Sscanf(filename, "chunk_%06d.gz", &id); err != nil || id <= lastCommitted {
+			report.UnindexedChunks = append(report.UnindexedChunks, repository.ChunkName(filename))
+			continue
+		}
+		report.OrphanChunks = append(report.OrphanChunks, repository.ChunkName(filename))
+	}
+
+	for path, info := range meta.Files {
+		if info.IsDeleted {
+			continue
+		}
+		for _, chunkID := range info.ChunkRefs {
+			if !present[chunkID] {
+				report.DanglingFiles = append(report.DanglingFiles, path)
+				break
+			}
+		}
+	}
+
+	if !repair || report.Clean() {
+		return report, nil
+	}
+
+	for _, temp := range report.TempFiles {
+		if err := storage.RemoveIfExists(m.backend, temp); err != nil {
+			return report, err
+		}
+	}
+	for _, orphan := range report.OrphanChunks {
+		err := storage.RemoveIfExists(m.backend, orphan)
+		if storage.IsPermission(err) {
+			// append-only server, the chunk stays and its number is skipped
+			log.Printf("Warning: cannot remove orphan chunk %s: %v", orphan, err)
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+	}
+
+	for _, chunkID := range report.MissingChunks {
+		m.RemoveChunk(chunkID)
+	}
+	for _, path := range report.DanglingFiles {
+		info := meta.Files[path]
+		// an empty hash never matches, so the next scan sees it as modified
+		info.Hash = ""
+		info.ChunkRefs = nil
+		info.Extents = nil
+		m.UpdateFileInfo(path, info)
+	}
+
+	return report, m.SaveMetadata()
+}
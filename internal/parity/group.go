@@ -0,0 +1,343 @@
+package parity
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"gobackup/pkg/models"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+/*
+Parity groups:
+Every DataShards consecutive chunk files form a group that gets ParityShards parity
+files in parity/. The shards are the chunk files exactly as stored (compressed and,
+if enabled, encrypted), padded with zeros to the largest one. A group survives
+losing any ParityShards of its files.
+
+	parity/group_000001.json   - manifest: members, sizes, checksums
+	parity/group_000001.p0 ... - parity shards
+
+Chunks only get protected once a full group of them exists, the newest few
+chunks are unprotected until then.
+*/
+type ShardInfo struct {
+	ChunkID  int    `json:"chunk_id,omitempty"`
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+type Group struct {
+	ID           int         `json:"id"`
+	DataShards   int         `json:"data_shards"`
+	ParityShards int         `json:"parity_shards"`
+	ShardSize    int64       `json:"shard_size"`
+	CreatedAt    time.Time   `json:"created_at"`
+	Members      []ShardInfo `json:"members"`
+	Parity       []ShardInfo `json:"parity"`
+}
+
+// GroupStatus is the result of checking one group, Margin is how many more files it can lose.
+type GroupStatus struct {
+	GroupID int
+	// chunk and parity files in the group
+	Files   int
+	Damaged []string
+	Margin  int
+}
+
+func (s GroupStatus) Recoverable() bool {
+	return s.Margin >= 0
+}
+
+type Manager struct {
+	backend      storage.Backend
+	dataShards   int
+	parityShards int
+	groups       []Group
+	grouped      map[int]int
+}
+
+func NewManager(backend storage.Backend, dataShards, parityShards int) *Manager {
+	return &Manager{
+		backend:      backend,
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		grouped:      make(map[int]int),
+	}
+}
+
+func parityName(filename string) string {
+	return path.Join(repository.ParityDir, filename)
+}
+
+func (m *Manager) shardName(group Group, index int) string {
+	if index < len(group.Members) {
+		return repository.ChunkName(group.Members[index].Filename)
+	}
+	return parityName(group.Parity[index-len(group.Members)].Filename)
+}
+
+func (m *Manager) shardInfo(group Group, index int) ShardInfo {
+	if index < len(group.Members) {
+		return group.Members[index]
+	}
+	return group.Parity[index-len(group.Members)]
+}
+
+func (m *Manager) Load() error {
+	entries, err := m.backend.List(repository.ParityDir)
+	if err != nil {
+		return err
+	}
+
+	var manifests []string
+	for _, entry := range entries {
+		if matched, _ := path.Match("group_*.json", entry.Name); matched && !entry.IsDir {
+			manifests = append(manifests, entry.Name)
+		}
+	}
+	sort.Strings(manifests)
+
+	m.groups = nil
+	m.grouped = make(map[int]int)
+	for _, manifest := range manifests {
+		data, err := storage.LoadBytes(m.backend, parityName(manifest))
+		if err != nil {
+			return err
+		}
+
+		var group Group
+		if err := json.Unmarshal(data, &group); err != nil {
+			log.Printf("Warning: ignoring unreadable parity manifest %s: %v", manifest, err)
+			continue
+		}
+		m.addGroup(group)
+	}
+	return nil
+}
+
+func (m *Manager) addGroup(group Group) {
+	m.groups = append(m.groups, group)
+	for _, member := range group.Members {
+		m.grouped[member.ChunkID] = group.ID
+	}
+}
+
+func (m *Manager) Groups() []Group {
+	return m.groups
+}
+
+// GroupOf returns the group protecting a chunk.
+func (m *Manager) GroupOf(chunkID int) (int, bool) {
+	id, exists := m.grouped[chunkID]
+	return id, exists
+}
+
+// Protect builds parity for every full group of chunks that isn't protected yet.
+func (m *Manager) Protect(chunks []models.ChunkInfo) (int, error) {
+	var pending []models.ChunkInfo
+	for _, chunk := range chunks {
+		if _, exists := m.grouped[chunk.ID]; !exists {
+			pending = append(pending, chunk)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].ID < pending[j].ID })
+
+	created := 0
+	for len(pending) >= m.dataShards {
+		if err := m.buildGroup(pending[:m.dataShards]); err != nil {
+			return created, err
+		}
+		pending = pending[m.dataShards:]
+		created++
+	}
+	return created, nil
+}
+
+func (m *Manager) buildGroup(chunks []models.ChunkInfo) error {
+	coder, err := NewCoder(m.dataShards, m.parityShards)
+	if err != nil {
+		return err
+	}
+
+	nextID := 1
+	if len(m.groups) > 0 {
+		nextID = m.groups[len(m.groups)-1].ID + 1
+	}
+	group := Group{
+		ID:           nextID,
+		DataShards:   m.dataShards,
+		ParityShards: m.parityShards,
+		CreatedAt:    time.Now(),
+	}
+
+	shards := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		data, err := storage.LoadBytes(m.backend, repository.ChunkName(chunk.Filename))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", chunk.Filename, err)
+		}
+		shards[i] = data
+		group.Members = append(group.Members, ShardInfo{
+			ChunkID:  chunk.ID,
+			Filename: chunk.Filename,
+			Size:     int64(len(data)),
+			Checksum: checksum(data),
+		})
+		if int64(len(data)) > group.ShardSize {
+			group.ShardSize = int64(len(data))
+		}
+	}
+	padShards(shards, group.ShardSize)
+
+	parityShards, err := coder.Encode(shards)
+	if err != nil {
+		return err
+	}
+
+	for i, shard := range parityShards {
+		filename := fmt.Sprintf("group_%06d.p%d", group.ID, i)
+		if err := storage.SaveBytes(m.backend, parityName(filename), shard); err != nil {
+			return fmt.Errorf("failed to write parity file: %w", err)
+		}
+		group.Parity = append(group.Parity, ShardInfo{
+			Filename: filename,
+			Size:     int64(len(shard)),
+			Checksum: checksum(shard),
+		})
+	}
+
+	// manifest last, a group without one is just ignored and rebuilt
+	if err := m.writeManifest(group); err != nil {
+		return err
+	}
+
+	m.addGroup(group)
+	log.Printf("Created parity group %d for chunks %d-%d", group.ID, chunks[0].ID, chunks[len(chunks)-1].ID)
+	return nil
+}
+
+func (m *Manager) writeManifest(group Group) error {
+	data, err := json.MarshalIndent(group, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.SaveBytes(m.backend, parityName(fmt.Sprintf("group_%06d.json", group.ID)), data)
+}
+
+/*
+Check looks at every file of every group. Without deep only existence and size
+are checked, with deep the content is checksummed as well.
+*/
+func (m *Manager) Check(deep bool) []GroupStatus {
+	var statuses []GroupStatus
+	for _, group := range m.groups {
+		statuses = append(statuses, m.checkGroup(group, deep))
+	}
+	return statuses
+}
+
+func (m *Manager) checkGroup(group Group, deep bool) GroupStatus {
+	status := GroupStatus{GroupID: group.ID}
+
+	total := len(group.Members) + len(group.Parity)
+	status.Files = total
+	for i := 0; i < total; i++ {
+		if !m.shardIntact(group, i, deep) {
+			status.Damaged = append(status.Damaged, m.shardInfo(group, i).Filename)
+		}
+	}
+
+	status.Margin = group.ParityShards - len(status.Damaged)
+	return status
+}
+
+func (m *Manager) shardIntact(group Group, index int, deep bool) bool {
+	info := m.shardInfo(group, index)
+	name := m.shardName(group, index)
+
+	if !deep {
+		stat, err := m.backend.Stat(name)
+		return err == nil && stat.Size == info.Size
+	}
+
+	data, err := storage.LoadBytes(m.backend, name)
+	return err == nil && int64(len(data)) == info.Size && checksum(data) == info.Checksum
+}
+
+// Repair rebuilds the damaged files of a group from the intact ones.
+func (m *Manager) Repair(groupID int) ([]string, error) {
+	var group *Group
+	for i := range m.groups {
+		if m.groups[i].ID == groupID {
+			group = &m.groups[i]
+			break
+		}
+	}
+	if group == nil {
+		return nil, fmt.Errorf("parity group %d not found", groupID)
+	}
+
+	coder, err := NewCoder(group.DataShards, group.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(group.Members) + len(group.Parity)
+	shards := make([][]byte, total)
+	var damaged []int
+	for i := 0; i < total; i++ {
+		data, err := storage.LoadBytes(m.backend, m.shardName(*group, i))
+		info := m.shardInfo(*group, i)
+		if err != nil || int64(len(data)) != info.Size || checksum(data) != info.Checksum {
+			damaged = append(damaged, i)
+			continue
+		}
+		shards[i] = data
+	}
+	if len(damaged) == 0 {
+		return nil, nil
+	}
+
+	padShards(shards, group.ShardSize)
+
+	if err := coder.Reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("parity group %d cannot be repaired: %w", group.ID, err)
+	}
+
+	var repaired []string
+	for _, i := range damaged {
+		info := m.shardInfo(*group, i)
+		data := shards[i][:info.Size]
+		if checksum(data) != info.Checksum {
+			return repaired, fmt.Errorf("reconstructed %s does not match its checksum", info.Filename)
+		}
+		if err := storage.SaveBytes(m.backend, m.shardName(*group, i), data); err != nil {
+			return repaired, err
+		}
+		repaired = append(repaired, info.Filename)
+	}
+	return repaired, nil
+}
+
+// padShards zero-pads to the group's shard size, missing (nil) shards stay missing.
+func padShards(shards [][]byte, size int64) {
+	for i, shard := range shards {
+		if shard != nil && int64(len(shard)) < size {
+			padded := make([]byte, size)
+			copy(padded, shard)
+			shards[i] = padded
+		}
+	}
+}
+
+func checksum(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
@@ -0,0 +1,219 @@
+package parity
+
+import "fmt"
+
+/*
+Reed-Solomon erasure coding over GF(2^8).
+
+The encoding matrix is systematic: the first K rows are the identity (data shards
+are stored as they are) and the M parity rows are a Cauchy matrix. Every K x K
+submatrix of that is invertible, so any K of the K+M shards are enough to get all
+data shards back.
+*/
+
+var (
+	gfExp [512]byte
+	gfLog [256]byte
+)
+
+func init() {
+	// generator polynomial x^8 + x^4 + x^3 + x^2 + 1
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+type Coder struct {
+	dataShards   int
+	parityShards int
+	// (K+M) x K
+	matrix [][]byte
+}
+
+func NewCoder(dataShards, parityShards int) (*Coder, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, fmt.Errorf("need at least one data and one parity shard")
+	}
+	if dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("at most 256 shards per group")
+	}
+
+	matrix := make([][]byte, dataShards+parityShards)
+	for i := 0; i < dataShards; i++ {
+		matrix[i] = make([]byte, dataShards)
+		matrix[i][i] = 1
+	}
+	for i := 0; i < parityShards; i++ {
+		row := make([]byte, dataShards)
+		for j := 0; j < dataShards; j++ {
+			// x_i = K+i, y_j = j, all distinct so x_i ^ y_j is never 0
+			row[j] = gfInv(byte(dataShards+i) ^ byte(j))
+		}
+		matrix[dataShards+i] = row
+	}
+
+	return &Coder{dataShards: dataShards, parityShards: parityShards, matrix: matrix}, nil
+}
+
+// Encode computes the parity shards, all data shards must have the same length.
+func (c *Coder) Encode(data [][]byte) ([][]byte, error) {
+	if len(data) != c.dataShards {
+		return nil, fmt.Errorf("expected %d data shards, got %d", c.dataShards, len(data))
+	}
+	size := len(data[0])
+	for _, shard := range data {
+		if len(shard) != size {
+			return nil, fmt.Errorf("data shards differ in size")
+		}
+	}
+
+	parity := make([][]byte, c.parityShards)
+	for i := range parity {
+		parity[i] = make([]byte, size)
+		mulRows(c.matrix[c.dataShards+i], data, parity[i])
+	}
+	return parity, nil
+}
+
+/*
+Reconstruct fills in the nil entries of shards (K data followed by M parity).
+At least K shards have to be present.
+*/
+func (c *Coder) Reconstruct(shards [][]byte) error {
+	if len(shards) != c.dataShards+c.parityShards {
+		return fmt.Errorf("expected %d shards, got %d", c.dataShards+c.parityShards, len(shards))
+	}
+
+	var present []int
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return fmt.Errorf("shards differ in size")
+		}
+		size = len(shard)
+		present = append(present, i)
+	}
+	if len(present) < c.dataShards {
+		return fmt.Errorf("too many shards lost: %d present, %d needed", len(present), c.dataShards)
+	}
+	if len(present) == len(shards) {
+		return nil
+	}
+
+	// the rows of the shards we kept, inverted, map them back to the data shards
+	present = present[:c.dataShards]
+	sub := make([][]byte, c.dataShards)
+	input := make([][]byte, c.dataShards)
+	for i, row := range present {
+		sub[i] = append([]byte(nil), c.matrix[row]...)
+		input[i] = shards[row]
+	}
+
+	decode, err := invert(sub)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < c.dataShards; i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			mulRows(decode[i], input, shards[i])
+		}
+	}
+
+	for i := 0; i < c.parityShards; i++ {
+		if shards[c.dataShards+i] == nil {
+			shards[c.dataShards+i] = make([]byte, size)
+			mulRows(c.matrix[c.dataShards+i], shards[:c.dataShards], shards[c.dataShards+i])
+		}
+	}
+	return nil
+}
+
+// out = sum(coefficients[j] * inputs[j])
+func mulRows(coefficients []byte, inputs [][]byte, out []byte) {
+	for j, coefficient := range coefficients {
+		if coefficient == 0 {
+			continue
+		}
+		in := inputs[j]
+		if coefficient == 1 {
+			for k := range out {
+				out[k] ^= in[k]
+			}
+			continue
+		}
+		logC := int(gfLog[coefficient])
+		for k, b := range in {
+			if b != 0 {
+				out[k] ^= gfExp[logC+int(gfLog[b])]
+			}
+		}
+	}
+}
+
+// invert uses Gauss-Jordan elimination, the input matrix is destroyed.
+func invert(matrix [][]byte) ([][]byte, error) {
+	n := len(matrix)
+	inverse := make([][]byte, n)
+	for i := range inverse {
+		inverse[i] = make([]byte, n)
+		inverse[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if matrix[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		matrix[col], matrix[pivot] = matrix[pivot], matrix[col]
+		inverse[col], inverse[pivot] = inverse[pivot], inverse[col]
+
+		scale := gfInv(matrix[col][col])
+		for k := 0; k < n; k++ {
+			matrix[col][k] = gfMul(matrix[col][k], scale)
+			inverse[col][k] = gfMul(inverse[col][k], scale)
+		}
+
+		for row := 0; row < n; row++ {
+			if row == col || matrix[row][col] == 0 {
+				continue
+			}
+			factor := matrix[row][col]
+			for k := 0; k < n; k++ {
+				matrix[row][k] ^= gfMul(factor, matrix[col][k])
+				inverse[row][k] ^= gfMul(factor, inverse[col][k])
+			}
+		}
+	}
+	return inverse, nil
+}
@@ -0,0 +1,106 @@
+package parity
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestReconstructRoundTrip(t *testing.T) {
+	tests := []struct {
+		name         string
+		dataShards   int
+		parityShards int
+		size         int
+	}{
+		{"one and one", 1, 1, 64},
+		{"default", 4, 2, 1000},
+		{"as many parity as data", 3, 3, 17},
+		{"wide", 10, 4, 256},
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			coder, err := NewCoder(tt.dataShards, tt.parityShards)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data := make([][]byte, tt.dataShards)
+			for i := range data {
+				data[i] = make([]byte, tt.size)
+				rng.Read(data[i])
+			}
+			parity, err := coder.Encode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original := append(append([][]byte(nil), data...), parity...)
+
+			// every way of losing up to M shards
+			for _, lost := range subsets(len(original), tt.parityShards) {
+				shards := make([][]byte, len(original))
+				for i := range original {
+					shards[i] = append([]byte(nil), original[i]...)
+				}
+				for _, i := range lost {
+					shards[i] = nil
+				}
+
+				if err := coder.Reconstruct(shards); err != nil {
+					t.Fatalf("lost %v: %v", lost, err)
+				}
+				for i := range original {
+					if !bytes.Equal(shards[i], original[i]) {
+						t.Fatalf("lost %v: shard %d reconstructed wrong", lost, i)
+					}
+				}
+			}
+
+			shards := make([][]byte, len(original))
+			copy(shards, original)
+			for i := 0; i <= tt.parityShards; i++ {
+				shards[i] = nil
+			}
+			if err := coder.Reconstruct(shards); err == nil {
+				t.Fatalf("lost %d shards with %d parity, expected an error", tt.parityShards+1, tt.parityShards)
+			}
+		})
+	}
+}
+
+func TestNewCoderLimits(t *testing.T) {
+	tests := []struct {
+		dataShards, parityShards int
+		ok                       bool
+	}{
+		{1, 1, true},
+		{200, 56, true},
+		{0, 1, false},
+		{1, 0, false},
+		{200, 57, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewCoder(tt.dataShards, tt.parityShards); (err == nil) != tt.ok {
+			t.Errorf("NewCoder(%d, %d): err = %v, want ok = %v", tt.dataShards, tt.parityShards, err, tt.ok)
+		}
+	}
+}
+
+// subsets lists every subset of 0..n-1 with at most k elements.
+func subsets(n, k int) [][]int {
+	result := [][]int{nil}
+	var grow func(start int, current []int)
+	grow = func(start int, current []int) {
+		if len(current) == k {
+			return
+		}
+		for i := start; i < n; i++ {
+			next := append(append([]int(nil), current...), i)
+			result = append(result, next)
+			grow(i+1, next)
+		}
+	}
+	grow(0, nil)
+	return result
+}
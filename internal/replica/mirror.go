@@ -0,0 +1,357 @@
+package replica
+
+import (
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Mirror keeps one destination in sync with the primary repository.
+
+The queue holds names, not data: syncing a name means making the mirror's file
+the same as the primary's right now (copy it, or remove it if the primary no
+longer has it). So a file changed ten times while the mirror was offline is
+copied once, and nothing has to be kept in memory but the names. A name queued
+again moves to the back, which keeps the primary's write order: a chunk always
+reaches the mirror before the journal record that refers to it.
+
+A failed sync marks the mirror offline and is retried with backoff. When a mirror
+comes back, and at startup, a catch-up compares both repositories and queues
+whatever differs.
+*/
+type Mirror struct {
+	primary storage.Backend
+	dest    storage.Backend
+
+	mu    sync.Mutex
+	queue []string
+	// name -> version, bumped on every enqueue so a change during a sync isn't lost
+	queued   map[string]uint64
+	version  uint64
+	catchUp  bool
+	status   Status
+	failures int
+
+	wake     chan struct{}
+	done     chan struct{}
+	finished chan struct{}
+	stopOnce sync.Once
+}
+
+type Status struct {
+	Location string
+	Online   bool
+	// files waiting to be copied or removed
+	Pending   int
+	LastSync  time.Time
+	LastError error
+	// the destination holds a different repository, nothing is written to it
+	Disabled bool
+}
+
+const maxRetryDelay = 5 * time.Minute
+
+func newMirror(primary, dest storage.Backend) *Mirror {
+	return &Mirror{
+		primary:  primary,
+		dest:     dest,
+		queued:   make(map[string]uint64),
+		catchUp:  true,
+		status:   Status{Location: dest.Location(), Online: true},
+		wake:     make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		finished: make(chan struct{}),
+	}
+}
+
+func (m *Mirror) Status() Status {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := m.status
+	status.Pending = len(m.queue)
+	return status
+}
+
+func (m *Mirror) enqueue(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status.Disabled {
+		return
+	}
+
+	if _, ok := m.queued[name]; ok {
+		for i, queued := range m.queue {
+			if queued == name {
+				m.queue = append(m.queue[:i], m.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	m.version++
+	m.queue = append(m.queue, name)
+	m.queued[name] = m.version
+
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (m *Mirror) run() {
+	defer close(m.finished)
+
+	for {
+		m.mu.Lock()
+		catchUp := m.catchUp
+		var name string
+		var version uint64
+		if len(m.queue) > 0 {
+			name = m.queue[0]
+			version = m.queued[name]
+		}
+		m.mu.Unlock()
+
+		var err error
+		switch {
+		case catchUp:
+			err = m.catchUpSync()
+		case name != "":
+			err = m.sync(name)
+		default:
+			select {
+			case <-m.wake:
+				continue
+			case <-m.done:
+				return
+			}
+		}
+
+		if err == nil {
+			m.succeeded(name, version, catchUp)
+			continue
+		}
+		if m.isDisabled() {
+			return
+		}
+
+		delay := m.failed(err)
+		select {
+		case <-time.After(delay):
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Mirror) succeeded(name string, version uint64, catchUp bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if catchUp {
+		m.catchUp = false
+	} else if m.queued[name] == version {
+		// not queued again while syncing, done with it
+		m.queue = m.queue[1:]
+		delete(m.queued, name)
+	}
+	m.status.LastSync = time.Now()
+	m.failures = 0
+
+	if !m.status.Online {
+		m.status.Online = true
+		m.status.LastError = nil
+		// anything could have happened while it was gone, compare everything once more
+		m.catchUp = true
+		log.Printf("Replica %s is reachable again, catching up", m.status.Location)
+	}
+}
+
+func (m *Mirror) failed(err error) time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.status.Online {
+		log.Printf("Warning: replica %s is unreachable, queueing changes for it: %v", m.status.Location, err)
+	}
+	m.status.Online = false
+	m.status.LastError = err
+	m.failures++
+
+	delay := time.Second << min(m.failures-1, 9)
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func (m *Mirror) isDisabled() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.status.Disabled
+}
+
+func (m *Mirror) disable(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	log.Printf("Error: not replicating to %s: %v", m.status.Location, err)
+	m.status.Disabled = true
+	m.status.Online = false
+	m.status.LastError = err
+	m.queue = nil
+	m.queued = make(map[string]uint64)
+}
+
+// sync makes the mirror's copy of name match the primary.
+func (m *Mirror) sync(name string) error {
+	r, err := m.primary.Load(name)
+	if storage.IsNotExist(err) {
+		err = storage.RemoveIfExists(m.dest, name)
+		if storage.IsPermission(err) {
+			// e.g. an append-only server, it keeps the file and that's fine
+			log.Printf("Warning: replica %s refused to remove %s: %v", m.status.Location, name, err)
+			return nil
+		}
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s from the primary: %w", name, err)
+	}
+	defer r.Close()
+
+	err = m.dest.Save(name, r)
+	if storage.IsPermission(err) {
+		log.Printf("Warning: replica %s refused to store %s: %v", m.status.Location, name, err)
+		return nil
+	}
+	return err
+}
+
+// catchUpSync queues every file that differs between the primary and the mirror.
+func (m *Mirror) catchUpSync() error {
+	primaryCfg, err := repository.LoadConfig(m.primary)
+	if storage.IsNotExist(err) {
+		// not initialized yet, init itself gets queued like any other write
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the primary config: %w", err)
+	}
+	mirrorCfg, err := repository.LoadConfig(m.dest)
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+	if mirrorCfg != nil && mirrorCfg.ID != primaryCfg.ID {
+		m.disable(fmt.Errorf("it holds a different repository (%s, not %s)", mirrorCfg.ID, primaryCfg.ID))
+		return fmt.Errorf("different repository")
+	}
+
+	source, err := listTree(m.primary)
+	if err != nil {
+		return fmt.Errorf("failed to list the primary: %w", err)
+	}
+	existing, err := listTree(m.dest)
+	if err != nil {
+		return err
+	}
+
+	var differ []string
+	for name, size := range source {
+		// index files can change without changing size, they are small enough to always copy
+		if destSize, ok := existing[name]; !ok || destSize != size || strings.HasPrefix(name, repository.IndexDir+"/") {
+			differ = append(differ, name)
+		}
+	}
+	for name := range existing {
+		if _, ok := source[name]; !ok {
+			differ = append(differ, name)
+		}
+	}
+
+	// same order as a backup writes: config and keys, then chunks and parity, the index last
+	sort.Slice(differ, func(i, j int) bool {
+		if pi, pj := syncPriority(differ[i]), syncPriority(differ[j]); pi != pj {
+			return pi < pj
+		}
+		return differ[i] < differ[j]
+	})
+	for _, name := range differ {
+		m.enqueue(name)
+	}
+	if len(differ) > 0 {
+		log.Printf("Replica %s: %d files to catch up", m.status.Location, len(differ))
+	}
+	return nil
+}
+
+func syncPriority(name string) int {
+	switch {
+	case name == repository.ConfigFile:
+		return 0
+	case strings.HasPrefix(name, repository.IndexDir+"/"):
+		return 2
+	default:
+		return 1
+	}
+}
+
+// listTree returns the size of every replicated file in a repository.
+func listTree(backend storage.Backend) (map[string]int64, error) {
+	files := make(map[string]int64)
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := backend.List(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := path.Join(dir, entry.Name)
+			if !replicated(name) {
+				continue
+			}
+			if entry.IsDir {
+				if err := walk(name); err != nil {
+					return err
+				}
+				continue
+			}
+			files[name] = entry.Size
+		}
+		return nil
+	}
+	return files, walk("")
+}
+
+// drain waits until the queue is empty, false if it didn't get there (in time).
+func (m *Mirror) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		m.mu.Lock()
+		idle := m.status.Disabled || (len(m.queue) == 0 && !m.catchUp)
+		offline := !m.status.Online
+		m.mu.Unlock()
+		if idle {
+			return true
+		}
+		// no point waiting for a mirror that is down
+		if offline || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (m *Mirror) stop() {
+	m.stopOnce.Do(func() { close(m.done) })
+	select {
+	case <-m.finished:
+	case <-time.After(10 * time.Second):
+		// stuck in a slow request, the process is about to exit anyway
+	}
+}
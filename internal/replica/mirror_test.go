@@ -0,0 +1,263 @@
+package replica
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+)
+
+func newRepository(t *testing.T) storage.Backend {
+	t.Helper()
+	backend := storage.NewMemory()
+	cfg, err := repository.NewConfig(0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repository.Init(backend, cfg); err != nil {
+		t.Fatal(err)
+	}
+	return backend
+}
+
+func save(t *testing.T, backend storage.Backend, name, content string) {
+	t.Helper()
+	if err := storage.SaveBytes(backend, name, []byte(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// contents is every replicated file of a repository.
+func contents(t *testing.T, backend storage.Backend) map[string]string {
+	t.Helper()
+	sizes, err := listTree(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]string, len(sizes))
+	for name := range sizes {
+		data, err := storage.LoadBytes(backend, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = string(data)
+	}
+	return files
+}
+
+// flaky fails every call while down is set.
+type flaky struct {
+	storage.Backend
+	mu   sync.Mutex
+	down bool
+}
+
+var errDown = errors.New("connection refused")
+
+func (f *flaky) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.down = down
+}
+
+func (f *flaky) err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return errDown
+	}
+	return nil
+}
+
+func (f *flaky) Save(name string, r io.Reader) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+	return f.Backend.Save(name, r)
+}
+
+func (f *flaky) Load(name string) (io.ReadCloser, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	return f.Backend.Load(name)
+}
+
+func (f *flaky) List(dir string) ([]storage.FileInfo, error) {
+	if err := f.err(); err != nil {
+		return nil, err
+	}
+	return f.Backend.List(dir)
+}
+
+func (f *flaky) Remove(name string) error {
+	if err := f.err(); err != nil {
+		return err
+	}
+	return f.Backend.Remove(name)
+}
+
+func TestMirrorQueue(t *testing.T) {
+	m := newMirror(storage.NewMemory(), storage.NewMemory())
+	for _, name := range []string{"data/a", "data/b", "index/journal.log", "data/a"} {
+		m.enqueue(name)
+	}
+	// queued again moves to the back, once
+	if want := []string{"data/b", "index/journal.log", "data/a"}; !reflect.DeepEqual(m.queue, want) {
+		t.Errorf("queue = %v, want %v", m.queue, want)
+	}
+	if pending := m.Status().Pending; pending != 3 {
+		t.Errorf("Pending = %d, want 3", pending)
+	}
+
+	m.succeeded("", 0, true)
+	if m.catchUp {
+		t.Errorf("catch-up still pending after it succeeded")
+	}
+
+	// changed again while it was being synced, it stays queued
+	version := m.queued["data/b"]
+	m.enqueue("data/b")
+	m.succeeded("data/b", version, false)
+	if want := []string{"index/journal.log", "data/a", "data/b"}; !reflect.DeepEqual(m.queue, want) {
+		t.Errorf("queue after a stale sync = %v, want %v", m.queue, want)
+	}
+	m.succeeded("index/journal.log", m.queued["index/journal.log"], false)
+	if want := []string{"data/a", "data/b"}; !reflect.DeepEqual(m.queue, want) {
+		t.Errorf("queue after a sync = %v, want %v", m.queue, want)
+	}
+
+	// failures back off up to maxRetryDelay, coming back starts a catch-up
+	var delays []time.Duration
+	for i := 0; i < 12; i++ {
+		delays = append(delays, m.failed(errDown))
+	}
+	if delays[0] != time.Second || delays[1] != 2*time.Second || delays[11] != maxRetryDelay {
+		t.Errorf("retry delays = %v", delays)
+	}
+	if status := m.Status(); status.Online || status.LastError != errDown {
+		t.Errorf("status after failures = %+v", status)
+	}
+	m.succeeded("data/a", m.queued["data/a"], false)
+	if status := m.Status(); !status.Online || status.LastError != nil || !m.catchUp {
+		t.Errorf("status after coming back = %+v, catch-up %v", status, m.catchUp)
+	}
+}
+
+func TestReplicated(t *testing.T) {
+	primary := newRepository(t)
+	mirror := storage.NewMemory()
+	r := New(primary, []storage.Backend{mirror})
+
+	save(t, r, "data/chunk_000001.gz", "one")
+	save(t, r, "data/chunk_000002.gz", "two")
+	if err := r.Append("index/journal.log", []byte("first\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Append("index/journal.log", []byte("second\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Remove("data/chunk_000002.gz"); err != nil {
+		t.Fatal(err)
+	}
+	save(t, r, "data/chunk_000003.gz.tmp", "temp")
+	if err := r.Rename("data/chunk_000003.gz.tmp", "data/chunk_000003.gz"); err != nil {
+		t.Fatal(err)
+	}
+	save(t, r, "locks/exclusive.json", "only for the primary")
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(t, mirror), contents(t, primary); !reflect.DeepEqual(got, want) {
+		t.Errorf("mirror = %v, want %v", got, want)
+	}
+	if exists, _ := storage.Exists(mirror, "locks/exclusive.json"); exists {
+		t.Errorf("lock file was replicated")
+	}
+}
+
+func TestMirrorCatchUp(t *testing.T) {
+	primary := newRepository(t)
+	save(t, primary, "data/chunk_000001.gz", "one")
+	save(t, primary, "index/metadata.json", "new index")
+
+	// a copy from before: config and a stale index, and a chunk the primary removed since
+	mirror := storage.NewMemory()
+	config, err := storage.LoadBytes(primary, repository.ConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	save(t, mirror, repository.ConfigFile, string(config))
+	save(t, mirror, "index/metadata.json", "old index")
+	save(t, mirror, "data/chunk_000000.gz", "gone")
+
+	r := New(primary, []storage.Backend{mirror})
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := contents(t, mirror), contents(t, primary); !reflect.DeepEqual(got, want) {
+		t.Errorf("mirror after catch-up = %v, want %v", got, want)
+	}
+}
+
+func TestMirrorOfOtherRepository(t *testing.T) {
+	primary := newRepository(t)
+	other := newRepository(t)
+	before := contents(t, other)
+
+	r := New(primary, []storage.Backend{other})
+	save(t, r, "data/chunk_000001.gz", "one")
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.Status()[0]; !status.Disabled {
+		t.Errorf("mirror of another repository = %+v, want it disabled", status)
+	}
+	if got := contents(t, other); !reflect.DeepEqual(got, before) {
+		t.Errorf("another repository was written to: %v, was %v", got, before)
+	}
+}
+
+func TestMirrorOffline(t *testing.T) {
+	primary := newRepository(t)
+	dest := &flaky{Backend: storage.NewMemory(), down: true}
+	r := New(primary, []storage.Backend{dest})
+	defer r.Close()
+
+	save(t, r, "data/chunk_000001.gz", "one")
+	save(t, r, "data/chunk_000001.gz", "one, written again")
+	save(t, r, "index/metadata.json", "index")
+	// a write returns once the primary has it, whatever the mirror does
+	if data, err := storage.LoadBytes(primary, "index/metadata.json"); err != nil || string(data) != "index" {
+		t.Fatalf("primary has %q (%v)", data, err)
+	}
+
+	waitFor(t, "the mirror to go offline", func() bool { return !r.Status()[0].Online })
+
+	dest.setDown(false)
+	// the next retry is a second away
+	waitFor(t, "the mirror to come back", func() bool { return r.Status()[0].Online })
+	if !r.mirrors[0].drain(5 * time.Second) {
+		t.Fatalf("mirror didn't catch up: %+v", r.Status()[0])
+	}
+	if got, want := contents(t, dest.Backend), contents(t, primary); !reflect.DeepEqual(got, want) {
+		t.Errorf("mirror after coming back = %v, want %v", got, want)
+	}
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
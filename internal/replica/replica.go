@@ -0,0 +1,132 @@
+package replica
+
+import (
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+/*
+Replicated is a backend that writes to a primary repository and keeps any
+number of mirrors in sync with it, so one watch session can back up to a local
+disk and an off-site server at the same time.
+
+Everything is read from and written to the primary first, a write returns as
+soon as the primary has it. Every mirror then copies the changed files on its
+own (see Mirror), a slow or unreachable mirror only grows its own queue and
+never holds up the backup engine. A mirror ends up as an exact copy of the
+primary repository (same config, keys, chunks and index) and can be restored
+from like any other repository.
+
+Locks are not replicated, they belong to the processes using one repository.
+*/
+type Replicated struct {
+	primary storage.Backend
+	mirrors []*Mirror
+}
+
+// how long Close waits for mirrors to catch up, the rest is synced at the next start
+const drainTimeout = 30 * time.Second
+
+func New(primary storage.Backend, mirrors []storage.Backend) *Replicated {
+	r := &Replicated{primary: primary}
+	for _, dest := range mirrors {
+		r.mirrors = append(r.mirrors, newMirror(primary, dest))
+	}
+	for _, mirror := range r.mirrors {
+		go mirror.run()
+	}
+	return r
+}
+
+func (r *Replicated) Location() string {
+	return r.primary.Location()
+}
+
+func (r *Replicated) Save(name string, body io.Reader) error {
+	if err := r.primary.Save(name, body); err != nil {
+		return err
+	}
+	r.changed(name)
+	return nil
+}
+
+func (r *Replicated) Load(name string) (io.ReadCloser, error) {
+	return r.primary.Load(name)
+}
+
+func (r *Replicated) Stat(name string) (storage.FileInfo, error) {
+	return r.primary.Stat(name)
+}
+
+func (r *Replicated) List(dir string) ([]storage.FileInfo, error) {
+	return r.primary.List(dir)
+}
+
+func (r *Replicated) Remove(name string) error {
+	if err := r.primary.Remove(name); err != nil {
+		return err
+	}
+	r.changed(name)
+	return nil
+}
+
+func (r *Replicated) Append(name string, data []byte) error {
+	if err := storage.Append(r.primary, name, data); err != nil {
+		return err
+	}
+	r.changed(name)
+	return nil
+}
+
+func (r *Replicated) Rename(from, to string) error {
+	if err := storage.Rename(r.primary, from, to); err != nil {
+		return err
+	}
+	r.changed(to)
+	r.changed(from)
+	return nil
+}
+
+func (r *Replicated) changed(name string) {
+	if !replicated(name) {
+		return
+	}
+	for _, mirror := range r.mirrors {
+		mirror.enqueue(name)
+	}
+}
+
+// Status reports every mirror, in the order they were given.
+func (r *Replicated) Status() []Status {
+	var statuses []Status
+	for _, mirror := range r.mirrors {
+		statuses = append(statuses, mirror.Status())
+	}
+	return statuses
+}
+
+// Close gives the mirrors a little time to finish their queues, then closes everything.
+func (r *Replicated) Close() error {
+	deadline := time.Now().Add(drainTimeout)
+	for _, mirror := range r.mirrors {
+		if !mirror.drain(time.Until(deadline)) {
+			status := mirror.Status()
+			log.Printf("Warning: %d files not yet replicated to %s, they will be synced at the next start",
+				status.Pending, status.Location)
+		}
+		mirror.stop()
+		if err := mirror.dest.Close(); err != nil {
+			log.Printf("Warning: failed to close %s: %v", mirror.dest.Location(), err)
+		}
+	}
+	return r.primary.Close()
+}
+
+// replicated leaves out what is local to one repository: locks and temp files.
+func replicated(name string) bool {
+	return !strings.HasPrefix(name, repository.LocksDir+"/") && !strings.HasSuffix(name, ".tmp")
+}
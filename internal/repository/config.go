@@ -0,0 +1,195 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gobackup/internal/storage"
+	"path"
+	"time"
+)
+
+/*
+Repository layout (format 2):
+
+	config.json       - this config, written by init / migrate
+	keys/             - key slots (encrypted repositories only)
+	locks/            - lock files of running processes
+	index/            - metadata index
+	data/             - chunk_NNNNNN.gz files
+	parity/           - Reed-Solomon parity groups (optional)
+
+Format 1 is the original flat layout: chunk_NNNNNN.gz and metadata.json in the
+backup directory itself, without a config. It can be upgraded with migrate.
+*/
+const (
+	FormatVersion = 2
+
+	ConfigFile = "config.json"
+	IndexDir   = "index"
+	DataDir    = "data"
+	ParityDir  = "parity"
+
+	CodecGzip = "gzip"
+
+	EncryptionNone      = "none"
+	EncryptionAES256GCM = "aes-256-gcm"
+
+	HashSHA256     = "sha256"
+	HashHMACSHA256 = "hmac-sha256"
+
+	DefaultChunkSize = 5 * 1024 * 1024
+)
+
+var (
+	ErrNotRepository = errors.New("not a backup repository, run init first")
+	ErrLegacyFormat  = errors.New("repository uses format 1, run migrate to upgrade it")
+)
+
+type Config struct {
+	FormatVersion int       `json:"format_version"`
+	ID            string    `json:"id"`
+	CreatedAt     time.Time `json:"created_at"`
+	ChunkSize     int64     `json:"chunk_size"`
+	Codec         string    `json:"codec"`
+	Encryption    string    `json:"encryption"`
+	ContentHash   string    `json:"content_hash"`
+	// parity groups of ParityData chunks + ParityShards parity files, 0 = off
+	ParityData   int `json:"parity_data,omitempty"`
+	ParityShards int `json:"parity_shards,omitempty"`
+}
+
+func (c *Config) Encrypted() bool {
+	return c.Encryption != EncryptionNone
+}
+
+func NewConfig(chunkSize int64, encrypted bool) (*Config, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	cfg := &Config{
+		FormatVersion: FormatVersion,
+		ID:            hex.EncodeToString(id),
+		CreatedAt:     time.Now(),
+		ChunkSize:     chunkSize,
+		Codec:         CodecGzip,
+	}
+	cfg.SetEncrypted(encrypted)
+	return cfg, nil
+}
+
+func (c *Config) ParityEnabled() bool {
+	return c.ParityData > 0 && c.ParityShards > 0
+}
+
+func (c *Config) SetEncrypted(encrypted bool) {
+	if encrypted {
+		c.Encryption = EncryptionAES256GCM
+		c.ContentHash = HashHMACSHA256
+	} else {
+		c.Encryption = EncryptionNone
+		c.ContentHash = HashSHA256
+	}
+}
+
+// Init creates a fresh repository, the location has to be missing or empty.
+func Init(backend storage.Backend, cfg *Config) error {
+	empty, err := IsEmpty(backend)
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("%s is not empty", backend.Location())
+	}
+
+	return SaveConfig(backend, cfg)
+}
+
+// Open loads the config and refuses formats this build doesn't understand.
+func Open(backend storage.Backend) (*Config, error) {
+	cfg, err := LoadConfig(backend)
+	if storage.IsNotExist(err) {
+		if IsLegacy(backend) {
+			return nil, ErrLegacyFormat
+		}
+		return nil, ErrNotRepository
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.check(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func LoadConfig(backend storage.Backend) (*Config, error) {
+	data, err := storage.LoadBytes(backend, ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("invalid repository config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func SaveConfig(backend storage.Backend, cfg *Config) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return storage.SaveBytes(backend, ConfigFile, data)
+}
+
+func (c *Config) check() error {
+	if c.FormatVersion > FormatVersion {
+		return fmt.Errorf("repository format %d is newer than this build supports (%d)", c.FormatVersion, FormatVersion)
+	}
+	if c.FormatVersion < FormatVersion {
+		return fmt.Errorf("repository format %d is outdated, run migrate to upgrade it", c.FormatVersion)
+	}
+	if c.Codec != CodecGzip {
+		return fmt.Errorf("unsupported codec %q", c.Codec)
+	}
+	if c.Encryption != EncryptionNone && c.Encryption != EncryptionAES256GCM {
+		return fmt.Errorf("unsupported encryption %q", c.Encryption)
+	}
+	if c.ChunkSize <= 0 {
+		return fmt.Errorf("invalid chunk size %d", c.ChunkSize)
+	}
+	if c.ParityData < 0 || c.ParityShards < 0 || c.ParityData+c.ParityShards > 256 {
+		return fmt.Errorf("invalid parity settings %d+%d", c.ParityData, c.ParityShards)
+	}
+	return nil
+}
+
+// ChunkName is the backend name of a chunk file.
+func ChunkName(filename string) string {
+	return path.Join(DataDir, filename)
+}
+
+func IndexName(filename string) string {
+	return path.Join(IndexDir, filename)
+}
+
+// IsEmpty reports whether there is nothing at all at the backup location yet.
+func IsEmpty(backend storage.Backend) (bool, error) {
+	entries, err := backend.List("")
+	if err != nil {
+		return false, err
+	}
+	return len(entries) == 0, nil
+}
@@ -0,0 +1,260 @@
+package repository
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gobackup/internal/storage"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	LocksDir = "locks"
+
+	// a live lock is refreshed every lockRefreshInterval, anything not touched
+	// for lockStaleAfter belongs to a process that is gone (or a host we can't check)
+	lockRefreshInterval = 5 * time.Minute
+	lockStaleAfter      = 30 * time.Minute
+)
+
+type LockInfo struct {
+	ID        string    `json:"id"`
+	Exclusive bool      `json:"exclusive"`
+	Host      string    `json:"host"`
+	PID       int       `json:"pid"`
+	Username  string    `json:"username"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// the file in locks/ it was read from, all there is of an unreadable one
+	Name string `json:"-"`
+}
+
+/*
+Lock is one lock file in locks/.
+Backups (and anything else that writes) take an exclusive lock, readers like
+list / restore / verify take a shared one. Any number of shared locks can be held
+at once, an exclusive lock conflicts with everything.
+*/
+type Lock struct {
+	backend  storage.Backend
+	info     LockInfo
+	stopChan chan struct{}
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+}
+
+func LockExclusive(backend storage.Backend) (*Lock, error) {
+	return acquireLock(backend, true)
+}
+
+func LockShared(backend storage.Backend) (*Lock, error) {
+	return acquireLock(backend, false)
+}
+
+func acquireLock(backend storage.Backend, exclusive bool) (*Lock, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	username := ""
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+
+	now := time.Now()
+	lock := &Lock{
+		backend: backend,
+		info: LockInfo{
+			ID:        hex.EncodeToString(id),
+			Exclusive: exclusive,
+			Host:      host,
+			PID:       os.Getpid(),
+			Username:  username,
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		stopChan: make(chan struct{}),
+	}
+
+	// write first, check after: if two processes race, both see each other and back off
+	if err := lock.write(); err != nil {
+		return nil, fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	locks, err := ListLocks(backend)
+	if err != nil {
+		lock.remove()
+		return nil, err
+	}
+
+	for _, other := range locks {
+		if other.ID == lock.info.ID {
+			continue
+		}
+		if !exclusive && !other.Exclusive {
+			continue
+		}
+		if other.IsStale() {
+			log.Printf("Ignoring stale lock %s held by PID %d on %s since %s",
+				other.ID, other.PID, other.Host, other.CreatedAt.Format(time.RFC3339))
+			continue
+		}
+
+		lock.remove()
+		kind := "shared"
+		if other.Exclusive {
+			kind = "exclusive"
+		}
+		return nil, fmt.Errorf("repository is locked (%s lock by %s@%s, PID %d, since %s), run unlock if that process is gone",
+			kind, other.Username, other.Host, other.PID, other.CreatedAt.Format(time.RFC3339))
+	}
+
+	lock.wg.Add(1)
+	go lock.refreshLoop()
+
+	return lock, nil
+}
+
+// IsStale reports whether the process holding the lock is gone.
+func (info LockInfo) IsStale() bool {
+	if time.Since(info.UpdatedAt) > lockStaleAfter {
+		return true
+	}
+
+	host, _ := os.Hostname()
+	if info.Host == host {
+		return !processAlive(info.PID)
+	}
+	return false
+}
+
+func (l *Lock) refreshLoop() {
+	defer l.wg.Done()
+
+	ticker := time.NewTicker(lockRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stopChan:
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			l.info.UpdatedAt = time.Now()
+			err := l.write()
+			l.mu.Unlock()
+			if err != nil {
+				log.Printf("Warning: failed to refresh lock: %v", err)
+			}
+		}
+	}
+}
+
+func (l *Lock) Unlock() error {
+	close(l.stopChan)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.remove()
+}
+
+func lockName(id string) string {
+	return path.Join(LocksDir, id+".json")
+}
+
+func (l *Lock) write() error {
+	data, err := json.MarshalIndent(l.info, "", "  ")
+	if err != nil {
+		return err
+	}
+	return storage.SaveBytes(l.backend, lockName(l.info.ID), data)
+}
+
+func (l *Lock) remove() error {
+	return storage.RemoveIfExists(l.backend, lockName(l.info.ID))
+}
+
+func ListLocks(backend storage.Backend) ([]LockInfo, error) {
+	locks, unreadable, err := listLockFiles(backend)
+	for _, name := range unreadable {
+		log.Printf("Warning: ignoring unreadable lock file %s, unlock --remove-all removes it", name)
+	}
+	return locks, err
+}
+
+// listLockFiles reads every lock file, the names of the ones that aren't valid locks are returned separately.
+func listLockFiles(backend storage.Backend) ([]LockInfo, []string, error) {
+	entries, err := backend.List(LocksDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var locks []LockInfo
+	var unreadable []string
+	for _, entry := range entries {
+		if entry.IsDir || path.Ext(entry.Name) != ".json" {
+			continue
+		}
+
+		data, err := storage.LoadBytes(backend, path.Join(LocksDir, entry.Name))
+		if storage.IsNotExist(err) {
+			// released while we were looking
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		var info LockInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			unreadable = append(unreadable, entry.Name)
+			continue
+		}
+		info.Name = entry.Name
+		locks = append(locks, info)
+	}
+	return locks, unreadable, nil
+}
+
+/*
+RemoveLocks deletes stale locks, or every lock when all is set. Lock files are
+removed by the name they have in locks/, whatever ID they claim inside. With all
+set, unreadable lock files (a crash while writing one) go too, they come back
+with only their Name set.
+*/
+func RemoveLocks(backend storage.Backend, all bool) ([]LockInfo, error) {
+	locks, unreadable, err := listLockFiles(backend)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		for _, name := range unreadable {
+			locks = append(locks, LockInfo{Name: name})
+		}
+	} else if len(unreadable) > 0 {
+		log.Printf("Warning: %d unreadable lock files left alone, unlock --remove-all removes them", len(unreadable))
+	}
+
+	var removed []LockInfo
+	for _, info := range locks {
+		if !all && !info.IsStale() {
+			continue
+		}
+
+		if err := storage.RemoveIfExists(backend, path.Join(LocksDir, info.Name)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, info)
+	}
+	return removed, nil
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+	"time"
+
+	"gobackup/internal/storage"
+)
+
+func writeLockFile(t *testing.T, backend storage.Backend, name string, info LockInfo) {
+	t.Helper()
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.SaveBytes(backend, path.Join(LocksDir, name), data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// staleLock is a lock of a process on another host that stopped refreshing it long ago.
+func staleLock(id string) LockInfo {
+	old := time.Now().Add(-2 * lockStaleAfter)
+	return LockInfo{ID: id, Exclusive: true, Host: "elsewhere", PID: 1, CreatedAt: old, UpdatedAt: old}
+}
+
+func TestLockConflicts(t *testing.T) {
+	backend := storage.NewMemory()
+
+	shared, err := LockShared(backend)
+	if err != nil {
+		t.Fatalf("LockShared: %v", err)
+	}
+	other, err := LockShared(backend)
+	if err != nil {
+		t.Fatalf("second LockShared: %v", err)
+	}
+	if _, err := LockExclusive(backend); err == nil {
+		t.Fatal("LockExclusive succeeded while shared locks are held")
+	}
+	shared.Unlock()
+	other.Unlock()
+
+	exclusive, err := LockExclusive(backend)
+	if err != nil {
+		t.Fatalf("LockExclusive: %v", err)
+	}
+	if _, err := LockShared(backend); err == nil {
+		t.Fatal("LockShared succeeded while an exclusive lock is held")
+	}
+	exclusive.Unlock()
+
+	// a crashed process doesn't keep the repository locked
+	writeLockFile(t, backend, "dead.json", staleLock("dead"))
+	lock, err := LockExclusive(backend)
+	if err != nil {
+		t.Fatalf("LockExclusive with a stale lock: %v", err)
+	}
+	lock.Unlock()
+}
+
+func TestRemoveLocksByFileName(t *testing.T) {
+	backend := storage.NewMemory()
+	if err := storage.SaveBytes(backend, ConfigFile, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	writeLockFile(t, backend, "renamed.json", staleLock("not-the-file-name"))
+	writeLockFile(t, backend, "crafted.json", staleLock("../config"))
+
+	removed, err := RemoveLocks(backend, false)
+	if err != nil {
+		t.Fatalf("RemoveLocks: %v", err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("RemoveLocks removed %d locks, want 2", len(removed))
+	}
+	if entries, _ := backend.List(LocksDir); len(entries) != 0 {
+		t.Errorf("locks/ still has %v", entries)
+	}
+	if exists, _ := storage.Exists(backend, ConfigFile); !exists {
+		t.Error("a lock ID pointing outside locks/ removed the config")
+	}
+}
+
+func TestRemoveUnreadableLocks(t *testing.T) {
+	backend := storage.NewMemory()
+	if err := storage.SaveBytes(backend, path.Join(LocksDir, "torn.json"), []byte(`{"id": "to`)); err != nil {
+		t.Fatal(err)
+	}
+	live, err := LockShared(backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Unlock()
+
+	// nothing says whether it is stale, only --remove-all takes it
+	if removed, err := RemoveLocks(backend, false); err != nil || len(removed) != 0 {
+		t.Fatalf("RemoveLocks = %v, %v, want nothing removed", removed, err)
+	}
+	removed, err := RemoveLocks(backend, true)
+	if err != nil {
+		t.Fatalf("RemoveLocks(all): %v", err)
+	}
+	names := make(map[string]string)
+	for _, info := range removed {
+		names[info.Name] = info.ID
+	}
+	if id, ok := names["torn.json"]; !ok || id != "" || len(names) != 2 {
+		t.Errorf("RemoveLocks(all) removed %v, want torn.json and the live lock", names)
+	}
+	if entries, _ := backend.List(LocksDir); len(entries) != 0 {
+		t.Errorf("locks/ still has %v", entries)
+	}
+}
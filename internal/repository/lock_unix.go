@@ -0,0 +1,14 @@
+//go:build !windows
+
+package repository
+
+import (
+	"errors"
+	"syscall"
+)
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM means it exists but belongs to someone else
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
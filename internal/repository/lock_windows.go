@@ -0,0 +1,8 @@
+//go:build windows
+
+package repository
+
+// no cheap liveness check here, locks on windows only go stale by age
+func processAlive(pid int) bool {
+	return true
+}
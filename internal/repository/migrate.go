@@ -0,0 +1,115 @@
+package repository
+
+import (
+	"fmt"
+	"gobackup/internal/encryption"
+	"gobackup/internal/storage"
+	"log"
+	"path"
+)
+
+const (
+	legacyMetadataFile = "metadata.json"
+	legacyIndexBackup  = "metadata-v1.json.bak"
+)
+
+// IsLegacy detects the format 1 layout (index and chunks directly in the backup
+// directory) or a migration that was interrupted before the config got written.
+func IsLegacy(backend storage.Backend) bool {
+	if exists, _ := storage.Exists(backend, legacyMetadataFile); exists {
+		return true
+	}
+	if exists, _ := storage.Exists(backend, IndexName(legacyIndexBackup)); exists {
+		return true
+	}
+	chunks, _ := legacyChunks(backend)
+	return len(chunks) > 0
+}
+
+func legacyChunks(backend storage.Backend) ([]string, error) {
+	entries, err := backend.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []string
+	for _, entry := range entries {
+		if matched, _ := path.Match("chunk_*.gz", entry.Name); matched && !entry.IsDir {
+			chunks = append(chunks, entry.Name)
+		}
+	}
+	return chunks, nil
+}
+
+/*
+Migrate upgrades a format 1 repository in place:
+ 1. keep a copy of the old index in index/metadata-v1.json.bak
+ 2. move chunk_NNNNNN.gz files into data/
+ 3. move metadata.json into index/
+ 4. write config.json
+
+The config goes last, so an interrupted migration is just run again - every step
+skips what's already done.
+*/
+func Migrate(backend storage.Backend) (*Config, error) {
+	if cfg, err := LoadConfig(backend); err == nil {
+		if cfg.FormatVersion == FormatVersion {
+			return nil, fmt.Errorf("repository is already at format %d", FormatVersion)
+		}
+		return nil, fmt.Errorf("don't know how to migrate from format %d", cfg.FormatVersion)
+	}
+
+	if !IsLegacy(backend) {
+		return nil, ErrNotRepository
+	}
+
+	hasLegacyMetadata, err := storage.Exists(backend, legacyMetadataFile)
+	if err != nil {
+		return nil, err
+	}
+	if hasLegacyMetadata {
+		backupCopy := IndexName(legacyIndexBackup)
+		if exists, _ := storage.Exists(backend, backupCopy); !exists {
+			data, err := storage.LoadBytes(backend, legacyMetadataFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read old index: %w", err)
+			}
+			if err := storage.SaveBytes(backend, backupCopy, data); err != nil {
+				return nil, fmt.Errorf("failed to back up old index: %w", err)
+			}
+			log.Printf("Saved a copy of the old index to %s", backupCopy)
+		}
+	}
+
+	chunks, err := legacyChunks(backend)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		if err := storage.Rename(backend, chunk, ChunkName(chunk)); err != nil {
+			return nil, fmt.Errorf("failed to move %s: %w", chunk, err)
+		}
+	}
+	log.Printf("Moved %d chunk files into %s/", len(chunks), DataDir)
+
+	if hasLegacyMetadata {
+		if err := storage.Rename(backend, legacyMetadataFile, IndexName(legacyMetadataFile)); err != nil {
+			return nil, fmt.Errorf("failed to move index: %w", err)
+		}
+	}
+
+	encrypted, err := encryption.NewKeyStore(backend).HasKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := NewConfig(DefaultChunkSize, encrypted)
+	if err != nil {
+		return nil, err
+	}
+	if err := SaveConfig(backend, cfg); err != nil {
+		return nil, fmt.Errorf("failed to write config: %w", err)
+	}
+
+	return cfg, nil
+}
@@ -3,7 +3,11 @@ package restore
 import (
 	"fmt"
 	"gobackup/internal/backup"
+	"gobackup/internal/encryption"
 	"gobackup/internal/metadata"
+	"gobackup/internal/parity"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
 	"gobackup/internal/utils"
 	"gobackup/pkg/models"
 	"log"
@@ -13,24 +17,52 @@ import (
 )
 
 type Engine struct {
-	backupPath string
+	backend    storage.Backend
 	targetPath string
 	metadata   *metadata.Manager
 	compressor *backup.Compressor
 	chunker    *backup.Chunker
+	key        *encryption.MasterKey
+	parity     *parity.Manager
+	hasher     utils.Hasher
+	// from the repository config, for copies
+	repositoryID string
+	// by ID, built on the first ReadChunk
+	chunkIndex map[int]models.ChunkInfo
+	// names of the roots to restore, all files if empty, see roots.go
+	roots []string
 }
 
-func NewEngine(backupPath, targetPath string) (*Engine, error) {
+func NewEngine(backend storage.Backend, targetPath string) (*Engine, error) {
 	return &Engine{
-		backupPath: backupPath,
+		backend:    backend,
 		targetPath: targetPath,
-		metadata:   metadata.NewManager(backupPath),
+		metadata:   metadata.NewManager(backend),
 		compressor: backup.NewCompressor(),
 		chunker:    backup.NewChunker(),
+		hasher:     utils.NewSHA256Hasher(),
 	}, nil
 }
 
+// SetMasterKey is needed to read chunks of an encrypted repository.
+func (e *Engine) SetMasterKey(key *encryption.MasterKey) {
+	e.key = key
+	if key != nil {
+		e.hasher = utils.NewKeyedHasher(key.IDKey())
+		e.chunker.SetHasher(e.hasher)
+	}
+}
+
 func (e *Engine) InitializeWithoutTarget() error {
+	cfg, err := repository.Open(e.backend)
+	if err != nil {
+		return err
+	}
+	if err := e.loadParity(cfg); err != nil {
+		return err
+	}
+	e.repositoryID = cfg.ID
+
 	if err := e.metadata.LoadMetadata(); err != nil {
 		return fmt.Errorf("failed to load backup metadata: %w", err)
 	}
@@ -39,6 +71,18 @@ func (e *Engine) InitializeWithoutTarget() error {
 }
 
 func (e *Engine) Initialize() error {
+	cfg, err := repository.Open(e.backend)
+	if err != nil {
+		return err
+	}
+	if cfg.Encrypted() && e.key == nil {
+		return fmt.Errorf("repository is encrypted, a passphrase or key file is required")
+	}
+	if err := e.loadParity(cfg); err != nil {
+		return err
+	}
+	e.repositoryID = cfg.ID
+
 	if err := e.metadata.LoadMetadata(); err != nil {
 		return fmt.Errorf("failed to load backup metadata: %w", err)
 	}
@@ -50,18 +94,123 @@ func (e *Engine) Initialize() error {
 	return nil
 }
 
+func (e *Engine) loadParity(cfg *repository.Config) error {
+	if !cfg.ParityEnabled() {
+		return nil
+	}
+
+	e.parity = parity.NewManager(e.backend, cfg.ParityData, cfg.ParityShards)
+	if err := e.parity.Load(); err != nil {
+		return fmt.Errorf("failed to load parity groups: %w", err)
+	}
+	return nil
+}
+
 func (e *Engine) ValidateBackup() error {
 	meta := e.metadata.GetMetadata()
+	missing := 0
 	for _, chunk := range meta.Chunks {
-		chunkPath := filepath.Join(e.backupPath, chunk.Filename)
-		if _, err := os.Stat(chunkPath); os.IsNotExist(err) {
-			return fmt.Errorf("chunk file missing: %s", chunk.Filename)
+		if _, err := e.backend.Stat(repository.ChunkName(chunk.Filename)); storage.IsNotExist(err) {
+			log.Printf("Chunk file missing: %s", chunk.Filename)
+			missing++
 		}
 	}
 
+	if e.parity != nil {
+		e.reportParity(e.parity.Check(false))
+	}
+
+	if missing > 0 {
+		if e.parity != nil {
+			return fmt.Errorf("%d chunk files missing, run a deep verify to repair them from parity", missing)
+		}
+		return fmt.Errorf("%d chunk files missing", missing)
+	}
+
+	report, err := e.metadata.Recover(false)
+	if err != nil {
+		return err
+	}
+	if !report.Clean() {
+		// not fatal for reading, the next backup run cleans this up
+		log.Printf("Warning: repository needs recovery: %s", report)
+	}
+
 	log.Printf("Backup validation completed: %d chunks verified", len(meta.Chunks))
 	return nil
 }
+
+/*
+DeepVerify reads back every chunk and checks its content hash. Damaged or
+missing chunk files that belong to a parity group are rebuilt first, so this
+needs the exclusive lock.
+*/
+func (e *Engine) DeepVerify() error {
+	if e.parity != nil {
+		for _, status := range e.parity.Check(true) {
+			if len(status.Damaged) == 0 {
+				continue
+			}
+
+			repaired, err := e.parity.Repair(status.GroupID)
+			if err != nil {
+				log.Printf("Parity group %d: %v", status.GroupID, err)
+				continue
+			}
+			for _, filename := range repaired {
+				log.Printf("Repaired %s from parity group %d", filename, status.GroupID)
+			}
+		}
+	}
+
+	meta := e.metadata.GetMetadata()
+	chunkMap := make(map[int]models.ChunkInfo)
+	for _, chunk := range meta.Chunks {
+		chunkMap[chunk.ID] = chunk
+	}
+
+	damaged := 0
+	for _, chunk := range meta.Chunks {
+		if _, err := e.readChunk(chunk.ID, chunkMap); err != nil {
+			log.Printf("Chunk %s is damaged: %v", chunk.Filename, err)
+			damaged++
+		}
+	}
+
+	if e.parity != nil {
+		e.reportParity(e.parity.Check(true))
+	}
+
+	if damaged > 0 {
+		return fmt.Errorf("%d of %d chunks are damaged", damaged, len(meta.Chunks))
+	}
+
+	log.Printf("Deep verification completed: %d chunks read back and verified", len(meta.Chunks))
+	return nil
+}
+
+// reportParity logs one line per group with the margin it has left, then the smallest one.
+func (e *Engine) reportParity(statuses []parity.GroupStatus) {
+	minMargin := -1
+	for _, status := range statuses {
+		switch {
+		case !status.Recoverable():
+			log.Printf("Parity group %d: %d files, %d damaged, NOT recoverable", status.GroupID, status.Files, len(status.Damaged))
+		case len(status.Damaged) > 0:
+			log.Printf("Parity group %d: %d files, %d damaged, can lose %d more", status.GroupID, status.Files, len(status.Damaged), status.Margin)
+		default:
+			log.Printf("Parity group %d: %d files, intact, can lose %d", status.GroupID, status.Files, status.Margin)
+		}
+		if minMargin < 0 || status.Margin < minMargin {
+			minMargin = status.Margin
+		}
+	}
+
+	if len(statuses) > 0 {
+		log.Printf("Parity: %d groups, smallest redundancy margin left: %d files", len(statuses), minMargin)
+	}
+}
+
 func (e *Engine) RestoreAll() error {
 	if err := e.ValidateBackup(); err != nil {
 		return err
@@ -82,8 +231,12 @@ func (e *Engine) RestoreAll() error {
 		if fileInfo.IsDeleted {
 			continue
 		}
+		targetRel, ok := e.selected(fileInfo.Path)
+		if !ok {
+			continue
+		}
 
-		if err := e.restoreFile(fileInfo, chunkMap); err != nil {
+		if err := e.restoreFile(fileInfo, targetRel, chunkMap); err != nil {
 			log.Printf("Failed to restore file %s: %v", fileInfo.Path, err)
 			continue
 		}
@@ -93,8 +246,10 @@ func (e *Engine) RestoreAll() error {
 
 	return nil
 }
-func (e *Engine) restoreFile(fileInfo models.FileInfo, chunkMap map[int]models.ChunkInfo) error {
-	targetFilePath := filepath.Join(e.targetPath, fileInfo.Path)
+
+// restoreFile writes a file to targetRel below the target.
+func (e *Engine) restoreFile(fileInfo models.FileInfo, targetRel string, chunkMap map[int]models.ChunkInfo) error {
+	targetFilePath := filepath.Join(e.targetPath, targetRel)
 
 	targetDir := filepath.Dir(targetFilePath)
 	if err := utils.EnsureDirectoryExists(targetDir); err != nil {
@@ -103,35 +258,40 @@ func (e *Engine) restoreFile(fileInfo models.FileInfo, chunkMap map[int]models.C
 
 	var fileData []byte
 
-	for _, chunkID := range fileInfo.ChunkRefs {
-		chunkInfo, exists := chunkMap[chunkID]
-		if !exists {
-			return fmt.Errorf("chunk %d not found", chunkID)
-		}
-
-		chunkPath := filepath.Join(e.backupPath, chunkInfo.Filename)
-		compressedData, err := os.ReadFile(chunkPath)
-		if err != nil {
-			return fmt.Errorf("failed to read chunk file: %w", err)
+	if len(fileInfo.Extents) > 0 {
+		for _, extent := range fileInfo.Extents {
+			chunkData, err := e.readChunk(extent.ChunkID, chunkMap)
+			if err != nil {
+				return err
+			}
+			if extent.Offset+extent.Size > int64(len(chunkData)) {
+				return fmt.Errorf("file data extends beyond chunk %d boundary", extent.ChunkID)
+			}
+			fileData = append(fileData, chunkData[extent.Offset:extent.Offset+extent.Size]...)
 		}
 
-		chunkData, err := e.compressor.Decompress(compressedData)
-		if err != nil {
-			return fmt.Errorf("failed to decompress chunk: %w", err)
+		if hash := e.hasher.HashData(fileData); hash != fileInfo.Hash {
+			return fmt.Errorf("file hash verification failed")
 		}
-
-		// Verify chunk hash
-		if hash := utils.CalculateDataHash(chunkData); hash != chunkInfo.Hash {
-			return fmt.Errorf("chunk %d hash verification failed", chunkID)
+	} else {
+		// legacy entries only know which chunks they are in, not where
+		for _, chunkID := range fileInfo.ChunkRefs {
+			chunkData, err := e.readChunk(chunkID, chunkMap)
+			if err != nil {
+				return err
+			}
+			fileData = append(fileData, chunkData...)
 		}
-
-		// Find file data within chunk (this is simplified - in reality we'd need to store file boundaries within chunks)
-		fileData = append(fileData, chunkData...)
 	}
 
 	if err := os.WriteFile(targetFilePath, fileData, 0644); err != nil {
 		return fmt.Errorf("failed to write restored file: %w", err)
 	}
+	if fileInfo.Mode != 0 {
+		if err := os.Chmod(targetFilePath, os.FileMode(fileInfo.Mode)); err != nil {
+			log.Printf("Warning: failed to restore permissions for %s: %v", fileInfo.Path, err)
+		}
+	}
 
 	if err := os.Chtimes(targetFilePath, fileInfo.ModTime, fileInfo.ModTime); err != nil {
 		log.Printf("Warning: failed to restore timestamp for %s: %v", fileInfo.Path, err)
@@ -140,6 +300,53 @@ func (e *Engine) restoreFile(fileInfo models.FileInfo, chunkMap map[int]models.C
 	return nil
 }
 
+// readChunk loads, decrypts, decompresses and verifies a chunk.
+func (e *Engine) readChunk(chunkID int, chunkMap map[int]models.ChunkInfo) ([]byte, error) {
+	chunkInfo, exists := chunkMap[chunkID]
+	if !exists {
+		return nil, fmt.Errorf("chunk %d not found", chunkID)
+	}
+
+	_, chunkData, err := e.loadChunk(chunkInfo)
+	return chunkData, err
+}
+
+func (e *Engine) loadChunk(chunkInfo models.ChunkInfo) (*backup.ChunkHeader, []byte, error) {
+	compressedData, err := storage.LoadBytes(e.backend, repository.ChunkName(chunkInfo.Filename))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read chunk file: %w", err)
+	}
+
+	header, chunkData, err := e.decodeChunkFile(compressedData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to decode chunk %d: %w", chunkInfo.ID, err)
+	}
+
+	// Verify chunk hash
+	if hash := e.hasher.HashData(chunkData); hash != chunkInfo.Hash {
+		return nil, nil, fmt.Errorf("chunk %d hash verification failed", chunkInfo.ID)
+	}
+
+	return header, chunkData, nil
+}
+
+func (e *Engine) decodeChunkFile(stored []byte) (*backup.ChunkHeader, []byte, error) {
+	var err error
+	if e.key != nil {
+		stored, err = e.key.Decrypt(stored)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	raw, err := e.compressor.Decompress(stored)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return backup.DecodeChunk(raw)
+}
+
 func (e *Engine) ListFiles() error {
 	meta := e.metadata.GetMetadata()
 
@@ -147,6 +354,14 @@ func (e *Engine) ListFiles() error {
 	fmt.Printf("Last updated: %s\n", meta.UpdatedAt.Format(time.RFC3339))
 	fmt.Printf("Total chunks: %d\n\n", len(meta.Chunks))
 
+	if len(meta.Roots) > 0 {
+		fmt.Println("Roots:")
+		for _, name := range rootNames(meta.Roots) {
+			fmt.Printf("  %-12s %s\n", name, meta.Roots[name])
+		}
+		fmt.Println()
+	}
+
 	activeFiles := 0
 	deletedFiles := 0
 
@@ -154,6 +369,9 @@ func (e *Engine) ListFiles() error {
 	fmt.Println("================")
 
 	for path, fileInfo := range meta.Files {
+		if _, ok := e.selected(path); !ok {
+			continue
+		}
 		status := "ACTIVE"
 		if fileInfo.IsDeleted {
 			status = "DELETED"
@@ -0,0 +1,263 @@
+package restore
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"gobackup/internal/utils"
+	"gobackup/pkg/models"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+/*
+Export writes backed up files as an archive straight from the chunks, nothing
+is restored to disk first. Files are written in chunk order so every chunk is
+decrypted and decompressed once, and each piece of a file goes to the archive
+as soon as its chunk is read, so only one chunk is held in memory however large
+the files are.
+
+A file's hash can only be checked once all of it is in the archive, one that
+doesn't match is reported as failed but stays in the archive. A chunk that
+can't be read in the middle of a file breaks the archive, export stops there.
+
+tar and zip both keep the modification time and the permission bits (files
+backed up before modes were recorded get 0644, like restore gives them).
+*/
+const (
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+)
+
+type ExportReport struct {
+	Files  int
+	Bytes  int64
+	Failed int
+}
+
+// archiveWriter is the part of tar and zip export needs.
+type archiveWriter interface {
+	// create starts a member, its content (size bytes) is written to the returned writer
+	create(info models.FileInfo, size int64) (io.Writer, error)
+	Close() error
+}
+
+// Export writes every active file selected accepts to w.
+func (e *Engine) Export(w io.Writer, format string, selected func(path string) bool) (*ExportReport, error) {
+	archive, err := newArchiveWriter(w, format)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := e.metadata.GetMetadata()
+	chunkMap := make(map[int]models.ChunkInfo)
+	for _, chunk := range meta.Chunks {
+		chunkMap[chunk.ID] = chunk
+	}
+
+	var files []models.FileInfo
+	for path, info := range meta.Files {
+		if info.IsDeleted || (selected != nil && !selected(path)) {
+			continue
+		}
+		info.Path = path
+		files = append(files, info)
+	}
+	sort.Slice(files, func(i, j int) bool {
+		a, b := exportPosition(files[i]), exportPosition(files[j])
+		if a != b {
+			return a.ChunkID < b.ChunkID || (a.ChunkID == b.ChunkID && a.Offset < b.Offset)
+		}
+		return files[i].Path < files[j].Path
+	})
+
+	report := &ExportReport{}
+	cache := &chunkCache{engine: e, chunkMap: chunkMap}
+	for _, info := range files {
+		broken, err := e.exportFile(archive, info, cache)
+		if err != nil {
+			if broken {
+				// the archive is broken from here on, no point going on
+				return report, fmt.Errorf("failed to write %s: %w", info.Path, err)
+			}
+			log.Printf("Failed to export %s: %v", info.Path, err)
+			report.Failed++
+			continue
+		}
+		report.Files++
+		report.Bytes += contentSize(info, chunkMap)
+	}
+
+	if err := archive.Close(); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+func exportPosition(info models.FileInfo) models.Extent {
+	if len(info.Extents) > 0 {
+		return info.Extents[0]
+	}
+	if len(info.ChunkRefs) > 0 {
+		return models.Extent{ChunkID: info.ChunkRefs[0]}
+	}
+	return models.Extent{}
+}
+
+// pieces is where a file's content is, legacy entries only know which chunks they are in and take all of each.
+func pieces(info models.FileInfo, chunkMap map[int]models.ChunkInfo) []models.Extent {
+	if len(info.Extents) > 0 {
+		return info.Extents
+	}
+	var extents []models.Extent
+	for _, chunkID := range info.ChunkRefs {
+		extents = append(extents, models.Extent{ChunkID: chunkID, Size: chunkMap[chunkID].Size})
+	}
+	return extents
+}
+
+func contentSize(info models.FileInfo, chunkMap map[int]models.ChunkInfo) int64 {
+	var size int64
+	for _, extent := range pieces(info, chunkMap) {
+		size += extent.Size
+	}
+	return size
+}
+
+/*
+exportFile puts a file back together from its chunks into the archive, the same
+way restoreFile does but a piece at a time. broken reports that the error left
+a member in the archive incomplete.
+*/
+func (e *Engine) exportFile(archive archiveWriter, info models.FileInfo, cache *chunkCache) (bool, error) {
+	extents := pieces(info, cache.chunkMap)
+	hash := e.hasher.New()
+	var member io.Writer
+	for _, extent := range extents {
+		chunkData, err := cache.get(extent.ChunkID)
+		if err != nil {
+			return member != nil, err
+		}
+		if extent.Offset+extent.Size > int64(len(chunkData)) {
+			return member != nil, fmt.Errorf("file data extends beyond chunk %d boundary", extent.ChunkID)
+		}
+
+		if member == nil {
+			w, err := archive.create(info, contentSize(info, cache.chunkMap))
+			if err != nil {
+				return true, err
+			}
+			member = io.MultiWriter(w, hash)
+		}
+		if _, err := member.Write(chunkData[extent.Offset : extent.Offset+extent.Size]); err != nil {
+			return true, err
+		}
+	}
+	if member == nil {
+		if _, err := archive.create(info, 0); err != nil {
+			return true, err
+		}
+	}
+
+	if len(info.Extents) > 0 && utils.Sum(hash) != info.Hash {
+		return false, fmt.Errorf("file hash verification failed, it is in the archive as stored")
+	}
+	return false, nil
+}
+
+// chunkCache keeps the last chunk read, files come in chunk order.
+type chunkCache struct {
+	engine   *Engine
+	chunkMap map[int]models.ChunkInfo
+	id       int
+	data     []byte
+}
+
+func (c *chunkCache) get(chunkID int) ([]byte, error) {
+	if c.data != nil && c.id == chunkID {
+		return c.data, nil
+	}
+	data, err := c.engine.readChunk(chunkID, c.chunkMap)
+	if err != nil {
+		return nil, err
+	}
+	c.id, c.data = chunkID, data
+	return data, nil
+}
+
+func fileMode(info models.FileInfo) int64 {
+	if info.Mode == 0 {
+		return 0644
+	}
+	return int64(info.Mode)
+}
+
+func newArchiveWriter(w io.Writer, format string) (archiveWriter, error) {
+	switch format {
+	case FormatTar:
+		return &tarWriter{tw: tar.NewWriter(w)}, nil
+	case FormatTarGz:
+		gz := gzip.NewWriter(w)
+		return &tarWriter{tw: tar.NewWriter(gz), gz: gz}, nil
+	case FormatZip:
+		return &zipWriter{zw: zip.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unknown export format %q (tar, tar.gz or zip)", format)
+	}
+}
+
+type tarWriter struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (t *tarWriter) create(info models.FileInfo, size int64) (io.Writer, error) {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     info.Path,
+		Size:     size,
+		Mode:     fileMode(info),
+		ModTime:  info.ModTime,
+	}
+	if err := t.tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	return t.tw, nil
+}
+
+func (t *tarWriter) Close() error {
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	if t.gz != nil {
+		return t.gz.Close()
+	}
+	return nil
+}
+
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) create(info models.FileInfo, size int64) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     info.Path,
+		Method:   zip.Deflate,
+		Modified: info.ModTime,
+	}
+	header.SetMode(os.FileMode(fileMode(info)))
+	if info.ModTime.IsZero() {
+		header.Modified = time.Now()
+	}
+
+	return z.zw.CreateHeader(header)
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
@@ -0,0 +1,208 @@
+package restore
+
+import (
+	"fmt"
+	"gobackup/internal/backup"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"gobackup/pkg/models"
+	"log"
+	"path"
+	"sort"
+	"time"
+)
+
+type RebuildReport struct {
+	Chunks     int
+	Links      int
+	Files      int
+	Roots      int
+	Headerless int
+	Unreadable int
+	// entries whose content is in chunks that are gone or unreadable
+	Lost int
+}
+
+// a chunk or link record, in the order they were written
+type record struct {
+	chunkID int
+	link    bool
+	header  *backup.ChunkHeader
+}
+
+/*
+RebuildIndex recreates the metadata index from the chunk headers and the link
+records (see backup/links.go), replayed in the order they were written, so the
+newest version of a path wins and deletions, renames and deduplicated files are
+recovered, and so are the root names. Repositories written before link records existed only have the
+headers: deleted files come back as active and files stored by reference to
+earlier content can't be recovered. Chunks written before headers existed are
+kept in the index (so their IDs aren't reused) but their files can't be
+recovered either.
+*/
+func (e *Engine) RebuildIndex() (*RebuildReport, error) {
+	cfg, err := repository.Open(e.backend)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Encrypted() && e.key == nil {
+		return nil, fmt.Errorf("repository is encrypted, a passphrase or key file is required")
+	}
+
+	entries, err := e.backend.List(repository.DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunkFiles, linkFiles []string
+	for _, entry := range entries {
+		if entry.IsDir {
+			continue
+		}
+		if matched, _ := path.Match("chunk_*.gz", entry.Name); matched {
+			chunkFiles = append(chunkFiles, entry.Name)
+		}
+		if matched, _ := path.Match(backup.LinksPrefix+"*.gz", entry.Name); matched {
+			linkFiles = append(linkFiles, entry.Name)
+		}
+	}
+	sort.Strings(chunkFiles)
+
+	now := time.Now()
+	meta := &models.BackupMetadata{
+		Version:   "1.0",
+		CreatedAt: now,
+		UpdatedAt: now,
+		Files:     make(map[string]models.FileInfo),
+		Chunks:    make([]models.ChunkInfo, 0),
+	}
+	report := &RebuildReport{}
+	var records []record
+
+	for _, filename := range chunkFiles {
+		var chunkID int
+		if _, err := fmt.Sscanf(filename, "chunk_%06d.gz", &chunkID); err != nil {
+			log.Printf("Skipping unexpected file %s", filename)
+			continue
+		}
+
+		stored, err := storage.LoadBytes(e.backend, repository.ChunkName(filename))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+
+		header, data, err := e.decodeChunkFile(stored)
+		if err != nil {
+			log.Printf("Warning: chunk %s is unreadable, skipping it: %v", filename, err)
+			report.Unreadable++
+			continue
+		}
+
+		meta.Chunks = append(meta.Chunks, models.ChunkInfo{
+			ID:             chunkID,
+			Filename:       filename,
+			Size:           int64(len(data)),
+			Hash:           e.hasher.HashData(data),
+			CompressedSize: int64(len(stored)),
+		})
+		report.Chunks++
+
+		if header == nil {
+			report.Headerless++
+			continue
+		}
+		records = append(records, record{chunkID: chunkID, header: header})
+	}
+
+	for _, filename := range linkFiles {
+		stored, err := storage.LoadBytes(e.backend, repository.ChunkName(filename))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filename, err)
+		}
+		header, _, err := e.decodeChunkFile(stored)
+		if err != nil || header == nil {
+			log.Printf("Warning: link record %s is unreadable, skipping it: %v", filename, err)
+			report.Unreadable++
+			continue
+		}
+		records = append(records, record{chunkID: header.ChunkID, link: true, header: header})
+		report.Links++
+	}
+
+	// a link record comes after the chunks up to its ChunkID, link records among themselves by time
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.chunkID != b.chunkID {
+			return a.chunkID < b.chunkID
+		}
+		if a.link != b.link {
+			return b.link
+		}
+		return a.header.CreatedAt.Before(b.header.CreatedAt)
+	})
+
+	for _, rec := range records {
+		for _, file := range rec.header.Files {
+			info := models.FileInfo{
+				Path:    file.Path,
+				Size:    file.Size,
+				ModTime: file.ModTime,
+				Mode:    file.Mode,
+				Hash:    file.Hash,
+				Extents: file.Extents,
+			}
+			if !rec.link {
+				info.Extents = []models.Extent{{ChunkID: rec.chunkID, Offset: file.Offset, Size: file.Size}}
+			}
+			info.ChunkRefs = chunkRefs(info.Extents)
+			meta.Files[file.Path] = info
+		}
+		// roots are only ever added or moved, the newest record knows all of them
+		if len(rec.header.Roots) > 0 {
+			meta.Roots = rec.header.Roots
+		}
+		for _, deleted := range rec.header.Deleted {
+			if info, exists := meta.Files[deleted]; exists {
+				info.IsDeleted = true
+				meta.Files[deleted] = info
+			}
+		}
+	}
+
+	present := make(map[int]bool, len(meta.Chunks))
+	for _, chunk := range meta.Chunks {
+		present[chunk.ID] = true
+	}
+	for filePath, info := range meta.Files {
+		for _, extent := range info.Extents {
+			if !present[extent.ChunkID] {
+				delete(meta.Files, filePath)
+				if !info.IsDeleted {
+					report.Lost++
+				}
+				break
+			}
+		}
+	}
+
+	for _, info := range meta.Files {
+		if !info.IsDeleted {
+			report.Files++
+		}
+	}
+	report.Roots = len(meta.Roots)
+	if err := e.metadata.ReplaceIndex(meta); err != nil {
+		return nil, fmt.Errorf("failed to write rebuilt index: %w", err)
+	}
+	return report, nil
+}
+
+func chunkRefs(extents []models.Extent) []int {
+	var refs []int
+	for _, extent := range extents {
+		if len(refs) == 0 || refs[len(refs)-1] != extent.ChunkID {
+			refs = append(refs, extent.ChunkID)
+		}
+	}
+	return refs
+}
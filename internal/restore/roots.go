@@ -0,0 +1,50 @@
+package restore
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// SelectRoots restores and lists only the files of these roots, a single root is restored straight into the target.
+func (e *Engine) SelectRoots(names []string) error {
+	roots := e.metadata.GetMetadata().Roots
+	for _, name := range names {
+		if _, ok := roots[name]; !ok {
+			if len(roots) == 0 {
+				return fmt.Errorf("no root named %q, this repository has no named roots", name)
+			}
+			return fmt.Errorf("no root named %q, the roots are: %s", name, strings.Join(rootNames(roots), ", "))
+		}
+	}
+	e.roots = names
+	return nil
+}
+
+// selected reports whether a file belongs to the selected roots, and where it goes below the target.
+func (e *Engine) selected(path string) (string, bool) {
+	if len(e.roots) == 0 {
+		return path, true
+	}
+	for _, name := range e.roots {
+		prefix := name + string(filepath.Separator)
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if len(e.roots) == 1 {
+			return path[len(prefix):], true
+		}
+		return path, true
+	}
+	return "", false
+}
+
+func rootNames(roots map[string]string) []string {
+	names := make([]string, 0, len(roots))
+	for name := range roots {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
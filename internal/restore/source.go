@@ -0,0 +1,37 @@
+package restore
+
+import (
+	"fmt"
+	"gobackup/internal/backup"
+	"gobackup/pkg/models"
+)
+
+// The engine is also the source side of a copy, see backup.ChunkSource.
+
+func (e *Engine) RepositoryID() string {
+	return e.repositoryID
+}
+
+func (e *Engine) Metadata() *models.BackupMetadata {
+	return e.metadata.GetMetadata()
+}
+
+// ReadChunk returns a verified chunk with its header (nil for old chunks).
+func (e *Engine) ReadChunk(chunkID int) (*backup.ChunkHeader, []byte, error) {
+	if e.chunkIndex == nil {
+		e.chunkIndex = make(map[int]models.ChunkInfo)
+		for _, chunk := range e.metadata.Chunks() {
+			e.chunkIndex[chunk.ID] = chunk
+		}
+	}
+
+	chunk, exists := e.chunkIndex[chunkID]
+	if !exists {
+		return nil, nil, fmt.Errorf("chunk %d not found", chunkID)
+	}
+	return e.loadChunk(chunk)
+}
+
+func (e *Engine) HashData(data []byte) string {
+	return e.hasher.HashData(data)
+}
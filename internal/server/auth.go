@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+/*
+Credentials are the users allowed to talk to the server, from two files:
+
+  - an htpasswd file with bcrypt hashes (htpasswd -B), for basic auth
+  - a token file with one "user:token" per line, for bearer tokens
+
+Lines starting with # are comments. A nil *Credentials lets everybody in.
+*/
+type Credentials struct {
+	passwords map[string][]byte
+	// sha256 of the token -> user
+	tokens map[[sha256.Size]byte]string
+
+	// bcrypt is slow on purpose, too slow for every request of a backup run,
+	// so the last password that matched is remembered (as a hash)
+	mu       sync.Mutex
+	verified map[string][sha256.Size]byte
+}
+
+func NewCredentials() *Credentials {
+	return &Credentials{
+		passwords: make(map[string][]byte),
+		tokens:    make(map[[sha256.Size]byte]string),
+		verified:  make(map[string][sha256.Size]byte),
+	}
+}
+
+func (c *Credentials) Users() int {
+	users := make(map[string]bool)
+	for user := range c.passwords {
+		users[user] = true
+	}
+	for _, user := range c.tokens {
+		users[user] = true
+	}
+	return len(users)
+}
+
+func (c *Credentials) LoadHTPasswd(path string) error {
+	return readUserFile(path, func(user, hash string) error {
+		if !strings.HasPrefix(hash, "$2") {
+			return fmt.Errorf("password of %s is not a bcrypt hash, create the file with htpasswd -B", user)
+		}
+		c.passwords[user] = []byte(hash)
+		return nil
+	})
+}
+
+func (c *Credentials) LoadTokens(path string) error {
+	return readUserFile(path, func(user, token string) error {
+		if len(token) < 16 {
+			return fmt.Errorf("token of %s is too short, use at least 16 characters", user)
+		}
+		c.tokens[sha256.Sum256([]byte(token))] = user
+		return nil
+	})
+}
+
+func readUserFile(path string, add func(user, secret string) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, secret, found := strings.Cut(line, ":")
+		if !found || user == "" || secret == "" {
+			return fmt.Errorf("%s:%d: expected user:secret", path, lineNo)
+		}
+		if err := add(user, secret); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Authenticate returns the user a request belongs to.
+func (c *Credentials) Authenticate(r *http.Request) (string, bool) {
+	if c == nil {
+		return "anonymous", true
+	}
+
+	if token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); found {
+		user, ok := c.tokens[sha256.Sum256([]byte(token))]
+		return user, ok
+	}
+
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := c.passwords[user]
+	if !ok {
+		return "", false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	c.mu.Lock()
+	known, cached := c.verified[user]
+	c.mu.Unlock()
+	if cached && subtle.ConstantTimeCompare(known[:], sum[:]) == 1 {
+		return user, true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return "", false
+	}
+	c.mu.Lock()
+	c.verified[user] = sum
+	c.mu.Unlock()
+	return user, true
+}
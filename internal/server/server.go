@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"gobackup/internal/repository"
+	"gobackup/internal/storage"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+/*
+Server exports a repository backend over HTTP, it is the other end of
+storage.REST (see there for the protocol). Every request has to be
+authenticated unless the server runs without credentials.
+
+In append-only mode a client can add files but not destroy any: chunks, parity,
+keys and the config can be created and never changed or removed. Locks work as
+usual, and the index (rewritten by every checkpoint) can still be replaced, but
+the previous version of an index file is kept under index/history/ first. So
+even a compromised client can't do more than add garbage, the admin can always
+get back to an older index or rebuild it from the chunks with `repair index`.
+*/
+type Server struct {
+	backend    storage.Backend
+	auth       *Credentials
+	appendOnly bool
+}
+
+// historyDir is where append-only mode keeps overwritten and removed index files.
+var historyDir = path.Join(repository.IndexDir, "history")
+
+func New(backend storage.Backend, auth *Credentials, appendOnly bool) *Server {
+	return &Server{backend: backend, auth: auth, appendOnly: appendOnly}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, ok := s.auth.Authenticate(r)
+	if !ok {
+		log.Printf("Warning: rejected unauthenticated %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="gobackup"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+
+	name, err := requestName(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	op := r.URL.Query().Get("op")
+	switch {
+	case r.Method == http.MethodGet && op == "list":
+		err = s.list(w, name)
+	case r.Method == http.MethodGet && op == "":
+		err = s.load(w, name)
+	case r.Method == http.MethodHead && op == "":
+		err = s.stat(w, name)
+	case r.Method == http.MethodPut && op == "":
+		err = s.save(name, r.Body)
+	case r.Method == http.MethodDelete && op == "":
+		err = s.remove(name)
+	case r.Method == http.MethodPost && op == "append":
+		err = s.append(name, r.Body)
+	case r.Method == http.MethodPost && op == "rename":
+		to, nameErr := requestName(r.URL.Query().Get("to"))
+		if nameErr != nil {
+			http.Error(w, nameErr.Error(), http.StatusBadRequest)
+			return
+		}
+		err = s.rename(name, to)
+	default:
+		http.Error(w, "unsupported request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case storage.IsNotExist(err):
+			status = http.StatusNotFound
+		case storage.IsPermission(err):
+			status = http.StatusForbidden
+			log.Printf("Refused %s %s for %s: %v", r.Method, name, user, err)
+		default:
+			log.Printf("Error: %s %s for %s: %v", r.Method, name, user, err)
+		}
+		http.Error(w, err.Error(), status)
+	}
+}
+
+// requestName turns a request path into a repository name, refusing anything outside the repository.
+func requestName(urlPath string) (string, error) {
+	name := strings.Trim(urlPath, "/")
+	if name == "" {
+		return "", nil
+	}
+	if !fs.ValidPath(name) {
+		return "", fmt.Errorf("invalid name %q", urlPath)
+	}
+	return name, nil
+}
+
+func (s *Server) list(w http.ResponseWriter, dir string) error {
+	files, err := s.backend.List(dir)
+	if err != nil {
+		return err
+	}
+	if dir == repository.IndexDir {
+		// the history is for the admin, clients (and their recovery) shouldn't see it
+		for i, file := range files {
+			if path.Join(dir, file.Name) == historyDir {
+				files = append(files[:i], files[i+1:]...)
+				break
+			}
+		}
+	}
+	if files == nil {
+		files = []storage.FileInfo{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(files)
+}
+
+func (s *Server) load(w http.ResponseWriter, name string) error {
+	info, err := s.backend.Stat(name)
+	if err != nil {
+		return err
+	}
+	r, err := s.backend.Load(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprint(info.Size))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	if _, err := io.Copy(w, r); err != nil {
+		// too late for an error status, the client sees a short body
+		log.Printf("Warning: failed to send %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *Server) stat(w http.ResponseWriter, name string) error {
+	info, err := s.backend.Stat(name)
+	if err != nil {
+		return err
+	}
+	size := info.Size
+	if info.IsDir {
+		w.Header().Set(storage.RESTDirHeader, "1")
+		size = 0
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	return nil
+}
+
+func (s *Server) save(name string, body io.Reader) error {
+	if name == "" {
+		return fmt.Errorf("missing file name")
+	}
+	if !s.appendOnly {
+		return s.backend.Save(name, body)
+	}
+
+	exists, err := storage.Exists(s.backend, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return s.backend.Save(name, body)
+	}
+	if mutable(name) {
+		if err := s.keepHistory(name); err != nil {
+			return err
+		}
+		return s.backend.Save(name, body)
+	}
+
+	// a client retrying an upload whose response got lost sends the same content again
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	existing, err := storage.LoadBytes(s.backend, name)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, existing) {
+		return refused("overwrite", name)
+	}
+	return nil
+}
+
+func (s *Server) remove(name string) error {
+	if s.appendOnly {
+		if !mutable(name) {
+			return refused("remove", name)
+		}
+		if err := s.keepHistory(name); err != nil {
+			return err
+		}
+	}
+	return s.backend.Remove(name)
+}
+
+func (s *Server) append(name string, body io.Reader) error {
+	if name == "" {
+		return fmt.Errorf("missing file name")
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if s.appendOnly && !mutable(name) {
+		// appending to a chunk would corrupt it just as well as overwriting it
+		exists, err := storage.Exists(s.backend, name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return refused("append to", name)
+		}
+	}
+	return storage.Append(s.backend, name, data)
+}
+
+func (s *Server) rename(from, to string) error {
+	if from == "" || to == "" {
+		return fmt.Errorf("missing file name")
+	}
+	if s.appendOnly {
+		if !mutable(from) {
+			return refused("rename", from)
+		}
+		if !mutable(to) {
+			exists, err := storage.Exists(s.backend, to)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return refused("overwrite", to)
+			}
+		}
+		if err := s.keepHistory(to); err != nil {
+			return err
+		}
+	}
+	return storage.Rename(s.backend, from, to)
+}
+
+// mutable is what append-only mode still lets clients change: locks, temp files and the index (with history).
+func mutable(name string) bool {
+	if strings.HasSuffix(name, ".tmp") {
+		return true
+	}
+	if strings.HasPrefix(name, historyDir+"/") {
+		return false
+	}
+	return strings.HasPrefix(name, repository.LocksDir+"/") || strings.HasPrefix(name, repository.IndexDir+"/")
+}
+
+// keepHistory copies an index file about to be replaced or removed to index/history/.
+func (s *Server) keepHistory(name string) error {
+	if !strings.HasPrefix(name, repository.IndexDir+"/") || strings.HasSuffix(name, ".tmp") {
+		return nil
+	}
+
+	data, err := storage.LoadBytes(s.backend, name)
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	stamp := time.Now().UTC().Format("20060102T150405.000000000")
+	target := path.Join(historyDir, path.Base(name)+"."+stamp)
+	if err := storage.SaveBytes(s.backend, target, data); err != nil {
+		return fmt.Errorf("failed to keep a copy of %s: %w", name, err)
+	}
+	return nil
+}
+
+func refused(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: errAppendOnly}
+}
+
+// errAppendOnly is a permission error, without repeating "permission denied" in every message.
+var errAppendOnly = appendOnlyError{}
+
+type appendOnlyError struct{}
+
+func (appendOnlyError) Error() string {
+	return "repository is append-only"
+}
+
+func (appendOnlyError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"gobackup/internal/storage"
+)
+
+// newAppendOnly returns a client for an append-only server without credentials, and the backend behind it.
+func newAppendOnly(t *testing.T) (*storage.REST, storage.Backend) {
+	t.Helper()
+	backend := storage.NewLocal(t.TempDir())
+	ts := httptest.NewServer(New(backend, nil, true))
+	t.Cleanup(ts.Close)
+
+	client, err := storage.NewREST("rest:"+ts.URL+"/", storage.RESTSettings{MaxRetries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, backend
+}
+
+func TestAppendOnlyChunks(t *testing.T) {
+	client, backend := newAppendOnly(t)
+	chunk := "data/chunk_000001.gz"
+
+	if err := storage.SaveBytes(client, chunk, []byte("chunk")); err != nil {
+		t.Fatalf("Save of a new chunk: %v", err)
+	}
+	// a retried upload is fine, a different one is not
+	if err := storage.SaveBytes(client, chunk, []byte("chunk")); err != nil {
+		t.Errorf("Save of the same content again: %v", err)
+	}
+	if err := storage.SaveBytes(client, chunk, []byte("garbage")); !storage.IsPermission(err) {
+		t.Errorf("Save over a chunk: %v, want a permission error", err)
+	}
+	if err := client.Remove(chunk); !storage.IsPermission(err) {
+		t.Errorf("Remove of a chunk: %v, want a permission error", err)
+	}
+	if err := client.Append(chunk, []byte("more")); !storage.IsPermission(err) {
+		t.Errorf("Append to a chunk: %v, want a permission error", err)
+	}
+	if err := client.Rename(chunk, "data/chunk_000002.gz"); !storage.IsPermission(err) {
+		t.Errorf("Rename of a chunk: %v, want a permission error", err)
+	}
+	if err := storage.SaveBytes(client, "index/metadata.json.tmp", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rename("index/metadata.json.tmp", "config.json"); err != nil {
+		t.Errorf("Rename onto a new config: %v", err)
+	}
+	if err := storage.SaveBytes(client, "index/metadata.json.tmp", []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rename("index/metadata.json.tmp", "config.json"); !storage.IsPermission(err) {
+		t.Errorf("Rename over the config: %v, want a permission error", err)
+	}
+
+	data, err := storage.LoadBytes(backend, chunk)
+	if err != nil || string(data) != "chunk" {
+		t.Errorf("chunk after the refused requests = %q, %v", data, err)
+	}
+}
+
+func TestAppendOnlyIndexHistory(t *testing.T) {
+	client, backend := newAppendOnly(t)
+
+	for _, content := range []string{"first", "second"} {
+		if err := storage.SaveBytes(client, "index/metadata.json.tmp", []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Rename("index/metadata.json.tmp", "index/metadata.json"); err != nil {
+			t.Fatalf("Rename of the index: %v", err)
+		}
+	}
+	if err := client.Append("index/journal.log", []byte("record\n")); err != nil {
+		t.Errorf("Append to the journal: %v", err)
+	}
+	if err := client.Remove("index/journal.log"); err != nil {
+		t.Errorf("Remove of the journal: %v", err)
+	}
+	if err := storage.SaveBytes(client, "locks/exclusive", []byte("me")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Remove("locks/exclusive"); err != nil {
+		t.Errorf("Remove of a lock: %v", err)
+	}
+
+	history, err := backend.List(historyDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kept []string
+	for _, file := range history {
+		data, err := storage.LoadBytes(backend, historyDir+"/"+file.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept = append(kept, string(data))
+	}
+	if got := strings.Join(kept, ","); !strings.Contains(got, "first") || !strings.Contains(got, "record\n") || len(kept) != 2 {
+		t.Errorf("history = %q, want the replaced index and the removed journal", kept)
+	}
+
+	// the history is out of reach of clients
+	entries, err := client.List("index")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name == "history" {
+			t.Error("List of the index shows the history")
+		}
+	}
+	if err := client.Remove(historyDir + "/" + history[0].Name); !storage.IsPermission(err) {
+		t.Errorf("Remove from the history: %v, want a permission error", err)
+	}
+}
+
+func TestRequestOutsideRepository(t *testing.T) {
+	s := New(storage.NewMemory(), nil, false)
+	for _, target := range []string{"/../secret", "/data/../../secret", "/data//chunk"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.URL.Path = target
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want %d", target, w.Code, http.StatusBadRequest)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/index/a?op=rename&to=../b", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("rename to ../b = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
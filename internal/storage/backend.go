@@ -0,0 +1,207 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+/*
+Backend is where a repository lives. Everything that reads or writes the
+repository (config, keys, locks, index, chunks, parity) goes through it, the
+engines never touch the filesystem of the backup location directly.
+
+Names are slash separated and relative to the repository root, e.g.
+"data/chunk_000001.gz" or "index/journal.log".
+
+Save has to be atomic: after a crash a file either has its complete new content
+or is left as it was, and once Save returns the data is durable.
+*/
+type Backend interface {
+	// Location is the path or URL of the repository, for messages.
+	Location() string
+	Save(name string, r io.Reader) error
+	Load(name string) (io.ReadCloser, error)
+	Stat(name string) (FileInfo, error)
+	// List returns the entries directly in dir, "" is the repository root.
+	List(dir string) ([]FileInfo, error)
+	Remove(name string) error
+	Close() error
+}
+
+// Appender is implemented by backends that can durably append to a file in place.
+type Appender interface {
+	Append(name string, data []byte) error
+}
+
+// Renamer is implemented by backends that can rename without copying.
+type Renamer interface {
+	Rename(from, to string) error
+}
+
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	IsDir   bool      `json:"is_dir,omitempty"`
+}
+
+// key slots are only readable by the owner, everything else is world readable like before
+var privateDirs = []string{"keys"}
+
+// filePerm is the mode for backends that store files with permissions.
+func filePerm(name string) os.FileMode {
+	for _, dir := range privateDirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return 0600
+		}
+	}
+	return 0644
+}
+
+// ErrNotExist is what every backend returns (wrapped) for a missing file.
+var ErrNotExist = fs.ErrNotExist
+
+func IsNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist)
+}
+
+func notExist(op, name string) error {
+	return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+}
+
+// IsPermission is true when the backend refused an operation, e.g. a delete on an append-only server.
+func IsPermission(err error) bool {
+	return errors.Is(err, fs.ErrPermission)
+}
+
+const maxBackoff = 30 * time.Second
+
+// retryBackoff is the delay before retry number attempt of a remote request.
+func retryBackoff(attempt int) time.Duration {
+	delay := 200 * time.Millisecond << (attempt - 1)
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	// jitter so parallel clients don't retry in lockstep
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+/*
+Settings is what remote backends need besides their location: endpoints,
+credentials, tuning. It comes from the --storage-config JSON file, anything
+left empty there is taken from the environment.
+*/
+type Settings struct {
+	S3   S3Settings   `json:"s3"`
+	SFTP SFTPSettings `json:"sftp"`
+	REST RESTSettings `json:"rest"`
+}
+
+func LoadSettings(path string) (*Settings, error) {
+	settings := &Settings{}
+	if path == "" {
+		return settings, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage config: %w", err)
+	}
+	if err := json.Unmarshal(data, settings); err != nil {
+		return nil, fmt.Errorf("invalid storage config %s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// Open picks the backend for a --backup location, plain paths are local directories.
+func Open(location string, settings *Settings) (Backend, error) {
+	if location == "" {
+		return nil, fmt.Errorf("empty repository location")
+	}
+	if settings == nil {
+		settings = &Settings{}
+	}
+
+	switch {
+	case strings.HasPrefix(location, "s3:"):
+		return NewS3(location, settings.S3)
+	case strings.HasPrefix(location, "sftp:"):
+		return NewSFTP(location, settings.SFTP)
+	case strings.HasPrefix(location, "rest:"):
+		return NewREST(location, settings.REST)
+	default:
+		return NewLocal(location), nil
+	}
+}
+
+func SaveBytes(b Backend, name string, data []byte) error {
+	return b.Save(name, bytes.NewReader(data))
+}
+
+func LoadBytes(b Backend, name string) ([]byte, error) {
+	r, err := b.Load(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func Exists(b Backend, name string) (bool, error) {
+	_, err := b.Stat(name)
+	if IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// RemoveIfExists is Remove that doesn't care whether the file was there.
+func RemoveIfExists(b Backend, name string) error {
+	if err := b.Remove(name); err != nil && !IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+/*
+Append adds data to the end of a file, creating it if needed. Backends that
+can't append (object stores) get the whole file rewritten, which is fine for
+the small files this is used for (the metadata journal).
+*/
+func Append(b Backend, name string, data []byte) error {
+	if appender, ok := b.(Appender); ok {
+		return appender.Append(name, data)
+	}
+
+	existing, err := LoadBytes(b, name)
+	if err != nil && !IsNotExist(err) {
+		return err
+	}
+	return SaveBytes(b, name, append(existing, data...))
+}
+
+// Rename moves a file, as copy + remove where the backend can't rename.
+func Rename(b Backend, from, to string) error {
+	if renamer, ok := b.(Renamer); ok {
+		return renamer.Rename(from, to)
+	}
+
+	r, err := b.Load(from)
+	if err != nil {
+		return err
+	}
+	err = b.Save(to, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return b.Remove(from)
+}
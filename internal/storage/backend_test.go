@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	checkBackend(t, NewLocal(t.TempDir()))
+}
+
+func TestMemory(t *testing.T) {
+	checkBackend(t, NewMemory())
+}
+
+/*
+checkBackend runs the semantics every backend has to share on an empty
+repository: Save replaces, List only has direct entries with subdirectories as
+IsDir, missing files are IsNotExist, and Append and Rename where the backend
+has them.
+*/
+func checkBackend(t *testing.T, b Backend) {
+	t.Helper()
+
+	mustSave(t, b, "config.json", "{}")
+	mustSave(t, b, "data/chunk_000001.gz", "first")
+	mustSave(t, b, "data/chunk_000002.gz", "second")
+	mustSave(t, b, "index/journal.log", "")
+	mustSave(t, b, "data/chunk_000001.gz", "replaced")
+
+	if got := mustLoad(t, b, "data/chunk_000001.gz"); got != "replaced" {
+		t.Errorf("Load after a second Save = %q, want %q", got, "replaced")
+	}
+
+	info, err := b.Stat("data/chunk_000002.gz")
+	if err != nil {
+		t.Fatalf("Stat: %v", err)
+	}
+	if info.Name != "chunk_000002.gz" || info.Size != int64(len("second")) || info.IsDir {
+		t.Errorf("Stat = %+v, want chunk_000002.gz with size %d", info, len("second"))
+	}
+
+	checkList(t, b, "", map[string]bool{"config.json": false, "data": true, "index": true})
+	checkList(t, b, "data", map[string]bool{"chunk_000001.gz": false, "chunk_000002.gz": false})
+	if entries, err := b.List("parity"); err != nil || len(entries) != 0 {
+		t.Errorf("List of a missing directory = %v, %v, want nothing", entries, err)
+	}
+
+	if err := b.Remove("data/chunk_000002.gz"); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	checkList(t, b, "data", map[string]bool{"chunk_000001.gz": false})
+
+	missing := "data/chunk_000002.gz"
+	if _, err := b.Load(missing); !IsNotExist(err) {
+		t.Errorf("Load of a missing file: %v, want a not-exist error", err)
+	}
+	if _, err := b.Stat(missing); !IsNotExist(err) {
+		t.Errorf("Stat of a missing file: %v, want a not-exist error", err)
+	}
+	// S3 reports success for a missing object, anything else has to say not-exist
+	if err := b.Remove(missing); err != nil && !IsNotExist(err) {
+		t.Errorf("Remove of a missing file: %v, want a not-exist error", err)
+	}
+	if err := RemoveIfExists(b, missing); err != nil {
+		t.Errorf("RemoveIfExists of a missing file: %v", err)
+	}
+	if exists, err := Exists(b, missing); exists || err != nil {
+		t.Errorf("Exists of a missing file = %v, %v", exists, err)
+	}
+
+	if appender, ok := b.(Appender); ok {
+		if err := appender.Append("index/journal.log", []byte("one\n")); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if err := appender.Append("index/journal.log", []byte("two\n")); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if got := mustLoad(t, b, "index/journal.log"); got != "one\ntwo\n" {
+			t.Errorf("Load after Append = %q", got)
+		}
+		if err := appender.Append("index/new.log", []byte("created")); err != nil {
+			t.Fatalf("Append to a new file: %v", err)
+		}
+		if got := mustLoad(t, b, "index/new.log"); got != "created" {
+			t.Errorf("Load after Append to a new file = %q", got)
+		}
+	}
+
+	if renamer, ok := b.(Renamer); ok {
+		if err := renamer.Rename("index/new.log", "index/metadata.json"); err != nil {
+			t.Fatalf("Rename: %v", err)
+		}
+		if got := mustLoad(t, b, "index/metadata.json"); got != "created" {
+			t.Errorf("Load after Rename = %q", got)
+		}
+		if _, err := b.Stat("index/new.log"); !IsNotExist(err) {
+			t.Errorf("Stat of the old name after Rename: %v, want a not-exist error", err)
+		}
+
+		mustSave(t, b, "index/next.json", "next")
+		if err := renamer.Rename("index/next.json", "index/metadata.json"); err != nil {
+			t.Fatalf("Rename onto an existing file: %v", err)
+		}
+		if got := mustLoad(t, b, "index/metadata.json"); got != "next" {
+			t.Errorf("Rename onto an existing file left %q", got)
+		}
+		if err := renamer.Rename("index/gone.json", "index/other.json"); !IsNotExist(err) {
+			t.Errorf("Rename of a missing file: %v, want a not-exist error", err)
+		}
+	}
+}
+
+func checkList(t *testing.T, b Backend, dir string, want map[string]bool) {
+	t.Helper()
+	entries, err := b.List(dir)
+	if err != nil {
+		t.Fatalf("List(%q): %v", dir, err)
+	}
+	got := make(map[string]bool)
+	for _, entry := range entries {
+		got[entry.Name] = entry.IsDir
+	}
+	if len(got) != len(want) {
+		t.Errorf("List(%q) = %v, want %v", dir, got, want)
+		return
+	}
+	for name, isDir := range want {
+		if gotDir, ok := got[name]; !ok || gotDir != isDir {
+			t.Errorf("List(%q) = %v, want %v", dir, got, want)
+			return
+		}
+	}
+}
+
+func mustSave(t *testing.T, b Backend, name, content string) {
+	t.Helper()
+	if err := b.Save(name, bytes.NewReader([]byte(content))); err != nil {
+		t.Fatalf("Save(%s): %v", name, err)
+	}
+}
+
+func mustLoad(t *testing.T, b Backend, name string) string {
+	t.Helper()
+	data, err := LoadBytes(b, name)
+	if err != nil {
+		t.Fatalf("Load(%s): %v", name, err)
+	}
+	return string(data)
+}
@@ -0,0 +1,4 @@
+package storage
+
+// CheckBackend lets tests outside the package (REST needs the server, which imports storage) share the backend semantics.
+var CheckBackend = checkBackend
@@ -0,0 +1,118 @@
+package storage
+
+import (
+	"gobackup/internal/utils"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Local is a repository in a directory on a local (or mounted) filesystem.
+type Local struct {
+	root string
+}
+
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+func (l *Local) Location() string {
+	return l.root
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+// Save writes through a temp file, see utils.WriteAtomic.
+func (l *Local) Save(name string, r io.Reader) error {
+	path := l.path(name)
+	if err := utils.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+	return utils.WriteAtomic(path, r, filePerm(name))
+}
+
+func (l *Local) Load(name string) (io.ReadCloser, error) {
+	return os.Open(l.path(name))
+}
+
+func (l *Local) Stat(name string) (FileInfo, error) {
+	info, err := os.Stat(l.path(name))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (l *Local) List(dir string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(l.path(dir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var files []FileInfo
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			// removed while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, FileInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: entry.IsDir()})
+	}
+	return files, nil
+}
+
+func (l *Local) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+func (l *Local) Append(name string, data []byte) error {
+	path := l.path(name)
+	if err := utils.EnsureDirectoryExists(filepath.Dir(path)); err != nil {
+		return err
+	}
+
+	_, statErr := os.Stat(path)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, filePerm(name))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if os.IsNotExist(statErr) {
+		return utils.SyncDir(filepath.Dir(path))
+	}
+	return nil
+}
+
+func (l *Local) Rename(from, to string) error {
+	toPath := l.path(to)
+	if err := utils.EnsureDirectoryExists(filepath.Dir(toPath)); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path(from), toPath); err != nil {
+		return err
+	}
+	return utils.SyncDir(filepath.Dir(toPath))
+}
+
+func (l *Local) Close() error {
+	return nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Memory keeps a whole repository in memory, for tests.
+type Memory struct {
+	files map[string]memoryFile
+	mu    sync.RWMutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string]memoryFile)}
+}
+
+func (m *Memory) Location() string {
+	return "memory:"
+}
+
+func (m *Memory) Save(name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[name] = memoryFile{data: data, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Load(name string) (io.ReadCloser, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	file, exists := m.files[name]
+	if !exists {
+		return nil, notExist("open", name)
+	}
+	return io.NopCloser(bytes.NewReader(file.data)), nil
+}
+
+func (m *Memory) Stat(name string) (FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if file, exists := m.files[name]; exists {
+		return FileInfo{Name: path.Base(name), Size: int64(len(file.data)), ModTime: file.modTime}, nil
+	}
+	for stored := range m.files {
+		if strings.HasPrefix(stored, name+"/") {
+			return FileInfo{Name: path.Base(name), IsDir: true}, nil
+		}
+	}
+	return FileInfo{}, notExist("stat", name)
+}
+
+func (m *Memory) List(dir string) ([]FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	prefix := ""
+	if dir != "" {
+		prefix = strings.TrimSuffix(dir, "/") + "/"
+	}
+
+	seenDirs := make(map[string]bool)
+	var files []FileInfo
+	for name, file := range m.files {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := name[len(prefix):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			if !seenDirs[rest[:i]] {
+				seenDirs[rest[:i]] = true
+				files = append(files, FileInfo{Name: rest[:i], IsDir: true})
+			}
+			continue
+		}
+		files = append(files, FileInfo{Name: rest, Size: int64(len(file.data)), ModTime: file.modTime})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+func (m *Memory) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.files[name]; !exists {
+		return notExist("remove", name)
+	}
+	delete(m.files, name)
+	return nil
+}
+
+func (m *Memory) Append(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file := m.files[name]
+	file.data = append(append([]byte(nil), file.data...), data...)
+	file.modTime = time.Now()
+	m.files[name] = file
+	return nil
+}
+
+func (m *Memory) Rename(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	file, exists := m.files[from]
+	if !exists {
+		return notExist("rename", from)
+	}
+	m.files[to] = file
+	delete(m.files, from)
+	return nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
@@ -0,0 +1,148 @@
+package storage_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"gobackup/internal/server"
+	"gobackup/internal/storage"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testToken = "0123456789abcdef-token"
+
+// newRESTServer exports a local repository the way `serve` does, with one user "tester".
+func newRESTServer(t *testing.T, handler func(http.Handler) http.Handler) *httptest.Server {
+	t.Helper()
+	dir := t.TempDir()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(dir, "htpasswd")
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.WriteFile(htpasswd, []byte("# users\ntester:"+string(hash)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokens, []byte("tester:"+testToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth := server.NewCredentials()
+	if err := auth.LoadHTPasswd(htpasswd); err != nil {
+		t.Fatal(err)
+	}
+	if err := auth.LoadTokens(tokens); err != nil {
+		t.Fatal(err)
+	}
+
+	var h http.Handler = server.New(storage.NewLocal(filepath.Join(dir, "repo")), auth, false)
+	if handler != nil {
+		h = handler(h)
+	}
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestREST(t *testing.T, location string, settings storage.RESTSettings) *storage.REST {
+	t.Helper()
+	t.Setenv("GOBACKUP_REST_USER", "")
+	t.Setenv("GOBACKUP_REST_PASSWORD", "")
+	t.Setenv("GOBACKUP_REST_TOKEN", "")
+	backend, err := storage.NewREST(location, settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+func TestREST(t *testing.T) {
+	ts := newRESTServer(t, nil)
+	storage.CheckBackend(t, newTestREST(t, "rest:"+ts.URL+"/", storage.RESTSettings{Token: testToken}))
+}
+
+func TestRESTBasicAuth(t *testing.T) {
+	ts := newRESTServer(t, nil)
+	// credentials in the location are taken out of it
+	location := strings.Replace("rest:"+ts.URL+"/", "://", "://tester:secret@", 1)
+	backend := newTestREST(t, location, storage.RESTSettings{})
+	if strings.Contains(backend.Location(), "secret") {
+		t.Errorf("Location() = %s, keeps the password", backend.Location())
+	}
+	storage.CheckBackend(t, backend)
+}
+
+func TestRESTAuthFailure(t *testing.T) {
+	var requests atomic.Int32
+	ts := newRESTServer(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			h.ServeHTTP(w, r)
+		})
+	})
+
+	for _, settings := range []storage.RESTSettings{
+		{},
+		{Username: "tester", Password: "wrong"},
+		{Username: "nobody", Password: "secret"},
+		{Token: "not-the-token-of-anybody"},
+	} {
+		requests.Store(0)
+		backend := newTestREST(t, "rest:"+ts.URL+"/", settings)
+		_, err := backend.Stat("config.json")
+		if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+			t.Errorf("Stat with %+v: %v, want an authentication error", settings, err)
+		}
+		if storage.IsNotExist(err) {
+			t.Errorf("Stat with %+v looks like a missing file: %v", settings, err)
+		}
+		// a wrong password doesn't get better by trying again
+		if n := requests.Load(); n != 1 {
+			t.Errorf("Stat with %+v sent %d requests, want 1", settings, n)
+		}
+	}
+}
+
+func TestRESTRetry(t *testing.T) {
+	var failures atomic.Int32
+	ts := newRESTServer(t, func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failures.Add(-1) >= 0 {
+				http.Error(w, "try again later", http.StatusServiceUnavailable)
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	})
+	backend := newTestREST(t, "rest:"+ts.URL+"/", storage.RESTSettings{Token: testToken, MaxRetries: 2})
+
+	failures.Store(1)
+	if err := storage.SaveBytes(backend, "config.json", []byte("{}")); err != nil {
+		t.Fatalf("Save after one 503: %v", err)
+	}
+	data, err := storage.LoadBytes(backend, "config.json")
+	if err != nil || string(data) != "{}" {
+		t.Fatalf("Load after the retried Save = %q, %v", data, err)
+	}
+
+	failures.Store(3)
+	_, err = backend.Stat("config.json")
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts") {
+		t.Errorf("Stat with the server down: %v, want giving up after 3 attempts", err)
+	}
+}
+
+func TestRESTInvalidLocation(t *testing.T) {
+	for _, location := range []string{"rest:", "rest:ftp://host/", "rest:https:///repo"} {
+		if _, err := storage.NewREST(location, storage.RESTSettings{}); err == nil {
+			t.Errorf("NewREST(%s) accepted an invalid location", location)
+		}
+	}
+}
@@ -0,0 +1,558 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+S3 stores the repository in an S3-compatible bucket (AWS, MinIO, Ceph RGW):
+
+	s3:bucket/prefix                        - AWS, or the endpoint from the settings / env
+	s3:http://localhost:9000/bucket/prefix  - explicit endpoint, e.g. a local MinIO
+
+Every repository file becomes the object prefix/name, so data/chunk_000001.gz
+ends up as prefix/data/chunk_000001.gz. Requests are signed with AWS signature
+version 4, failed requests are retried with exponential backoff and files bigger
+than PartSize are uploaded in parts.
+*/
+const (
+	s3DefaultEndpoint = "s3.amazonaws.com"
+	s3DefaultRegion   = "us-east-1"
+	s3DefaultPartSize = 16 * 1024 * 1024
+	s3MinPartSize     = 5 * 1024 * 1024
+	s3DefaultRetries  = 5
+)
+
+// only bulk data gets the storage class, index and lock files are small and
+// rewritten all the time, which infrequent access classes bill as minimum size/duration
+var s3StorageClassDirs = []string{"data", "parity"}
+
+type S3Settings struct {
+	Endpoint     string `json:"endpoint,omitempty"`
+	Region       string `json:"region,omitempty"`
+	AccessKey    string `json:"access_key,omitempty"`
+	SecretKey    string `json:"secret_key,omitempty"`
+	SessionToken string `json:"session_token,omitempty"`
+	StorageClass string `json:"storage_class,omitempty"`
+	// bucket in the path instead of the host name, needed by most self-hosted servers
+	PathStyle bool `json:"path_style,omitempty"`
+	// plain http
+	Insecure   bool  `json:"insecure,omitempty"`
+	PartSize   int64 `json:"part_size,omitempty"`
+	MaxRetries int   `json:"max_retries,omitempty"`
+}
+
+// fillFromEnv takes whatever the settings file left open from the usual AWS variables.
+func (s *S3Settings) fillFromEnv() {
+	fill := func(value *string, names ...string) {
+		for _, name := range names {
+			if *value == "" {
+				*value = os.Getenv(name)
+			}
+		}
+	}
+	fill(&s.AccessKey, "AWS_ACCESS_KEY_ID")
+	fill(&s.SecretKey, "AWS_SECRET_ACCESS_KEY")
+	fill(&s.SessionToken, "AWS_SESSION_TOKEN")
+	fill(&s.Region, "AWS_REGION", "AWS_DEFAULT_REGION")
+	fill(&s.StorageClass, "GOBACKUP_S3_STORAGE_CLASS")
+
+	if s.Endpoint == "" {
+		endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+		if endpoint == "" {
+			endpoint = os.Getenv("AWS_ENDPOINT_URL")
+		}
+		if endpoint != "" {
+			s.setEndpointURL(endpoint)
+		}
+	}
+}
+
+func (s *S3Settings) setEndpointURL(endpoint string) {
+	if u, err := url.Parse(endpoint); err == nil && u.Host != "" {
+		s.Endpoint = u.Host
+		s.Insecure = u.Scheme == "http"
+	} else {
+		s.Endpoint = endpoint
+	}
+	// custom endpoints rarely have wildcard DNS for virtual hosted buckets
+	s.PathStyle = true
+}
+
+type S3 struct {
+	settings S3Settings
+	bucket   string
+	prefix   string
+	client   *http.Client
+}
+
+func NewS3(location string, settings S3Settings) (*S3, error) {
+	rest := strings.TrimPrefix(location, "s3:")
+	if strings.HasPrefix(rest, "http://") || strings.HasPrefix(rest, "https://") {
+		u, err := url.Parse(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3 location %s: %w", location, err)
+		}
+		settings.setEndpointURL(u.Scheme + "://" + u.Host)
+		rest = u.Path
+	}
+	settings.fillFromEnv()
+
+	rest = strings.Trim(rest, "/")
+	bucket, prefix, _ := strings.Cut(rest, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("S3 location %s has no bucket, expected s3:bucket/prefix", location)
+	}
+	if settings.AccessKey == "" || settings.SecretKey == "" {
+		return nil, fmt.Errorf("S3 credentials missing, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or use a storage config file")
+	}
+
+	if settings.Endpoint == "" {
+		settings.Endpoint = s3DefaultEndpoint
+	}
+	if settings.Region == "" {
+		settings.Region = s3DefaultRegion
+	}
+	if settings.PartSize == 0 {
+		settings.PartSize = s3DefaultPartSize
+	}
+	if settings.PartSize < s3MinPartSize {
+		return nil, fmt.Errorf("S3 part size must be at least %d bytes", s3MinPartSize)
+	}
+	if settings.MaxRetries == 0 {
+		settings.MaxRetries = s3DefaultRetries
+	}
+
+	return &S3{
+		settings: settings,
+		bucket:   bucket,
+		prefix:   strings.Trim(prefix, "/"),
+		client:   &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+func (s *S3) Location() string {
+	return "s3:" + path.Join(s.bucket, s.prefix)
+}
+
+func (s *S3) key(name string) string {
+	return strings.TrimPrefix(path.Join(s.prefix, name), "/")
+}
+
+func (s *S3) storageClass(name string) string {
+	for _, dir := range s3StorageClassDirs {
+		if strings.HasPrefix(name, dir+"/") {
+			return s.settings.StorageClass
+		}
+	}
+	return ""
+}
+
+// Save uploads in one PUT, or in parts once the content is bigger than one part.
+func (s *S3) Save(name string, r io.Reader) error {
+	key := s.key(name)
+	header := make(http.Header)
+	if class := s.storageClass(name); class != "" {
+		header.Set("x-amz-storage-class", class)
+	}
+
+	// most saves are a single chunk, far below a part, so the buffer only grows
+	// as far as the data goes
+	var first bytes.Buffer
+	n, err := first.ReadFrom(io.LimitReader(r, s.settings.PartSize))
+	if err != nil {
+		return err
+	}
+	if n < s.settings.PartSize {
+		resp, err := s.do(http.MethodPut, key, nil, header, first.Bytes())
+		if err != nil {
+			return err
+		}
+		return s.check(resp, http.MethodPut, key)
+	}
+
+	return s.uploadMultipart(key, header, first.Bytes(), r)
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+func (s *S3) uploadMultipart(key string, header http.Header, part []byte, r io.Reader) error {
+	resp, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, header, nil)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := s.decode(resp, http.MethodPost, key, &initiated); err != nil {
+		return fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+
+	// an unfinished upload keeps its parts (and costs money) until aborted
+	abort := func(cause error) error {
+		resp, err := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		if err == nil {
+			err = s.check(resp, http.MethodDelete, key)
+		}
+		if err != nil {
+			log.Printf("Warning: failed to abort multipart upload of %s: %v", key, err)
+		}
+		return cause
+	}
+
+	var completed struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+	data := part
+	for partNumber := 1; len(data) > 0; partNumber++ {
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {initiated.UploadID},
+		}
+		resp, err := s.do(http.MethodPut, key, query, nil, data)
+		if err == nil {
+			err = s.check(resp, http.MethodPut, key)
+		}
+		if err != nil {
+			return abort(fmt.Errorf("failed to upload part %d: %w", partNumber, err))
+		}
+		completed.Parts = append(completed.Parts, s3CompletedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		n, err := io.ReadFull(r, part)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+		data = part[:n]
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return abort(err)
+	}
+	resp, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, body)
+	if err != nil {
+		return abort(err)
+	}
+	// S3 can answer 200 and still report an error in the body
+	var result struct {
+		XMLName xml.Name
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	if err := s.decode(resp, http.MethodPost, key, &result); err != nil {
+		return abort(fmt.Errorf("failed to complete multipart upload: %w", err))
+	}
+	if result.XMLName.Local == "Error" {
+		return abort(fmt.Errorf("failed to complete multipart upload of %s: %s (%s)", key, result.Code, result.Message))
+	}
+	return nil
+}
+
+func (s *S3) Load(name string) (io.ReadCloser, error) {
+	key := s.key(name)
+	resp, err := s.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, notExist("open", name)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, s.responseError(resp, http.MethodGet, key)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(name string) (FileInfo, error) {
+	key := s.key(name)
+	resp, err := s.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return FileInfo{}, notExist("stat", name)
+	}
+	if resp.StatusCode/100 != 2 {
+		return FileInfo{}, fmt.Errorf("s3 HEAD %s: %s", key, resp.Status)
+	}
+
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: path.Base(name), Size: resp.ContentLength, ModTime: modTime}, nil
+}
+
+func (s *S3) List(dir string) ([]FileInfo, error) {
+	prefix := s.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var files []FileInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+			"delimiter": {"/"},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		if err := s.decode(resp, http.MethodGet, prefix, &result); err != nil {
+			return nil, err
+		}
+
+		for _, object := range result.Contents {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if name == "" {
+				continue
+			}
+			files = append(files, FileInfo{Name: name, Size: object.Size, ModTime: object.LastModified})
+		}
+		for _, common := range result.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(common.Prefix, prefix), "/")
+			files = append(files, FileInfo{Name: name, IsDir: true})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	return files, nil
+}
+
+// Remove doesn't report missing objects, S3 answers a delete of one with success.
+func (s *S3) Remove(name string) error {
+	key := s.key(name)
+	resp, err := s.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return s.check(resp, http.MethodDelete, key)
+}
+
+func (s *S3) Close() error {
+	s.client.CloseIdleConnections()
+	return nil
+}
+
+// do sends a signed request, retrying network errors, throttling and 5xx with backoff.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	var lastErr error
+	for attempt := 0; attempt <= s.settings.MaxRetries; attempt++ {
+		if attempt > 0 {
+			delay := retryBackoff(attempt)
+			log.Printf("Warning: S3 %s %s failed, retrying in %s: %v", method, key, delay.Round(time.Millisecond), lastErr)
+			time.Sleep(delay)
+		}
+
+		req, err := s.newRequest(method, key, query, header, body)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			lastErr = s.responseError(resp, method, key)
+			continue
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", s.settings.MaxRetries+1, lastErr)
+}
+
+func (s *S3) newRequest(method, key string, query url.Values, header http.Header, body []byte) (*http.Request, error) {
+	scheme := "https"
+	if s.settings.Insecure {
+		scheme = "http"
+	}
+
+	u := &url.URL{Scheme: scheme, Host: s.settings.Endpoint, Path: "/" + key}
+	if s.settings.PathStyle {
+		u.Path = "/" + s.bucket
+		if key != "" {
+			u.Path += "/" + key
+		}
+	} else {
+		u.Host = s.bucket + "." + s.settings.Endpoint
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.ContentLength = int64(len(body))
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+	return req, nil
+}
+
+// sign adds an AWS signature version 4 Authorization header.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := strings.Join([]string{amzDate[:8], s.settings.Region, "s3", "aws4_request"}, "/")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	if s.settings.SessionToken != "" {
+		req.Header.Set("x-amz-security-token", s.settings.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+
+	signingKey := []byte("AWS4" + s.settings.SecretKey)
+	for _, part := range []string{amzDate[:8], s.settings.Region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.settings.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Escape is the URI encoding signature v4 expects: everything but unreserved characters.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func (s *S3) check(resp *http.Response, method, key string) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s.responseError(resp, method, key)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+func (s *S3) decode(resp *http.Response, method, key string, v interface{}) error {
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return s.responseError(resp, method, key)
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// responseError turns an S3 error response into an error and closes the body.
+func (s *S3) responseError(resp *http.Response, method, key string) error {
+	defer resp.Body.Close()
+
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &s3Err) == nil && s3Err.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s (%s)", method, key, resp.Status, s3Err.Code, s3Err.Message)
+	}
+	return fmt.Errorf("s3 %s %s: %s", method, key, resp.Status)
+}
@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	testBucket    = "backups"
+)
+
+/*
+fakeS3 is a path-style S3 bucket that checks every request's signature version
+4 the way S3 does, from what arrives on the wire. Listings are paged two keys
+at a time so continuation tokens get used.
+*/
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	classes map[string]string
+	uploads map[string]map[int][]byte
+	// storage class given when the upload was started
+	uploadClasses map[string]string
+	nextID        int
+
+	parts     int
+	completed int
+	aborted   int
+	// answer the next request with 503
+	failNext bool
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{
+		objects:       make(map[string][]byte),
+		classes:       make(map[string]string),
+		uploads:       make(map[string]map[int][]byte),
+		uploadClasses: make(map[string]string),
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failNext {
+		f.failNext = false
+		s3Error(w, http.StatusServiceUnavailable, "SlowDown", "try again")
+		return
+	}
+	if problem := checkSignature(r, body); problem != "" {
+		s3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", problem)
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != testBucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.nextID++
+		id := fmt.Sprintf("upload-%d", f.nextID)
+		f.uploads[id] = make(map[int][]byte)
+		f.uploadClasses[id] = r.Header.Get("x-amz-storage-class")
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		parts, ok := f.uploads[query.Get("uploadId")]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchUpload", query.Get("uploadId"))
+			return
+		}
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		parts[number] = body
+		f.parts++
+		w.Header().Set("ETag", partETag(number, body))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.complete(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(f.uploads, query.Get("uploadId"))
+		f.aborted++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		f.objects[key] = body
+		f.classes[key] = r.Header.Get("x-amz-storage-class")
+	case r.Method == http.MethodGet, r.Method == http.MethodHead:
+		data, ok := f.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", r.Method)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+
+	type entry struct {
+		key    string
+		common bool
+	}
+	seen := make(map[string]bool)
+	var entries []entry
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			common := key[:len(prefix)+i+1]
+			if !seen[common] {
+				seen[common] = true
+				entries = append(entries, entry{common, true})
+			}
+			continue
+		}
+		entries = append(entries, entry{key, false})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	end := min(start+2, len(entries))
+
+	var out strings.Builder
+	out.WriteString("<ListBucketResult>")
+	for _, e := range entries[start:end] {
+		if e.common {
+			fmt.Fprintf(&out, "<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", e.key)
+			continue
+		}
+		fmt.Fprintf(&out, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>%s</LastModified></Contents>",
+			e.key, len(f.objects[e.key]), time.Now().UTC().Format(time.RFC3339))
+	}
+	if end < len(entries) {
+		fmt.Fprintf(&out, "<IsTruncated>true</IsTruncated><NextContinuationToken>%d</NextContinuationToken>", end)
+	}
+	out.WriteString("</ListBucketResult>")
+	io.WriteString(w, out.String())
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, id string, body []byte) {
+	parts, ok := f.uploads[id]
+	if !ok {
+		s3Error(w, http.StatusNotFound, "NoSuchUpload", id)
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &request); err != nil {
+		s3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var data []byte
+	for i, part := range request.Parts {
+		content, ok := parts[part.PartNumber]
+		if part.PartNumber != i+1 || !ok || part.ETag != partETag(part.PartNumber, content) {
+			// S3 reports this with 200 and an error body
+			io.WriteString(w, "<Error><Code>InvalidPart</Code><Message>part mismatch</Message></Error>")
+			return
+		}
+		data = append(data, content...)
+	}
+	delete(f.uploads, id)
+	f.objects[key] = data
+	f.classes[key] = f.uploadClasses[id]
+	f.completed++
+	fmt.Fprintf(w, "<CompleteMultipartUploadResult><Key>%s</Key></CompleteMultipartUploadResult>", key)
+}
+
+func partETag(number int, data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("\"%d-%x\"", number, sum[:8])
+}
+
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// checkSignature verifies a signature v4 request independently of S3.sign, "" if it is valid.
+func checkSignature(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(sum[:]) {
+		return "payload hash doesn't match the body"
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 "), ", ") {
+		name, value, _ := strings.Cut(field, "=")
+		fields[name] = value
+	}
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || credential[0] != testAccessKey || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return "bad credential " + fields["Credential"]
+	}
+	amzDate := r.Header.Get("x-amz-date")
+	if len(amzDate) != 16 || amzDate[:8] != credential[1] {
+		return "date doesn't match the credential scope"
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	if !sort.StringsAreSorted(signed) {
+		return "signed headers not sorted"
+	}
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	for name := range r.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") && !strings.Contains(";"+fields["SignedHeaders"]+";", ";"+lower+";") {
+			return lower + " is not signed"
+		}
+	}
+
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, key := range keys {
+		for _, value := range query[key] {
+			params = append(params, awsEscape(key, false)+"="+awsEscape(value, false))
+		}
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		awsEscape(r.URL.Path, true),
+		strings.Join(params, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	scope := strings.Join(credential[1:], "/")
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + testSecretKey)
+	for _, part := range credential[1:] {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(toSign))
+	if hex.EncodeToString(mac.Sum(nil)) != fields["Signature"] {
+		return "signature mismatch"
+	}
+	return ""
+}
+
+// awsEscape is the URI encoding of the signature v4 documentation.
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~", c) >= 0 || c == '/' && keepSlash {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func newTestS3(t *testing.T, server *httptest.Server, settings S3Settings) *S3 {
+	t.Helper()
+	settings.AccessKey = testAccessKey
+	settings.SecretKey = testSecretKey
+	// characters that need escaping in the signed path
+	s3, err := NewS3("s3:"+server.URL+"/"+testBucket+"/host=laptop+1", settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3
+}
+
+func TestS3(t *testing.T) {
+	_, server := newFakeS3(t)
+	checkBackend(t, newTestS3(t, server, S3Settings{}))
+}
+
+func TestS3Multipart(t *testing.T) {
+	fake, server := newFakeS3(t)
+	s3 := newTestS3(t, server, S3Settings{PartSize: s3MinPartSize, StorageClass: "STANDARD_IA"})
+
+	content := make([]byte, 2*s3MinPartSize+1234)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	if err := s3.Save("data/chunk_000001.gz", bytes.NewReader(content)); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if fake.parts != 3 || fake.completed != 1 || fake.aborted != 0 {
+		t.Errorf("%d parts, %d completed, %d aborted, want 3, 1, 0", fake.parts, fake.completed, fake.aborted)
+	}
+	got, err := LoadBytes(s3, "data/chunk_000001.gz")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("multipart upload came back different (%d bytes, want %d)", len(got), len(content))
+	}
+	if class := fake.classes["host=laptop+1/data/chunk_000001.gz"]; class != "STANDARD_IA" {
+		t.Errorf("multipart upload storage class = %q, want STANDARD_IA", class)
+	}
+
+	// exactly one part goes up in a single PUT, with the storage class only for data
+	if err := s3.Save("data/chunk_000002.gz", bytes.NewReader(content[:100])); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if err := s3.Save("index/journal.log", bytes.NewReader(content[:100])); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if fake.parts != 3 {
+		t.Errorf("small files went up in parts")
+	}
+	if class := fake.classes["host=laptop+1/data/chunk_000002.gz"]; class != "STANDARD_IA" {
+		t.Errorf("chunk storage class = %q, want STANDARD_IA", class)
+	}
+	if class := fake.classes["host=laptop+1/index/journal.log"]; class != "" {
+		t.Errorf("index storage class = %q, want none", class)
+	}
+
+	// multipart only starts once a whole part was read
+	for _, tt := range []struct {
+		size  int
+		parts int
+	}{
+		{s3MinPartSize - 1, 0},
+		{s3MinPartSize, 1},
+		{s3MinPartSize + 1, 2},
+	} {
+		before := fake.parts
+		if err := s3.Save("data/chunk_000003.gz", bytes.NewReader(content[:tt.size])); err != nil {
+			t.Fatalf("Save of %d bytes: %v", tt.size, err)
+		}
+		if parts := fake.parts - before; parts != tt.parts {
+			t.Errorf("Save of %d bytes went up in %d parts, want %d", tt.size, parts, tt.parts)
+		}
+		if got, err := LoadBytes(s3, "data/chunk_000003.gz"); err != nil || !bytes.Equal(got, content[:tt.size]) {
+			t.Errorf("Save of %d bytes came back as %d bytes (%v)", tt.size, len(got), err)
+		}
+	}
+
+	// a small save doesn't allocate a whole part
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	allocated := stats.TotalAlloc
+	if err := s3.Save("data/chunk_000004.gz", bytes.NewReader(content[:100])); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	runtime.ReadMemStats(&stats)
+	if n := stats.TotalAlloc - allocated; n > s3MinPartSize/2 {
+		t.Errorf("saving 100 bytes allocated %d bytes", n)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	fake, server := newFakeS3(t)
+	s3 := newTestS3(t, server, S3Settings{})
+
+	// throttling is retried
+	fake.failNext = true
+	if err := SaveBytes(s3, "config.json", []byte("{}")); err != nil {
+		t.Fatalf("Save after a 503: %v", err)
+	}
+
+	wrong := newTestS3(t, server, S3Settings{})
+	wrong.settings.SecretKey = "not the secret"
+	_, err := LoadBytes(wrong, "config.json")
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("Load with the wrong secret: %v, want SignatureDoesNotMatch", err)
+	}
+}
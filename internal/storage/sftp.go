@@ -0,0 +1,466 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+/*
+SFTP stores the repository on another host over SSH:
+
+	sftp:user@host:/srv/backups/laptop
+	sftp://user@host:2222/srv/backups/laptop
+
+Only key based auth is supported (identity files and ssh-agent), and the host key
+has to be in known_hosts, there is no trust on first use. One connection is kept
+open and reused, keepalives notice when it dies and the next operation reconnects.
+*/
+const (
+	sftpDefaultPort       = 22
+	sftpKeepaliveInterval = 30 * time.Second
+	sftpDialTimeout       = 30 * time.Second
+)
+
+type SFTPSettings struct {
+	// default: id_ed25519, id_ecdsa, id_rsa in ~/.ssh, plus ssh-agent
+	IdentityFile string `json:"identity_file,omitempty"`
+	// default: ~/.ssh/known_hosts
+	KnownHostsFile string `json:"known_hosts_file,omitempty"`
+	Port           int    `json:"port,omitempty"`
+}
+
+type SFTP struct {
+	addr     string
+	root     string
+	config   *ssh.ClientConfig
+	location string
+	// ssh-agent, dialed for each connection and closed once it is authenticated
+	agentSocket string
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+	done   chan struct{}
+}
+
+func NewSFTP(location string, settings SFTPSettings) (*SFTP, error) {
+	username, host, port, root, err := parseSFTPLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = settings.Port
+	}
+	if port == 0 {
+		port = sftpDefaultPort
+	}
+	if username == "" {
+		if u, err := user.Current(); err == nil {
+			username = u.Username
+		}
+	}
+
+	auth, err := sftpAuthMethods(settings.IdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	agentSocket := os.Getenv("SSH_AUTH_SOCK")
+	if len(auth) == 0 && agentSocket == "" {
+		return nil, fmt.Errorf("no SSH key found, set identity_file in the storage config or start ssh-agent")
+	}
+
+	knownHostsFile := settings.KnownHostsFile
+	if knownHostsFile == "" {
+		home, _ := os.UserHomeDir()
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known hosts: %w", err)
+	}
+
+	return &SFTP{
+		addr:        net.JoinHostPort(host, strconv.Itoa(port)),
+		root:        root,
+		location:    location,
+		agentSocket: agentSocket,
+		config: &ssh.ClientConfig{
+			User:            username,
+			Auth:            auth,
+			HostKeyCallback: hostKeyCallback,
+			Timeout:         sftpDialTimeout,
+		},
+	}, nil
+}
+
+func parseSFTPLocation(location string) (username, host string, port int, root string, err error) {
+	if strings.HasPrefix(location, "sftp://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return "", "", 0, "", fmt.Errorf("invalid SFTP location %s: %w", location, err)
+		}
+		if u.Port() != "" {
+			port, _ = strconv.Atoi(u.Port())
+		}
+		return u.User.Username(), u.Hostname(), port, u.Path, nil
+	}
+
+	// sftp:user@host:/path, like scp
+	rest := strings.TrimPrefix(location, "sftp:")
+	hostPart, root, found := strings.Cut(rest, ":")
+	if !found || hostPart == "" || root == "" {
+		return "", "", 0, "", fmt.Errorf("invalid SFTP location %s, expected sftp:user@host:/path", location)
+	}
+	if at := strings.LastIndex(hostPart, "@"); at >= 0 {
+		username, hostPart = hostPart[:at], hostPart[at+1:]
+	}
+	return username, hostPart, 0, root, nil
+}
+
+func sftpAuthMethods(identityFile string) ([]ssh.AuthMethod, error) {
+	var signers []ssh.Signer
+
+	candidates := []string{identityFile}
+	if identityFile == "" {
+		home, _ := os.UserHomeDir()
+		candidates = []string{
+			filepath.Join(home, ".ssh", "id_ed25519"),
+			filepath.Join(home, ".ssh", "id_ecdsa"),
+			filepath.Join(home, ".ssh", "id_rsa"),
+		}
+	}
+	for _, candidate := range candidates {
+		data, err := os.ReadFile(candidate)
+		if os.IsNotExist(err) && identityFile == "" {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read identity file: %w", err)
+		}
+
+		signer, err := ssh.ParsePrivateKey(data)
+		var passphraseErr *ssh.PassphraseMissingError
+		if errors.As(err, &passphraseErr) {
+			// can't prompt in a daemon, the agent has to hold this one
+			log.Printf("Warning: %s is passphrase protected, load it into ssh-agent to use it", candidate)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity file %s: %w", candidate, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	// ssh-agent comes on top, see session
+	var methods []ssh.AuthMethod
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods, nil
+}
+
+func (s *SFTP) Location() string {
+	return s.location
+}
+
+func (s *SFTP) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+// session returns the current client, connecting if there is none.
+func (s *SFTP) session() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	config := *s.config
+	var agentConn net.Conn
+	if s.agentSocket != "" {
+		if c, err := net.Dial("unix", s.agentSocket); err == nil {
+			agentConn = c
+			config.Auth = append(slices.Clip(s.config.Auth), ssh.PublicKeysCallback(agent.NewClient(c).Signers))
+		}
+	}
+	conn, err := ssh.Dial("tcp", s.addr, &config)
+	// the agent only signs during the handshake
+	if agentConn != nil {
+		agentConn.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", s.addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start SFTP session on %s: %w", s.addr, err)
+	}
+
+	s.conn = conn
+	s.client = client
+	s.done = make(chan struct{})
+	go s.keepalive(conn, s.done)
+	return client, nil
+}
+
+// drop closes the connection client belongs to, if it's still the current one.
+func (s *SFTP) drop(client *sftp.Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != client || client == nil {
+		return
+	}
+	close(s.done)
+	s.client.Close()
+	s.conn.Close()
+	s.client = nil
+	s.conn = nil
+}
+
+// keepalive closes the connection when the server stops answering, so nothing hangs on a dead link.
+func (s *SFTP) keepalive(conn *ssh.Client, done chan struct{}) {
+	ticker := time.NewTicker(sftpKeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case <-done:
+				return
+			case err := <-reply:
+				if err == nil {
+					continue
+				}
+				log.Printf("Warning: SFTP connection to %s lost: %v", s.addr, err)
+			case <-time.After(sftpKeepaliveInterval):
+				log.Printf("Warning: SFTP server %s stopped answering keepalives", s.addr)
+			}
+			conn.Close()
+			return
+		}
+	}
+}
+
+func isUnsupported(err error) bool {
+	var statusErr *sftp.StatusError
+	return errors.As(err, &statusErr) && statusErr.FxCode() == sftp.ErrSSHFxOpUnsupported
+}
+
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) || errors.As(err, &opErr)
+}
+
+// run does one operation, reconnecting and trying once more if the connection was lost.
+func (s *SFTP) run(op func(client *sftp.Client) error) error {
+	client, err := s.session()
+	if err != nil {
+		return err
+	}
+
+	err = op(client)
+	if err == nil || !isConnectionError(err) {
+		return err
+	}
+
+	log.Printf("Warning: SFTP connection to %s lost, reconnecting: %v", s.addr, err)
+	s.drop(client)
+	client, err = s.session()
+	if err != nil {
+		return err
+	}
+	return op(client)
+}
+
+// Save writes a temp file and renames it over the target with posix-rename.
+func (s *SFTP) Save(name string, r io.Reader) error {
+	target := s.path(name)
+	started := false
+
+	return s.run(func(client *sftp.Client) error {
+		if started {
+			// retry after a reconnect, only possible if we can rewind
+			seeker, ok := r.(io.Seeker)
+			if !ok {
+				return fmt.Errorf("connection lost while uploading %s", name)
+			}
+			if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		started = true
+
+		if err := client.MkdirAll(path.Dir(target)); err != nil {
+			return err
+		}
+
+		suffix := make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return err
+		}
+		tempPath := target + "." + hex.EncodeToString(suffix) + ".tmp"
+
+		file, err := client.OpenFile(tempPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, r); err != nil {
+			file.Close()
+			client.Remove(tempPath)
+			return err
+		}
+		if err := file.Chmod(filePerm(name)); err != nil {
+			file.Close()
+			client.Remove(tempPath)
+			return err
+		}
+		// fsync@openssh.com, servers without it give no durability guarantee at all
+		if err := file.Sync(); err != nil && !isUnsupported(err) {
+			file.Close()
+			client.Remove(tempPath)
+			return err
+		}
+		if err := file.Close(); err != nil {
+			client.Remove(tempPath)
+			return err
+		}
+
+		if err := client.PosixRename(tempPath, target); err != nil {
+			client.Remove(tempPath)
+			return err
+		}
+		return nil
+	})
+}
+
+func (s *SFTP) Load(name string) (io.ReadCloser, error) {
+	var file *sftp.File
+	err := s.run(func(client *sftp.Client) error {
+		var err error
+		file, err = client.Open(s.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+func (s *SFTP) Stat(name string) (FileInfo, error) {
+	var info os.FileInfo
+	err := s.run(func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(s.path(name))
+		return err
+	})
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return FileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime(), IsDir: info.IsDir()}, nil
+}
+
+func (s *SFTP) List(dir string) ([]FileInfo, error) {
+	var entries []os.FileInfo
+	err := s.run(func(client *sftp.Client) error {
+		var err error
+		entries, err = client.ReadDir(s.path(dir))
+		return err
+	})
+	if IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		files = append(files, FileInfo{Name: entry.Name(), Size: entry.Size(), ModTime: entry.ModTime(), IsDir: entry.IsDir()})
+	}
+	return files, nil
+}
+
+func (s *SFTP) Remove(name string) error {
+	return s.run(func(client *sftp.Client) error {
+		return client.Remove(s.path(name))
+	})
+}
+
+// Append writes at the current end, only one process appends at a time (exclusive lock).
+func (s *SFTP) Append(name string, data []byte) error {
+	target := s.path(name)
+	return s.run(func(client *sftp.Client) error {
+		if err := client.MkdirAll(path.Dir(target)); err != nil {
+			return err
+		}
+
+		file, err := client.OpenFile(target, os.O_WRONLY|os.O_CREATE)
+		if err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			file.Close()
+			return err
+		}
+		if _, err := file.Write(data); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Sync(); err != nil && !isUnsupported(err) {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+}
+
+func (s *SFTP) Rename(from, to string) error {
+	return s.run(func(client *sftp.Client) error {
+		if err := client.MkdirAll(path.Dir(s.path(to))); err != nil {
+			return err
+		}
+		return client.PosixRename(s.path(from), s.path(to))
+	})
+}
+
+func (s *SFTP) Close() error {
+	s.mu.Lock()
+	client := s.client
+	s.mu.Unlock()
+
+	s.drop(client)
+	return nil
+}
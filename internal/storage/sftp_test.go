@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer serves the local filesystem over SFTP to one authorized key.
+type sftpServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+
+	mu    sync.Mutex
+	conns []*ssh.ServerConn
+}
+
+func newSFTPServer(t *testing.T, authorized ssh.PublicKey) *sftpServer {
+	t.Helper()
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(authorized.Marshal()) {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	s := &sftpServer{listener: listener, hostKey: hostKey}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *sftpServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	serverConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s.mu.Lock()
+	s.conns = append(s.conns, serverConn)
+	s.mu.Unlock()
+
+	// keepalives
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range channelRequests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				go func() {
+					server.Serve()
+					server.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// dropAll cuts every connection, like a server restart.
+func (s *sftpServer) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// sftpIdentity writes a client key the way ssh-keygen does.
+func sftpIdentity(t *testing.T) (ssh.PublicKey, string) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	identity := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(identity, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientKey, identity
+}
+
+// knownHosts writes a known_hosts file trusting hostKey for addr.
+func knownHosts(t *testing.T, addr string, hostKey ssh.PublicKey) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey) + "\n"
+	if err := os.WriteFile(file, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func newTestSFTP(t *testing.T) (*SFTP, *sftpServer) {
+	t.Helper()
+	// only the identity file, whatever agent the test runs under stays out of it
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	clientKey, identity := sftpIdentity(t)
+	server := newSFTPServer(t, clientKey)
+	addr := server.listener.Addr().String()
+	settings := SFTPSettings{IdentityFile: identity, KnownHostsFile: knownHosts(t, addr, server.hostKey.PublicKey())}
+
+	backend, err := NewSFTP("sftp://tester@"+addr+t.TempDir(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+	return backend, server
+}
+
+func TestSFTP(t *testing.T) {
+	backend, _ := newTestSFTP(t)
+	checkBackend(t, backend)
+}
+
+func TestSFTPReconnect(t *testing.T) {
+	backend, server := newTestSFTP(t)
+	if err := SaveBytes(backend, "config.json", []byte("{}")); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	server.dropAll()
+	data, err := LoadBytes(backend, "config.json")
+	if err != nil {
+		t.Fatalf("Load after the connection was cut: %v", err)
+	}
+	if string(data) != "{}" {
+		t.Errorf("Load after reconnecting = %q", data)
+	}
+}
+
+func TestSFTPUnknownHostKey(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+	clientKey, identity := sftpIdentity(t)
+	server := newSFTPServer(t, clientKey)
+	addr := server.listener.Addr().String()
+
+	// known_hosts has another key for this address, there is no trust on first use
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	signer, err := ssh.NewSignerFromKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := SFTPSettings{IdentityFile: identity, KnownHostsFile: knownHosts(t, addr, signer.PublicKey())}
+	backend, err := NewSFTP("sftp://tester@"+addr+t.TempDir(), settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	if _, err := backend.Stat("config.json"); err == nil {
+		t.Fatal("connected to a server with an unknown host key")
+	}
+}
+
+func TestSFTPAgent(t *testing.T) {
+	// no identity files, the key is only in the agent
+	t.Setenv("HOME", t.TempDir())
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+		t.Fatal(err)
+	}
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var open atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			open.Add(1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				conn.Close()
+				open.Add(-1)
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", socket)
+
+	clientKey, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSFTPServer(t, clientKey)
+	addr := server.listener.Addr().String()
+	backend, err := NewSFTP("sftp://tester@"+addr+t.TempDir(), SFTPSettings{KnownHostsFile: knownHosts(t, addr, server.hostKey.PublicKey())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	if err := SaveBytes(backend, "config.json", []byte("{}")); err != nil {
+		t.Fatalf("Save with the agent's key: %v", err)
+	}
+	// the agent connection is only needed for the handshake
+	deadline := time.Now().Add(5 * time.Second)
+	for open.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d agent connections still open after connecting", open.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
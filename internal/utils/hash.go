@@ -1,27 +1,90 @@
 package utils
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 )
 
+/*
+Hasher produces the content identifiers stored in metadata (file and chunk hashes).
+Unencrypted repositories use plain SHA-256, encrypted ones use HMAC-SHA256 keyed
+with a repository secret so the stored hashes can't be used to confirm that a known
+file is in the backup.
+*/
+type Hasher interface {
+	HashFile(filePath string) (string, error)
+	HashData(data []byte) string
+	// New hashes a stream the same way, for content too large to hold at once (see Sum)
+	New() hash.Hash
+}
+
+type sha256Hasher struct{}
+
+func NewSHA256Hasher() Hasher {
+	return sha256Hasher{}
+}
+
+func (sha256Hasher) HashFile(filePath string) (string, error) {
+	return CalculateFileHash(filePath)
+}
+
+func (sha256Hasher) HashData(data []byte) string {
+	return CalculateDataHash(data)
+}
+
+func (sha256Hasher) New() hash.Hash {
+	return sha256.New()
+}
+
+type keyedHasher struct {
+	key []byte
+}
+
+func NewKeyedHasher(key []byte) Hasher {
+	return keyedHasher{key: key}
+}
+
+func (h keyedHasher) HashFile(filePath string) (string, error) {
+	return hashFileWith(filePath, hmac.New(sha256.New, h.key))
+}
+
+func (h keyedHasher) HashData(data []byte) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write(data)
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+func (h keyedHasher) New() hash.Hash {
+	return hmac.New(sha256.New, h.key)
+}
+
+// Sum formats a streamed hash like HashData does.
+func Sum(h hash.Hash) string {
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 func CalculateFileHash(filePath string) (string, error) {
+	return hashFileWith(filePath, sha256.New())
+}
+
+func CalculateDataHash(data []byte) string {
+	hash := sha256.Sum256(data)
+	return fmt.Sprintf("%x", hash[:])
+}
+
+func hashFileWith(filePath string, h hash.Hash) (string, error) {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return "", err
 	}
 	defer file.Close()
 
-	hash := sha256.New()
-	if _, err := io.Copy(hash, file); err != nil {
+	if _, err := io.Copy(h, file); err != nil {
 		return "", err
 	}
-	return fmt.Sprintf("%x", hash.Sum(nil)), nil
-}
-
-func CalculateDataHash(data []byte) string {
-	hash := sha256.Sum256(data)
-	return fmt.Sprintf("%x", hash[:])
+	return Sum(h), nil
 }
@@ -0,0 +1,17 @@
+//go:build !windows
+
+package watcher
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIDOf identifies a file across renames by device and inode.
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package watcher
+
+import "os"
+
+// no inode numbers in os.FileInfo here, renames show up as delete and create
+func fileIDOf(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
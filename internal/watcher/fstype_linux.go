@@ -0,0 +1,29 @@
+//go:build linux
+
+package watcher
+
+import "syscall"
+
+// filesystems inotify doesn't see remote changes on, by statfs magic number
+var networkFilesystems = map[int64]string{
+	0x6969:     "nfs",
+	0x517b:     "smb",
+	0xff534d42: "cifs",
+	0xfe534d42: "smb2",
+	0x65735546: "fuse",
+	0x73757245: "coda",
+	0x5346414f: "afs",
+	0x00c36400: "ceph",
+	0x01021997: "9p",
+	0x564c:     "ncp",
+}
+
+// networkFS reports whether path is on a network or FUSE filesystem, and which.
+func networkFS(path string) (string, bool) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return "", false
+	}
+	name, ok := networkFilesystems[int64(stat.Type)]
+	return name, ok
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package watcher
+
+// filesystem types aren't checked here, use --watch-mode poll for network mounts
+func networkFS(path string) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,79 @@
+package watcher
+
+import (
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+/*
+Watch limits:
+inotify needs a watch per directory and fs.inotify.max_user_watches caps them
+per user (8192 on many distributions), so a big monorepo can run out of them.
+A directory that can't get a watch doesn't stop the watcher: it and everything
+below it are handed to the poller, which walks them every poll interval instead.
+Changes there show up later than elsewhere, but they show up, and Status reports
+how many directories ended up polled so it's visible in the logs.
+
+Polled subtrees stay polled, watches freed later aren't used to take them back.
+*/
+
+// SetPolling sets how directories without a watch are polled, see Options.
+func (w *Watcher) SetPolling(interval time.Duration, rate int) {
+	w.poller.interval = interval
+	w.poller.rate = rate
+}
+
+// pollDir hands a directory that got no watch to the poller and returns the files in it, w.mu must be held.
+func (w *Watcher) pollDir(dir string) []string {
+	if !w.limitWarned {
+		log.Printf("Warning: out of inotify watches at %s (raise fs.inotify.max_user_watches), directories without a watch are polled every %s", dir, w.poller.interval)
+		w.limitWarned = true
+	}
+
+	snapshot := w.poller.addRoot(dir)
+	var files []string
+	for path, file := range snapshot {
+		if !file.isDir {
+			files = append(files, path)
+		}
+	}
+	return files
+}
+
+// forwardPolled passes on what the poller finds in the directories without a watch.
+func (w *Watcher) forwardPolled() {
+	for {
+		select {
+		case <-w.ctx.Done():
+			return
+		case event := <-w.poller.Changes():
+			select {
+			case w.changeChan <- event:
+			case <-w.ctx.Done():
+				return
+			}
+		case err := <-w.poller.Errors():
+			select {
+			case w.errorChan <- err:
+			default:
+			}
+		}
+	}
+}
+
+func (w *Watcher) Status() WatchStatus {
+	w.mu.RLock()
+	watched := len(w.watchedDirs)
+	w.mu.RUnlock()
+
+	status := w.poller.Status()
+	status.Watched = watched
+	return status
+}
+
+// watchLimitReached reports whether err means no more watches (or inotify instances) are available.
+func watchLimitReached(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EMFILE)
+}
@@ -0,0 +1,87 @@
+package watcher
+
+import (
+	"fmt"
+	"gobackup/internal/filter"
+	"gobackup/pkg/models"
+	"log"
+	"time"
+)
+
+/*
+FileWatcher is what the backup loop needs from a watcher. Watcher gets its
+events from the kernel (inotify and friends), Poller finds them by comparing the
+tree with what it saw the last time. Polling costs a stat per file per interval
+but it is the only thing that works where the kernel never hears about changes:
+NFS, SMB and sshfs mounts, or anything changed by another host.
+*/
+type FileWatcher interface {
+	SetFilter(f *filter.Filter)
+	AddWatch(path string) error
+	Start()
+	Changes() <-chan models.FileEvent
+	Errors() <-chan error
+	Status() WatchStatus
+	Close() error
+}
+
+// WatchStatus is how a watcher is covering its tree right now.
+type WatchStatus struct {
+	// directories with a kernel watch
+	Watched int
+	// directories polled instead, because they couldn't get one
+	Polled int
+}
+
+const (
+	ModeAuto   = "auto"
+	ModeNotify = "notify"
+	ModePoll   = "poll"
+
+	DefaultPollInterval = 30 * time.Second
+)
+
+type Options struct {
+	// auto polls on network and FUSE filesystems and uses notifications elsewhere
+	Mode         string
+	PollInterval time.Duration
+	// stats per second while polling, 0 for no limit
+	PollRate int
+}
+
+// New returns the watcher for root, see Options.Mode.
+func New(root string, opts Options) (FileWatcher, error) {
+	mode := opts.Mode
+	switch mode {
+	case "", ModeAuto:
+		mode = ModeNotify
+		if fsType, remote := networkFS(root); remote {
+			log.Printf("%s is on %s, polling it for changes every %s", root, fsType, pollInterval(opts))
+			mode = ModePoll
+		}
+	case ModeNotify, ModePoll:
+	default:
+		return nil, fmt.Errorf("unknown watch mode %q (auto, notify or poll)", opts.Mode)
+	}
+
+	if mode == ModePoll {
+		return NewPoller(pollInterval(opts), opts.PollRate), nil
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		if !watchLimitReached(err) {
+			return nil, err
+		}
+		log.Printf("Warning: no inotify instance left (%v, see fs.inotify.max_user_instances), polling %s every %s instead", err, root, pollInterval(opts))
+		return NewPoller(pollInterval(opts), opts.PollRate), nil
+	}
+	w.SetPolling(pollInterval(opts), opts.PollRate)
+	return w, nil
+}
+
+func pollInterval(opts Options) time.Duration {
+	if opts.PollInterval > 0 {
+		return opts.PollInterval
+	}
+	return DefaultPollInterval
+}
@@ -0,0 +1,343 @@
+package watcher
+
+import (
+	"context"
+	"gobackup/internal/filter"
+	"gobackup/pkg/models"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Poller watches a tree by walking it every interval and comparing each file's
+size, mtime, mode and inode with the previous walk:
+  - a new path is a CREATE, a changed one a MODIFY, a missing one a DELETE
+  - a missing path whose inode shows up under a new path is a RENAME, for a
+    directory that covers everything below it, so a moved tree isn't read again
+
+The first walk only records the tree, the initial full backup covers it. A walk
+that takes longer than the interval delays the next one instead of overlapping
+it, and with a rate the walk paces itself to that many stats per second, so
+polling a big NAS share doesn't saturate it.
+*/
+type Poller struct {
+	interval time.Duration
+	rate     int
+	filter   *filter.Filter
+
+	mu    sync.Mutex
+	roots []string
+	// path -> what it was on the last walk, per root
+	snapshots map[string]map[string]polledFile
+
+	changeChan chan models.FileEvent
+	errorChan  chan error
+	ctx        context.Context
+	cancel     context.CancelFunc
+	wg         sync.WaitGroup
+}
+
+type polledFile struct {
+	id      fileID
+	hasID   bool
+	size    int64
+	modTime time.Time
+	mode    os.FileMode
+	isDir   bool
+}
+
+func NewPoller(interval time.Duration, rate int) *Poller {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Poller{
+		interval:   interval,
+		rate:       rate,
+		snapshots:  make(map[string]map[string]polledFile),
+		changeChan: make(chan models.FileEvent),
+		errorChan:  make(chan error, 10),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+}
+
+// SetFilter leaves excluded files and directories out of every walk, call it before AddWatch.
+func (p *Poller) SetFilter(f *filter.Filter) {
+	p.filter = f
+}
+
+func (p *Poller) AddWatch(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	snapshot := p.addRoot(path)
+	log.Printf("Polling directory: %s (%d entries, every %s)", path, len(snapshot), p.interval)
+	return nil
+}
+
+// addRoot starts polling path and returns what it holds now.
+func (p *Poller) addRoot(path string) map[string]polledFile {
+	snapshot := p.walk(path)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.roots = append(p.roots, path)
+	p.snapshots[path] = snapshot
+	return snapshot
+}
+
+// RemoveWatch stops polling path and the roots below it.
+func (p *Poller) RemoveWatch(path string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	prefix := path + string(filepath.Separator)
+	roots := p.roots[:0]
+	for _, root := range p.roots {
+		if root == path || strings.HasPrefix(root, prefix) {
+			delete(p.snapshots, root)
+			log.Printf("Stopped polling directory: %s", root)
+			continue
+		}
+		roots = append(roots, root)
+	}
+	p.roots = roots
+}
+
+// Status counts the polled directories as of the last walk.
+func (p *Poller) Status() WatchStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var status WatchStatus
+	for _, snapshot := range p.snapshots {
+		for _, file := range snapshot {
+			if file.isDir {
+				status.Polled++
+			}
+		}
+	}
+	return status
+}
+
+func (p *Poller) Start() {
+	p.wg.Add(1)
+	go p.run()
+}
+
+func (p *Poller) Changes() <-chan models.FileEvent {
+	return p.changeChan
+}
+
+func (p *Poller) Errors() <-chan error {
+	return p.errorChan
+}
+
+func (p *Poller) Close() error {
+	p.cancel()
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Poller) run() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(p.interval):
+		}
+
+		p.mu.Lock()
+		roots := append([]string(nil), p.roots...)
+		p.mu.Unlock()
+
+		for _, root := range roots {
+			if !p.poll(root) {
+				return
+			}
+		}
+	}
+}
+
+// poll walks root once and sends what changed, false if the poller was closed.
+func (p *Poller) poll(root string) bool {
+	if _, err := os.Stat(root); err != nil {
+		// an unmounted share would look like everything was deleted
+		select {
+		case p.errorChan <- err:
+		default:
+		}
+		return true
+	}
+
+	// pick up .gobackupignore changes
+	p.filter.Reset()
+	current := p.walk(root)
+	if p.ctx.Err() != nil {
+		return false
+	}
+
+	p.mu.Lock()
+	previous := p.snapshots[root]
+	p.snapshots[root] = current
+	p.mu.Unlock()
+
+	for _, event := range diffSnapshots(previous, current) {
+		select {
+		case p.changeChan <- event:
+		case <-p.ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// walk records every file and directory below root the filter lets through.
+func (p *Poller) walk(root string) map[string]polledFile {
+	snapshot := make(map[string]polledFile)
+	start := time.Now()
+	stats := 0
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if p.ctx.Err() != nil {
+			return filepath.SkipAll
+		}
+		if err != nil {
+			return nil
+		}
+		if p.rate > 0 {
+			stats++
+			// pace in steps, not per stat
+			if stats%100 == 0 {
+				if ahead := time.Duration(stats)*time.Second/time.Duration(p.rate) - time.Since(start); ahead > 0 {
+					time.Sleep(ahead)
+				}
+			}
+		}
+
+		if path != root {
+			if p.filter.CheckPath(path, info) != "" {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		id, hasID := fileIDOf(info)
+		snapshot[path] = polledFile{
+			id:      id,
+			hasID:   hasID,
+			size:    info.Size(),
+			modTime: info.ModTime(),
+			mode:    info.Mode(),
+			isDir:   info.IsDir(),
+		}
+		return nil
+	})
+	return snapshot
+}
+
+// diffSnapshots turns two walks into events: renames first, then deletes, then creates and changes.
+func diffSnapshots(previous, current map[string]polledFile) []models.FileEvent {
+	removed := make(map[string]polledFile)
+	added := make(map[string]polledFile)
+	var modified []string
+	for path, before := range previous {
+		now, ok := current[path]
+		switch {
+		case !ok || now.isDir != before.isDir:
+			removed[path] = before
+			if ok {
+				added[path] = now
+			}
+		case !now.isDir && (now.size != before.size || !now.modTime.Equal(before.modTime) || now.mode != before.mode):
+			modified = append(modified, path)
+		}
+	}
+	for path, now := range current {
+		if _, ok := previous[path]; !ok {
+			added[path] = now
+		}
+	}
+
+	// inode -> new path, for pairing moves
+	addedIDs := make(map[fileID]string)
+	for path, now := range added {
+		if now.hasID {
+			addedIDs[now.id] = path
+		}
+	}
+
+	var events []models.FileEvent
+	// directories first and shallow ones before deep ones, a moved tree takes its contents along
+	for _, oldPath := range sortedPaths(removed) {
+		before, ok := removed[oldPath]
+		if !ok || !before.hasID {
+			continue
+		}
+		newPath, ok := addedIDs[before.id]
+		if !ok || added[newPath].isDir != before.isDir {
+			continue
+		}
+
+		event := eventFor(newPath, "RENAME")
+		event.OldPath = oldPath
+		events = append(events, event)
+		delete(removed, oldPath)
+		delete(added, newPath)
+
+		if !before.isDir {
+			if now := current[newPath]; now.size != before.size || !now.modTime.Equal(before.modTime) {
+				modified = append(modified, newPath)
+			}
+			continue
+		}
+		// everything below moved along, only what changed on the way is reported
+		oldPrefix := oldPath + string(filepath.Separator)
+		for path, below := range removed {
+			if !strings.HasPrefix(path, oldPrefix) {
+				continue
+			}
+			movedPath := newPath + path[len(oldPath):]
+			now, ok := added[movedPath]
+			if !ok {
+				continue
+			}
+			delete(removed, path)
+			delete(added, movedPath)
+			if !now.isDir && (now.size != below.size || !now.modTime.Equal(below.modTime) || now.mode != below.mode) {
+				modified = append(modified, movedPath)
+			}
+		}
+	}
+
+	for _, path := range sortedPaths(removed) {
+		if !removed[path].isDir {
+			events = append(events, eventFor(path, "DELETE"))
+		}
+	}
+	for _, path := range sortedPaths(added) {
+		if !added[path].isDir {
+			events = append(events, eventFor(path, "CREATE"))
+		}
+	}
+	sort.Strings(modified)
+	for _, path := range modified {
+		events = append(events, eventFor(path, "MODIFY"))
+	}
+	return events
+}
+
+func sortedPaths(files map[string]polledFile) []string {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,156 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+Rename tracking:
+fsnotify reports a move as a Rename of the old path and a Create of the new one,
+without the inotify cookie that ties the two together. So the watcher remembers
+the inode and size of every file and directory it knows, and a Create whose
+inode (and, for files, size) matches a Rename from the last moment is the other
+half of that move. The pair becomes one RENAME event and the backup moves the
+index entries instead of reading the content again.
+
+A Rename nobody claims within renameWait was a move out of the watched tree (or
+into an excluded directory) and becomes a DELETE.
+*/
+const renameWait = 500 * time.Millisecond
+
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type knownFile struct {
+	id    fileID
+	size  int64
+	isDir bool
+}
+
+type pendingRename struct {
+	path  string
+	size  int64
+	isDir bool
+	timer *time.Timer
+}
+
+// remember records what a path is, for pairing if it's renamed later.
+func (w *Watcher) remember(path string, info os.FileInfo) {
+	id, ok := fileIDOf(info)
+	if !ok {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.known[path] = knownFile{id: id, size: info.Size(), isDir: info.IsDir()}
+}
+
+// forget drops a removed path, and everything below it for a directory.
+func (w *Watcher) forget(path string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.forgetLocked(path)
+}
+
+func (w *Watcher) forgetLocked(path string) {
+	known, ok := w.known[path]
+	if !ok {
+		return
+	}
+	delete(w.known, path)
+	if known.isDir {
+		prefix := path + string(filepath.Separator)
+		for p := range w.known {
+			if strings.HasPrefix(p, prefix) {
+				delete(w.known, p)
+			}
+		}
+	}
+}
+
+// renamed holds on to the old half of a move until the new half shows up.
+func (w *Watcher) renamed(oldPath string) {
+	w.mu.Lock()
+	known, ok := w.known[oldPath]
+	if !ok {
+		w.mu.Unlock()
+		w.send(fsnotify.Event{Name: oldPath, Op: fsnotify.Remove})
+		return
+	}
+	if previous, exists := w.renames[known.id]; exists {
+		previous.timer.Stop()
+	}
+	w.renames[known.id] = &pendingRename{
+		path:  oldPath,
+		size:  known.size,
+		isDir: known.isDir,
+		timer: time.AfterFunc(renameWait, func() { w.renameExpired(known.id, oldPath) }),
+	}
+	w.mu.Unlock()
+}
+
+// renameExpired turns an unclaimed Rename into a delete.
+func (w *Watcher) renameExpired(id fileID, oldPath string) {
+	w.mu.Lock()
+	pending, ok := w.renames[id]
+	if !ok || pending.path != oldPath {
+		w.mu.Unlock()
+		return
+	}
+	delete(w.renames, id)
+	w.forgetLocked(oldPath)
+	w.mu.Unlock()
+
+	w.send(fsnotify.Event{Name: oldPath, Op: fsnotify.Remove})
+}
+
+// pairRename returns the old path if newPath is the new half of a move.
+func (w *Watcher) pairRename(newPath string, info os.FileInfo) (string, bool) {
+	id, ok := fileIDOf(info)
+	if !ok {
+		return "", false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	pending, ok := w.renames[id]
+	if !ok || pending.isDir != info.IsDir() || (!pending.isDir && pending.size != info.Size()) {
+		return "", false
+	}
+	pending.timer.Stop()
+	delete(w.renames, id)
+	w.forgetLocked(pending.path)
+	return pending.path, true
+}
+
+// sendRename reports a completed move, for a directory it also watches the new tree.
+func (w *Watcher) sendRename(oldPath, newPath string, info os.FileInfo) {
+	if info.IsDir() {
+		// same files as before, only their paths changed, nothing to announce
+		w.watchNewDir(newPath, false)
+	} else {
+		w.remember(newPath, info)
+	}
+	// a change to the file right before the move still has to be backed up, under the new name
+	written := w.cancelDebounce(oldPath)
+
+	event := eventFor(newPath, "RENAME")
+	event.OldPath = oldPath
+	go func() {
+		select {
+		case w.changeChan <- event:
+		case <-w.ctx.Done():
+		}
+	}()
+
+	if written {
+		w.send(fsnotify.Event{Name: newPath, Op: fsnotify.Write})
+	}
+}
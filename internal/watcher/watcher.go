@@ -3,10 +3,12 @@ package watcher
 import (
 	"context"
 	"fmt"
+	"gobackup/internal/filter"
 	"gobackup/pkg/models"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 
@@ -25,6 +27,13 @@ type Watcher struct {
 	mu              sync.RWMutex
 	debouncer       map[string]*time.Timer
 	debounceMu      sync.Mutex
+	filter          *filter.Filter
+	// path -> inode, and moves waiting for their other half, see rename.go
+	known   map[string]knownFile
+	renames map[fileID]*pendingRename
+	// directories left without a watch by the inotify limit, see limit.go
+	poller      *Poller
+	limitWarned bool
 }
 
 /*
@@ -36,7 +45,7 @@ Debouncer: 500ms debounce is added to prevent duplicate events. If multiple even
 Concurrency is added, i added rwmutex to prevent concurrent access to the watchedDirs map - multiple reads OR single write.
 
 Event Types:
-CREATE, MODIFY, DELETE, SCAN events are generated.
+CREATE, MODIFY, DELETE, RENAME, SCAN events are generated.
 */
 
 func NewWatcher() (*Watcher, error) {
@@ -55,33 +64,63 @@ func NewWatcher() (*Watcher, error) {
 		cancel:          cancel,
 		mu:              sync.RWMutex{},
 		debouncer:       make(map[string]*time.Timer),
+		known:           make(map[string]knownFile),
+		renames:         make(map[fileID]*pendingRename),
+		poller:          NewPoller(DefaultPollInterval, 0),
 	}, nil
 }
 
+// SetFilter keeps excluded directories unwatched and drops events for excluded files, call it before AddWatch.
+func (w *Watcher) SetFilter(f *filter.Filter) {
+	w.filter = f
+	w.poller.SetFilter(f)
+}
+
 func (w *Watcher) AddWatch(path string) error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	return filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
+	err := filepath.Walk(path, func(walkPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 
 		if info.IsDir() {
+			// not watched at all, so they don't use up inotify watches
+			if walkPath != path && w.filter.CheckPath(walkPath, info) != "" {
+				return filepath.SkipDir
+			}
 			// Add directory to watch - recursive :)
 			if err := w.fsNotifyWatcher.Add(walkPath); err != nil {
-				return err
+				if !watchLimitReached(err) {
+					return err
+				}
+				w.pollDir(walkPath)
+				return filepath.SkipDir
 			}
 			w.watchedDirs[walkPath] = true
 			log.Printf("Watching directory: %s", walkPath)
 		}
+		if id, ok := fileIDOf(info); ok {
+			w.known[walkPath] = knownFile{id: id, size: info.Size(), isDir: info.IsDir()}
+		}
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+
+	if polled := w.poller.Status().Polled; polled > 0 {
+		log.Printf("Warning: %d directories could not be watched (inotify watch limit), watching %d and polling the rest", polled, len(w.watchedDirs))
+	}
+	return nil
 }
 
 func (w *Watcher) Start() {
 	go w.handleEvents()
 	go w.periodicFullScan()
+	w.poller.Start()
+	go w.forwardPolled()
 }
 func (w *Watcher) handleEvents() {
 	for {
@@ -116,6 +155,49 @@ func (w *Watcher) periodicFullScan() {
 	}
 }
 func (w *Watcher) processEvent(event fsnotify.Event) {
+	if filepath.Base(event.Name) == filter.IgnoreFile {
+		w.filter.Forget(filepath.Dir(event.Name))
+	}
+	if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+		w.unwatchDir(event.Name)
+	}
+
+	info, err := os.Lstat(event.Name)
+	if err != nil {
+		// gone, so it can only be checked against the patterns
+		if w.filter.ExcludedPath(event.Name, false) {
+			return
+		}
+		if event.Op&fsnotify.Rename == fsnotify.Rename {
+			w.renamed(event.Name)
+			return
+		}
+		w.forget(event.Name)
+		w.send(event)
+		return
+	}
+	if w.filter.CheckPath(event.Name, info) != "" {
+		return
+	}
+
+	if event.Op&fsnotify.Create == fsnotify.Create {
+		if oldPath, ok := w.pairRename(event.Name, info); ok {
+			w.sendRename(oldPath, event.Name, info)
+			return
+		}
+	}
+	w.remember(event.Name, info)
+	if info.IsDir() {
+		if event.Op&fsnotify.Create == fsnotify.Create {
+			w.watchNewDir(event.Name, true)
+		}
+		return
+	}
+
+	w.send(event)
+}
+
+func (w *Watcher) send(event fsnotify.Event) {
 	w.debouncedSend(event.Name, func() {
 		var operation string
 		switch {
@@ -125,21 +207,101 @@ func (w *Watcher) processEvent(event fsnotify.Event) {
 			operation = "MODIFY"
 		case event.Op&fsnotify.Remove == fsnotify.Remove:
 			operation = "DELETE"
+		case event.Op&fsnotify.Chmod == fsnotify.Chmod:
+			// modes are backed up too, and it mustn't swallow a CREATE still being debounced
+			operation = "MODIFY"
 		default:
 			return
 		}
 		select {
-		case w.changeChan <- models.FileEvent{
-			Path:      event.Name,
-			Operation: operation,
-			Timestamp: time.Now(),
-		}:
+		case w.changeChan <- eventFor(event.Name, operation):
 		case <-w.ctx.Done():
 			return
 		}
 	})
 }
 
+func eventFor(path, operation string) models.FileEvent {
+	return models.FileEvent{
+		Path:      path,
+		Operation: operation,
+		Timestamp: time.Now(),
+	}
+}
+
+/*
+watchNewDir watches a directory created after AddWatch, and everything below it:
+mkdir -p and git clone create whole trees before the first event is handled.
+Each directory is watched before it is listed, so a file shows up either in the
+listing or as an event (or both, the debouncer merges those), and with announce
+the files that are already there are sent as CREATE events.
+*/
+func (w *Watcher) watchNewDir(dir string, announce bool) {
+	var files []string
+
+	w.mu.Lock()
+	filepath.Walk(dir, func(walkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			// removed again while walking
+			return nil
+		}
+		if id, ok := fileIDOf(info); ok {
+			w.known[walkPath] = knownFile{id: id, size: info.Size(), isDir: info.IsDir()}
+		}
+		if !info.IsDir() {
+			if announce && w.filter.CheckPath(walkPath, info) == "" {
+				files = append(files, walkPath)
+			}
+			return nil
+		}
+
+		if walkPath != dir && w.filter.CheckPath(walkPath, info) != "" {
+			return filepath.SkipDir
+		}
+		if !w.watchedDirs[walkPath] {
+			if err := w.fsNotifyWatcher.Add(walkPath); err != nil {
+				if watchLimitReached(err) {
+					polled := w.pollDir(walkPath)
+					if announce {
+						files = append(files, polled...)
+					}
+					return filepath.SkipDir
+				}
+				log.Printf("Warning: failed to watch %s: %v", walkPath, err)
+				return filepath.SkipDir
+			}
+			w.watchedDirs[walkPath] = true
+			log.Printf("Watching directory: %s", walkPath)
+		}
+		return nil
+	})
+	w.mu.Unlock()
+
+	for _, file := range files {
+		w.send(fsnotify.Event{Name: file, Op: fsnotify.Create})
+	}
+}
+
+// unwatchDir forgets a removed or moved directory and the directories below it.
+func (w *Watcher) unwatchDir(dir string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.poller.RemoveWatch(dir)
+	if !w.watchedDirs[dir] {
+		return
+	}
+	prefix := dir + string(filepath.Separator)
+	for watched := range w.watchedDirs {
+		if watched == dir || strings.HasPrefix(watched, prefix) {
+			// inotify drops the watch of a deleted directory by itself, an error here is expected
+			w.fsNotifyWatcher.Remove(watched)
+			delete(w.watchedDirs, watched)
+			log.Printf("Stopped watching directory: %s", watched)
+		}
+	}
+}
+
 func (w *Watcher) performFullScan() {
 	w.mu.Lock()
 	dirs := make([]string, 0, len(w.watchedDirs))
@@ -154,7 +316,14 @@ func (w *Watcher) performFullScan() {
 				return err
 			}
 
-			if !info.IsDir() {
+			skip := w.filter.CheckPath(path, info) != ""
+			if info.IsDir() {
+				if skip {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !skip {
 				select {
 				case w.changeChan <- models.FileEvent{
 					Path:      path,
@@ -0,0 +1,85 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gobackup/internal/filter"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatcherFilter(t *testing.T) {
+	root := t.TempDir()
+	path := func(rel string) string { return filepath.Join(root, filepath.FromSlash(rel)) }
+	writeFile(t, path(filter.IgnoreFile), "*.tmp\n")
+	if err := os.MkdirAll(path("build"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path("sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := filter.New(root, filter.Options{Excludes: []string{"build/"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcher()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.SetFilter(f)
+	if err := w.AddWatch(root); err != nil {
+		t.Fatal(err)
+	}
+	if w.watchedDirs[path("build")] {
+		t.Errorf("excluded directory build is watched")
+	}
+	w.Start()
+
+	writeFile(t, path("keep.txt"), "kept")
+	writeFile(t, path("a.tmp"), "excluded by .gobackupignore")
+	writeFile(t, path("sub/y.txt"), "kept")
+	// a changed .gobackupignore applies to what comes after it
+	writeFile(t, path("sub/"+filter.IgnoreFile), "*.log\n")
+	writeFile(t, path("sub/z.log"), "excluded by the new sub/.gobackupignore")
+	writeFile(t, path("sub/z.txt"), "kept")
+
+	want := map[string]bool{
+		path("keep.txt"):                 true,
+		path("sub/y.txt"):                true,
+		path("sub/z.txt"):                true,
+		path("sub/" + filter.IgnoreFile): true,
+	}
+	seen := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	// once everything expected arrived, wait out the debounce delay so excluded events had their chance too
+	var settle <-chan time.Time
+	for {
+		select {
+		case event := <-w.Changes():
+			if !want[event.Path] {
+				t.Errorf("event for excluded %s (%s)", event.Path, event.Operation)
+			}
+			seen[event.Path] = true
+			if len(seen) == len(want) && settle == nil {
+				settle = time.After(time.Second)
+			}
+		case <-settle:
+			return
+		case <-timeout:
+			t.Fatalf("got events for %v, want %v", seen, want)
+		}
+	}
+}
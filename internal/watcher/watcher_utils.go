@@ -28,6 +28,19 @@ func (w *Watcher) debouncedSend(path string, fn func()) {
 
 }
 
+// cancelDebounce drops the event waiting for path, true if there was one.
+func (w *Watcher) cancelDebounce(path string) bool {
+	w.debounceMu.Lock()
+	defer w.debounceMu.Unlock()
+
+	timer, exists := w.debouncer[path]
+	if !exists {
+		return false
+	}
+	delete(w.debouncer, path)
+	return timer.Stop()
+}
+
 func (w *Watcher) Changes() <-chan models.FileEvent {
 	return w.changeChan
 }
@@ -38,5 +51,6 @@ func (w *Watcher) Errors() <-chan error {
 
 func (w *Watcher) Close() error {
 	w.cancel()
+	w.poller.Close()
 	return w.fsNotifyWatcher.Close()
 }
@@ -9,6 +9,8 @@ type ChunkInfo struct {
 	Size           int64  `json:"size"`
 	Hash           string `json:"hash"`
 	CompressedSize int64  `json:"compressed_size"`
+	// copied chunks: source repository ID and the chunk's hash there, see backup.CopyFrom
+	Source string `json:"source,omitempty"`
 }
 
 type BackupMetadata struct {
@@ -17,6 +19,10 @@ type BackupMetadata struct {
 	UpdatedAt time.Time           `json:"updated_at"`
 	Files     map[string]FileInfo `json:"files"`
 	Chunks    []ChunkInfo         `json:"chunks"`
+	// last journal record folded into this checkpoint
+	JournalSeq int64 `json:"journal_seq"`
+	// root name -> directory it was last backed up from, files of a root are stored under name/
+	Roots map[string]string `json:"roots,omitempty"`
 }
 
 type FileInfo struct {
@@ -25,17 +31,36 @@ type FileInfo struct {
 	ModTime   time.Time `json:"mod_time"`
 	Hash      string    `json:"hash"`
 	ChunkRefs []int     `json:"chunk_refs"`
+	Extents   []Extent  `json:"extents,omitempty"`
 	IsDeleted bool      `json:"is_deleted"`
+	// permission bits, 0 for entries from before modes were recorded
+	Mode uint32 `json:"mode,omitempty"`
+}
+
+// Root is one of the directories backed up into a repository.
+type Root struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Extent locates a piece of a file's content inside a chunk.
+type Extent struct {
+	ChunkID int   `json:"chunk_id"`
+	Offset  int64 `json:"offset"`
+	Size    int64 `json:"size"`
 }
 
 type FileEvent struct {
 	Path      string
-	Operation string // CREATE, MODIFY, DELETE
+	Operation string // CREATE, MODIFY, DELETE, RENAME
 	Timestamp time.Time
+	// where a renamed file or directory was before
+	OldPath string
 }
 
 type FileChange struct {
 	Path      string
 	Operation string
 	FileInfo  *FileInfo
+	OldPath   string
 }